@@ -0,0 +1,389 @@
+package dragonfruit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/gedex/inflector"
+)
+
+// The aggregation path segment and query params.  Each aggregate function
+// takes a list of numeric properties
+// (e.g. /orders/_aggregate?groupBy=status&sum=total&avg=total,quantity).
+const (
+	AGGREGATE = "_aggregate"
+	GROUPBY   = "groupBy"
+	SUM       = "sum"
+	AVG       = "avg"
+	MIN       = "min"
+	MAX       = "max"
+)
+
+// AggregateFunctions lists the aggregate functions in the order they're
+// documented.
+var AggregateFunctions = []string{SUM, AVG, MIN, MAX}
+
+// An Aggregation describes an aggregate query on a collection.
+type Aggregation struct {
+	// the property results are grouped by, if any
+	GroupBy string
+	// the numeric properties for each aggregate function
+	Functions map[string][]string
+}
+
+// Fields returns every numeric property used by the aggregation, without
+// duplicates.
+func (agg *Aggregation) Fields() []string {
+	seen := make(map[string]bool)
+	out := make([]string, 0)
+	for _, function := range AggregateFunctions {
+		for _, field := range agg.Functions[function] {
+			if !seen[field] {
+				seen[field] = true
+				out = append(out, field)
+			}
+		}
+	}
+	return out
+}
+
+// An AggregateResult holds the aggregates of a single group.  Only the
+// requested functions are set.
+type AggregateResult struct {
+	Group interface{}        `json:"group"`
+	Count int                `json:"count"`
+	Sum   map[string]float64 `json:"sum,omitempty"`
+	Avg   map[string]float64 `json:"avg,omitempty"`
+	Min   map[string]float64 `json:"min,omitempty"`
+	Max   map[string]float64 `json:"max,omitempty"`
+}
+
+// FieldStats holds the statistics of a numeric property in a group.
+type FieldStats struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// add adds a value to a set of statistics.
+func (s *FieldStats) add(val float64) {
+	if s.Count == 0 || val < s.Min {
+		s.Min = val
+	}
+	if s.Count == 0 || val > s.Max {
+		s.Max = val
+	}
+	s.Count++
+	s.Sum = s.Sum + val
+}
+
+// SetStats sets the requested aggregates of a property from its statistics.
+func (r *AggregateResult) SetStats(agg *Aggregation, field string, stats FieldStats) {
+	if stats.Count == 0 {
+		return
+	}
+
+	values := map[string]float64{
+		SUM: stats.Sum,
+		AVG: stats.Sum / float64(stats.Count),
+		MIN: stats.Min,
+		MAX: stats.Max,
+	}
+
+	for _, function := range AggregateFunctions {
+		for _, f := range agg.Functions[function] {
+			if f != field {
+				continue
+			}
+			target := r.functionMap(function)
+			target[field] = values[function]
+		}
+	}
+}
+
+// functionMap returns (and creates if needed) the map holding the values of
+// an aggregate function.
+func (r *AggregateResult) functionMap(function string) map[string]float64 {
+	var target *map[string]float64
+	switch function {
+	case SUM:
+		target = &r.Sum
+	case AVG:
+		target = &r.Avg
+	case MIN:
+		target = &r.Min
+	default:
+		target = &r.Max
+	}
+	if *target == nil {
+		*target = make(map[string]float64)
+	}
+	return *target
+}
+
+// An Aggregator is a backend which can run aggregate queries natively.
+// Backends which don't implement it are aggregated by the frontend, which
+// loads every matching document.
+type Aggregator interface {
+	// Aggregate runs the Aggregation of a QueryParams struct against the
+	// collection at its Path.  Other query params are applied as filters.
+	Aggregate(QueryParams) (Container, error)
+}
+
+// AggregateDocuments groups a set of documents and computes the requested
+// aggregates for each group.  Results are ordered by group.
+func AggregateDocuments(docs []interface{}, agg *Aggregation) []*AggregateResult {
+	results := make([]*AggregateResult, 0)
+	groups := make(map[string]*AggregateResult)
+	stats := make(map[string]map[string]*FieldStats)
+	fields := agg.Fields()
+
+	for _, doc := range docs {
+		var group interface{}
+		if d, ok := doc.(map[string]interface{}); ok && agg.GroupBy != "" {
+			group = d[agg.GroupBy]
+		}
+
+		key := GroupKey(group)
+		result, ok := groups[key]
+		if !ok {
+			result = &AggregateResult{Group: group}
+			groups[key] = result
+			stats[key] = make(map[string]*FieldStats)
+			results = append(results, result)
+		}
+		result.Count++
+
+		for _, field := range fields {
+			s, ok := stats[key][field]
+			if !ok {
+				s = &FieldStats{}
+				stats[key][field] = s
+			}
+			for _, val := range lookupPath(doc, []string{field}) {
+				if num, ok := val.(float64); ok {
+					s.add(num)
+				}
+			}
+		}
+	}
+
+	for key, result := range groups {
+		for field, s := range stats[key] {
+			result.SetStats(agg, field, *s)
+		}
+	}
+
+	SortAggregates(results)
+	return results
+}
+
+// GroupKey returns a string which identifies a group value.
+func GroupKey(group interface{}) string {
+	out, _ := json.Marshal(group)
+	return string(out)
+}
+
+// SortAggregates orders aggregate results by group.
+func SortAggregates(results []*AggregateResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return CompareValues(results[i].Group, results[j].Group) < 0
+	})
+}
+
+// MakeAggregateContainer wraps a set of aggregate results in a container.
+func MakeAggregateContainer(results []*AggregateResult) Container {
+	c := Container{}
+	c.Meta.Count = len(results)
+	c.Meta.Total = len(results)
+	c.Meta.ResponseCode = 200
+	c.Meta.ResponseMessage = "Ok."
+	c.ContainerType = "Aggregate" + strings.Title(ContainerName)
+	c.Results = make([]interface{}, 0)
+	for _, result := range results {
+		c.Results = append(c.Results, result)
+	}
+	return c
+}
+
+// makeAggregateAPI creates the aggregation API of a collection
+// (e.g. /orders/_aggregate).  Every model can be counted, but only string
+// properties can be grouped by and only numeric properties aggregated.
+func makeAggregateAPI(schemaName string, schema *Schema,
+	upstreamParams []*Parameter, cnf Conf) *PathItem {
+
+	groups := make([]interface{}, 0)
+	numbers := make([]interface{}, 0)
+	propNames := make([]string, 0)
+	for propName := range schema.Properties {
+		propNames = append(propNames, propName)
+	}
+	sort.Strings(propNames)
+
+	for _, propName := range propNames {
+		switch schema.Properties[propName].Type {
+		case "string":
+			groups = append(groups, propName)
+		case "integer", "number":
+			numbers = append(numbers, propName)
+		}
+	}
+
+	getOp := &Operation{
+		OperationID: "aggregate" + inflector.Pluralize(schemaName),
+		Summary:     "Count and aggregate " + inflector.Pluralize(inflector.Singularize(schemaName)) + ".",
+		Description: "Returns the number of items in each group, plus the sum, average, " +
+			"minimum or maximum of the requested numeric properties.",
+		Responses: copyResponseMap(cnf.CommonCollectionResponses),
+		Aggregate: schemaName,
+	}
+
+	getOp.Responses["200"] = &Response{
+		Schema:      makeAggregateContainerSchema(),
+		Description: "Aggregates of " + inflector.Pluralize(schemaName),
+	}
+
+	if len(groups) > 0 {
+		getOp.Parameters = append(getOp.Parameters, &Parameter{
+			Name:        GROUPBY,
+			In:          "query",
+			Description: "The property to group results by.",
+			Type:        "string",
+			Enum:        groups,
+		})
+	}
+	if len(numbers) > 0 {
+		for _, function := range AggregateFunctions {
+			getOp.Parameters = append(getOp.Parameters, &Parameter{
+				Name:        function,
+				In:          "query",
+				Description: "A comma separated list of numeric properties to " + function + ".",
+				Type:        "array",
+				Items: &Items{
+					Type: "string",
+					Enum: numbers,
+				},
+				CollectionFormat: "csv",
+			})
+		}
+	}
+
+	// aggregates can be filtered like the collection
+	for _, propName := range propNames {
+		params := makePropertyParams(propName, schema.Properties[propName])
+		getOp.Parameters = append(getOp.Parameters, params...)
+	}
+	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
+
+	return &PathItem{
+		Get:     getOp,
+		Options: makeOptionsOperation("GET", upstreamParams),
+	}
+}
+
+// makeAggregateContainerSchema describes the container returned by
+// aggregation APIs.
+func makeAggregateContainerSchema() *Schema {
+	// maps of property names to numbers
+	numberMap := &Schema{
+		Type:                 "object",
+		AdditionalProperties: true,
+	}
+
+	return &Schema{
+		Properties: map[string]*Schema{
+			"results": &Schema{
+				Type: "array",
+				Items: &Schema{
+					Properties: map[string]*Schema{
+						"group": &Schema{},
+						"count": &Schema{Type: "integer"},
+						SUM:     numberMap,
+						AVG:     numberMap,
+						MIN:     numberMap,
+						MAX:     numberMap,
+					},
+				},
+			},
+			"containerType": &Schema{
+				Type: "string",
+			},
+		},
+		Required: []string{"containerType"},
+		AllOf: []*Schema{
+			&Schema{
+				Ref: MakeRef(strings.Title(ContainerName)),
+			},
+		},
+	}
+}
+
+// serveAggregate runs an aggregate query for the frontend.  The query params
+// have already been coerced.
+func serveAggregate(db DbBackend, path string, pathParams map[string]interface{},
+	qParams map[string]interface{}, owner string, ctx context.Context) (int, string) {
+
+	agg := &Aggregation{
+		Functions: make(map[string][]string),
+	}
+	agg.GroupBy, _ = qParams[GROUPBY].(string)
+	delete(qParams, GROUPBY)
+	for _, function := range AggregateFunctions {
+		if fields := stringList(qParams[function]); len(fields) > 0 {
+			agg.Functions[function] = fields
+		}
+		delete(qParams, function)
+	}
+
+	q := QueryParams{
+		Path:        strings.TrimSuffix(path, "/"+AGGREGATE),
+		PathParams:  pathParams,
+		QueryParams: qParams,
+		Aggregation: agg,
+		Owner:       owner,
+		Context:     ctx,
+	}
+
+	var (
+		result Container
+		err    error
+	)
+	if aggregator, ok := db.(Aggregator); ok {
+		result, err = aggregator.Aggregate(q)
+	} else {
+		result, err = aggregateResults(db, q)
+	}
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+	return 200, string(out)
+}
+
+// aggregateResults runs an aggregate query for backends which don't
+// implement Aggregator.
+func aggregateResults(db DbBackend, q QueryParams) (Container, error) {
+	if q.Aggregation == nil {
+		return Container{}, errors.New("No aggregation was requested.")
+	}
+
+	docs := make([]interface{}, 0)
+	_, err := queryAll(db, q, func(doc interface{}) {
+		docs = append(docs, doc)
+	})
+	if err != nil {
+		return Container{}, err
+	}
+
+	return MakeAggregateContainer(AggregateDocuments(docs, q.Aggregation)), nil
+}
@@ -0,0 +1,191 @@
+package dragonfruit
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Audit properties, which are set by the frontend and can't be written by
+// clients.
+const (
+	CREATEDAT = "createdAt"
+	UPDATEDAT = "updatedAt"
+	CREATEDBY = "createdBy"
+	UPDATEDBY = "updatedBy"
+)
+
+// The header holding the user making a request, when it's set by an
+// authenticating proxy (see AuditUser)
+const USERHEADER = "X-User"
+
+// AuditFields lists the audit properties.
+var AuditFields = []string{CREATEDAT, UPDATEDAT, CREATEDBY, UPDATEDBY}
+
+// AuditUser returns the user making a request, for the createdBy and
+// updatedBy properties: the authenticated user, or else the user header.
+// Requests without a user leave them unchanged.
+var AuditUser = func(req *http.Request) string {
+	if auth := GetAuthorization(req); auth != nil && auth.User != "" {
+		return auth.User
+	}
+	return req.Header.Get(USERHEADER)
+}
+
+// auditStamp holds the audit values of a single request.  A nil stamp
+// leaves bodies unchanged, so operations without audit properties don't need
+// to check for them.
+type auditStamp struct {
+	user string
+	now  string
+}
+
+// newAuditStamp returns the audit stamp of a request, or nil if the
+// operation doesn't set audit properties.
+func newAuditStamp(op *Operation, req *http.Request) *auditStamp {
+	if !op.Audit {
+		return nil
+	}
+	return &auditStamp{
+		user: AuditUser(req),
+		now:  time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// addAuditFields adds the (read only) audit properties to a model.
+func addAuditFields(schema *Schema) {
+	if schema.Properties == nil {
+		schema.Properties = make(map[string]*Schema)
+	}
+	for _, field := range []string{CREATEDAT, UPDATEDAT} {
+		schema.Properties[field] = &Schema{
+			Type:     "string",
+			Format:   "date-time",
+			ReadOnly: true,
+		}
+	}
+	for _, field := range []string{CREATEDBY, UPDATEDBY} {
+		schema.Properties[field] = &Schema{
+			Type:     "string",
+			ReadOnly: true,
+		}
+	}
+}
+
+// create stamps the body of a new item.  Bodies which aren't maps are left
+// for the backend to reject.
+func (s *auditStamp) create(body []byte) ([]byte, error) {
+	doc, ok := s.decode(body)
+	if !ok {
+		return body, nil
+	}
+	s.set(doc, CREATEDAT, CREATEDBY)
+	s.set(doc, UPDATEDAT, UPDATEDBY)
+	return json.Marshal(doc)
+}
+
+// replace stamps the body of a PUT, keeping the creation properties of the
+// item being replaced.
+func (s *auditStamp) replace(body []byte, existing interface{}) ([]byte, error) {
+	doc, ok := s.decode(body)
+	if !ok {
+		return body, nil
+	}
+	if old, ok := existing.(map[string]interface{}); ok {
+		for _, field := range []string{CREATEDAT, CREATEDBY} {
+			if val, ok := old[field]; ok {
+				doc[field] = val
+			}
+		}
+	}
+	s.set(doc, UPDATEDAT, UPDATEDBY)
+	return json.Marshal(doc)
+}
+
+// patch stamps a merge patch or JSON patch.  JSON patches can't change audit
+// properties, so they return a PatchError if they try to.
+func (s *auditStamp) patch(format string, body []byte) ([]byte, error) {
+	if s == nil {
+		return body, nil
+	}
+
+	if format != JSONPATCH {
+		doc, ok := s.decode(body)
+		if !ok {
+			return body, nil
+		}
+		s.set(doc, UPDATEDAT, UPDATEDBY)
+		return json.Marshal(doc)
+	}
+
+	var ops []PatchOperation
+	if json.Unmarshal(body, &ops) != nil {
+		return body, nil
+	}
+	for _, op := range ops {
+		if op.Op == "test" {
+			continue
+		}
+		for _, pointer := range []string{op.Path, op.From} {
+			path, err := parsePointer(pointer)
+			if err == nil && len(path) > 0 && isAuditField(path[0]) {
+				return body, newPatchError("The property " + path[0] + " is read only.")
+			}
+		}
+	}
+
+	ops = append(ops, PatchOperation{Op: "add", Path: "/" + UPDATEDAT, Value: s.now})
+	if s.user != "" {
+		ops = append(ops, PatchOperation{Op: "add", Path: "/" + UPDATEDBY, Value: s.user})
+	}
+	return json.Marshal(ops)
+}
+
+// decode unmarshals a body and removes any audit properties sent by the
+// client.  It returns false for nil stamps and bodies which aren't maps.
+func (s *auditStamp) decode(body []byte) (map[string]interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	var doc map[string]interface{}
+	if json.Unmarshal(body, &doc) != nil || doc == nil {
+		return nil, false
+	}
+	for _, field := range AuditFields {
+		delete(doc, field)
+	}
+	return doc, true
+}
+
+// set sets a timestamp property and (if the user is known) a user property.
+func (s *auditStamp) set(doc map[string]interface{}, at string, by string) {
+	doc[at] = s.now
+	if s.user != "" {
+		doc[by] = s.user
+	}
+}
+
+// isAuditField reports whether a property is an audit property.
+func isAuditField(name string) bool {
+	for _, field := range AuditFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// loadExisting loads the item a PUT replaces, so its creation properties can
+// be kept.  It returns nil if the item can't be loaded.
+func loadExisting(db DbBackend, path string, pathParams map[string]interface{}) interface{} {
+	c, err := db.Query(QueryParams{
+		Path:        path,
+		PathParams:  pathParams,
+		QueryParams: make(qparam),
+	})
+	if err != nil || len(c.Results) == 0 {
+		return nil
+	}
+	return c.Results[0]
+}
@@ -0,0 +1,447 @@
+package dragonfruit
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// Security scheme types (see SecurityScheme)
+const (
+	APIKEYSCHEME = "apiKey"
+	BASICSCHEME  = "basic"
+	OAUTH2SCHEME = "oauth2"
+)
+
+// Authentication errors
+const (
+	UNAUTHORIZEDERROR = "Authentication is required."
+	FORBIDDENERROR    = "The credentials don't grant the required scopes."
+)
+
+// authorizationKey is the request context key of the authorization of a
+// request.
+type authorizationKey struct{}
+
+// GetAuthorization returns the credentials which authorized a request, or
+// nil if it has none.
+func GetAuthorization(req *http.Request) *Authorization {
+	auth, _ := req.Context().Value(authorizationKey{}).(*Authorization)
+	return auth
+}
+
+// authenticator checks credentials against the ones in the configuration.
+type authenticator struct {
+	apiKeys    map[string]string
+	basicUsers map[string]string
+	userRoles  map[string][]string
+	jwtSecret  []byte
+	jwtKey     *rsa.PublicKey
+}
+
+// newAuthenticator reads the credentials in a configuration.
+func newAuthenticator(cnf Conf) (*authenticator, error) {
+	out := &authenticator{
+		apiKeys:    cnf.APIKeys,
+		basicUsers: cnf.BasicUsers,
+		userRoles:  cnf.UserRoles,
+	}
+	if cnf.JWTKey == "" {
+		return out, nil
+	}
+
+	block, _ := pem.Decode([]byte(cnf.JWTKey))
+	if block == nil {
+		out.jwtSecret = []byte(cnf.JWTKey)
+		return out, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The JWT key must be an RSA public key.")
+	}
+	out.jwtKey = rsaKey
+	return out, nil
+}
+
+// operationSecurity returns the security requirements of an operation,
+// which default to the ones of the definition.
+func operationSecurity(rd *Swagger, op *Operation) []map[string][]string {
+	if op != nil && op.Security != nil {
+		return op.Security
+	}
+	return rd.Security
+}
+
+// adminSecurity returns the security requirements of the admin APIs (e.g.
+// webhooks and metrics): the definition's, or else the ones of the
+// generated operations.
+func adminSecurity(rd *Swagger, cnf Conf) []map[string][]string {
+	if len(rd.Security) > 0 {
+		return rd.Security
+	}
+	return cnf.Security
+}
+
+// authenticate returns a handler which rejects requests that don't meet any
+// of a set of security requirements.  Accepted requests carry their
+// authorization (see GetAuthorization), which is also mapped for later
+// handlers.  Without requirements, any valid credentials are used (so roles
+// apply) but none are needed.
+func authenticate(rd *Swagger, requirements []map[string][]string) martini.Handler {
+	return func(c martini.Context, auth *authenticator, req *http.Request, res http.ResponseWriter) {
+		if len(requirements) == 0 {
+			if authz := auth.identify(rd, req); authz != nil {
+				c.Map(req.WithContext(context.WithValue(req.Context(), authorizationKey{}, authz)))
+				c.Map(authz)
+			}
+			return
+		}
+
+		authz, code := auth.authorize(rd, requirements, req)
+		if authz == nil {
+			for _, challenge := range challenges(rd, requirements, code) {
+				res.Header().Add("WWW-Authenticate", challenge)
+			}
+			message := UNAUTHORIZEDERROR
+			if code == 403 {
+				message = FORBIDDENERROR
+			}
+			writeError(res, code, message)
+			return
+		}
+		authz.Roles = auth.roles(authz)
+
+		c.Map(req.WithContext(context.WithValue(req.Context(), authorizationKey{}, authz)))
+		c.Map(authz)
+	}
+}
+
+// authorize returns the authorization of the first security requirement a
+// request meets.  Otherwise it returns the status code to respond with: 403
+// if the request was authenticated but lacks scopes, or else 401.
+func (a *authenticator) authorize(rd *Swagger, requirements []map[string][]string,
+	req *http.Request) (*Authorization, int) {
+
+	code := 401
+	for _, requirement := range requirements {
+		var out *Authorization
+		met := true
+		for name, scopes := range requirement {
+			scheme, ok := rd.SecurityDefinitions[name]
+			if !ok {
+				met = false
+				break
+			}
+			authz := a.check(scheme, req)
+			if authz == nil {
+				met = false
+				break
+			}
+			authz.Scheme = name
+			if !hasScopes(authz, scopes) {
+				code = 403
+				met = false
+				break
+			}
+			if out == nil {
+				out = authz
+			}
+		}
+		if met {
+			if out == nil {
+				out = &Authorization{}
+			}
+			return out, 0
+		}
+	}
+	return nil, code
+}
+
+// identify returns the authorization of the first security scheme a
+// request has valid credentials for, or nil if it has none.
+func (a *authenticator) identify(rd *Swagger, req *http.Request) *Authorization {
+	names := make([]string, 0)
+	for name := range rd.SecurityDefinitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if authz := a.check(rd.SecurityDefinitions[name], req); authz != nil {
+			authz.Scheme = name
+			authz.Roles = a.roles(authz)
+			return authz
+		}
+	}
+	return nil
+}
+
+// roles returns the roles of an authorized user: the ones in the roles (or
+// role) claim of a bearer token, and the ones configured for the user.
+func (a *authenticator) roles(authz *Authorization) []string {
+	out := make([]string, 0)
+	add := func(role string) {
+		if role != "" && !containsString(out, role) {
+			out = append(out, role)
+		}
+	}
+
+	if roles, ok := authz.Claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if str, ok := role.(string); ok {
+				add(str)
+			}
+		}
+	}
+	if role, ok := authz.Claims["role"].(string); ok {
+		add(role)
+	}
+	if authz.User != "" {
+		for _, role := range a.userRoles[authz.User] {
+			add(role)
+		}
+	}
+	return out
+}
+
+// check returns the authorization of the credentials a request sends for a
+// security scheme, or nil if they aren't valid.
+func (a *authenticator) check(scheme *SecurityScheme, req *http.Request) *Authorization {
+	switch scheme.Type {
+	case APIKEYSCHEME:
+		key := apiKeyValue(scheme, req)
+		if key == "" {
+			return nil
+		}
+		for k, user := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				return &Authorization{User: user}
+			}
+		}
+
+	case BASICSCHEME:
+		user, password, ok := req.BasicAuth()
+		if !ok {
+			return nil
+		}
+		expected, ok := a.basicUsers[user]
+		if ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+			return &Authorization{User: user}
+		}
+
+	case OAUTH2SCHEME:
+		header := req.Header.Get("Authorization")
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+			return nil
+		}
+		claims, err := a.parseJWT(strings.TrimSpace(header[7:]))
+		if err != nil {
+			return nil
+		}
+		out := &Authorization{Claims: claims, Scopes: tokenScopes(claims)}
+		out.User, _ = claims["sub"].(string)
+		return out
+	}
+	return nil
+}
+
+// apiKeyValue returns the key a request sends for an apiKey scheme.
+func apiKeyValue(scheme *SecurityScheme, req *http.Request) string {
+	if scheme.In == "query" {
+		return req.URL.Query().Get(scheme.Name)
+	}
+	return req.Header.Get(scheme.Name)
+}
+
+// parseJWT validates a JWT and returns its claims.  Tokens must be signed
+// with the configured key, and be within their exp and nbf times.
+func (a *authenticator) parseJWT(token string) (map[string]interface{}, error) {
+	invalid := errors.New("The token is not valid.")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if decodeJWTPart(parts[0], &header) != nil {
+		return nil, invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && a.jwtSecret != nil:
+		mac := hmac.New(sha256.New, a.jwtSecret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, invalid
+		}
+	case header.Alg == "RS256" && a.jwtKey != nil:
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(a.jwtKey, crypto.SHA256, sum[:], sig) != nil {
+			return nil, invalid
+		}
+	default:
+		return nil, invalid
+	}
+
+	claims := make(map[string]interface{})
+	if decodeJWTPart(parts[1], &claims) != nil {
+		return nil, invalid
+	}
+
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now >= exp {
+		return nil, errors.New("The token has expired.")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, invalid
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes the header or claims of a JWT.
+func decodeJWTPart(part string, v interface{}) error {
+	byt, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(byt, v)
+}
+
+// tokenScopes returns the scopes granted by a token, from either a space
+// separated scope claim or an scp list.
+func tokenScopes(claims map[string]interface{}) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	out := make([]string, 0)
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				out = append(out, str)
+			}
+		}
+	}
+	return out
+}
+
+// hasScopes reports whether an authorization grants a set of scopes.
+func hasScopes(authz *Authorization, scopes []string) bool {
+	for _, scope := range scopes {
+		if !containsString(authz.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// challenges returns the WWW-Authenticate headers for a rejected request.
+func challenges(rd *Swagger, requirements []map[string][]string, code int) []string {
+	out := make([]string, 0)
+	for _, requirement := range requirements {
+		for name := range requirement {
+			scheme, ok := rd.SecurityDefinitions[name]
+			if !ok {
+				continue
+			}
+			var challenge string
+			switch {
+			case scheme.Type == BASICSCHEME && code == 401:
+				challenge = `Basic realm="` + rd.Info.Title + `"`
+			case scheme.Type == OAUTH2SCHEME && code == 401:
+				challenge = "Bearer"
+			case scheme.Type == OAUTH2SCHEME:
+				challenge = `Bearer error="insufficient_scope"`
+			}
+			if challenge != "" && !containsString(out, challenge) {
+				out = append(out, challenge)
+			}
+		}
+	}
+	return out
+}
+
+// secureOperations adds the security requirements of a configuration, and
+// the responses they cause, to every operation of a definition.  The
+// definition gets any security schemes from the swagger template which it
+// lacks.
+func secureOperations(sw *Swagger, cnf Conf) error {
+	if len(cnf.Security) == 0 {
+		return nil
+	}
+
+	if sw.SecurityDefinitions == nil {
+		sw.SecurityDefinitions = make(map[string]*SecurityScheme)
+	}
+	if cnf.SwaggerTemplate != nil {
+		for name, scheme := range cnf.SwaggerTemplate.SecurityDefinitions {
+			if _, ok := sw.SecurityDefinitions[name]; !ok {
+				sw.SecurityDefinitions[name] = scheme
+			}
+		}
+	}
+
+	scoped := false
+	for _, requirement := range cnf.Security {
+		for name, scopes := range requirement {
+			if _, ok := sw.SecurityDefinitions[name]; !ok {
+				return errors.New("The security scheme " + name + " is not defined.")
+			}
+			scoped = scoped || len(scopes) > 0
+		}
+	}
+
+	for _, pathitem := range sw.Paths {
+		for _, op := range []*Operation{pathitem.Get, pathitem.Put, pathitem.Post,
+			pathitem.Delete, pathitem.Head, pathitem.Patch} {
+
+			if op == nil {
+				continue
+			}
+			op.Security = cnf.Security
+			if op.Responses == nil {
+				op.Responses = make(map[string]*Response)
+			}
+			op.Responses["401"] = &Response{
+				Description: UNAUTHORIZEDERROR,
+				Schema:      &Schema{Type: "string"},
+			}
+			if scoped {
+				op.Responses["403"] = &Response{
+					Description: FORBIDDENERROR,
+					Schema:      &Schema{Type: "string"},
+				}
+			}
+		}
+	}
+	return nil
+}
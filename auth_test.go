@@ -0,0 +1,202 @@
+package dragonfruit
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the HMAC secret tokens in the tests are signed with
+const testJWTSecret = "sekrit"
+
+// makeTestJWT makes a JWT with an alg header and a set of claims, and signs
+// it with sign.
+func makeTestJWT(t *testing.T, alg string, claims map[string]interface{},
+	sign func(signed []byte) []byte) string {
+
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+// signHS256 returns a func which signs tokens with an HMAC secret.
+func signHS256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+// signRS256 returns a func which signs tokens with an RSA key.
+func signRS256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	hmacAuth, err := newAuthenticator(Conf{JWTKey: testJWTSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaAuth, err := newAuthenticator(Conf{JWTKey: pemKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noAuth, err := newAuthenticator(Conf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "alice", "exp": now + 60}
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	tests := []struct {
+		name  string
+		auth  *authenticator
+		token string
+		valid bool
+	}{
+		{"HS256", hmacAuth, makeTestJWT(t, "HS256", valid, signHS256(testJWTSecret)), true},
+		{"HS256 with the wrong secret", hmacAuth, makeTestJWT(t, "HS256", valid, signHS256("other")), false},
+		{"RS256", rsaAuth, makeTestJWT(t, "RS256", valid, signRS256(t, key)), true},
+		{"RS256 with the wrong key", rsaAuth, makeTestJWT(t, "RS256", valid, signRS256(t, other)), false},
+		{"RS256 with an HMAC secret", hmacAuth, makeTestJWT(t, "RS256", valid, signRS256(t, key)), false},
+		{"HS256 with an RSA key", rsaAuth, makeTestJWT(t, "HS256", valid, signHS256(pemKey)), false},
+		{"unsigned tokens", hmacAuth, makeTestJWT(t, "none", valid, func([]byte) []byte { return nil }), false},
+		{"no key configured", noAuth, makeTestJWT(t, "HS256", valid, signHS256("")), false},
+		{"expired tokens", hmacAuth, makeTestJWT(t, "HS256",
+			map[string]interface{}{"exp": now - 1}, signHS256(testJWTSecret)), false},
+		{"tokens expiring now", hmacAuth, makeTestJWT(t, "HS256",
+			map[string]interface{}{"exp": now}, signHS256(testJWTSecret)), false},
+		{"tokens not valid yet", hmacAuth, makeTestJWT(t, "HS256",
+			map[string]interface{}{"nbf": now + 60}, signHS256(testJWTSecret)), false},
+		{"tokens valid since now", hmacAuth, makeTestJWT(t, "HS256",
+			map[string]interface{}{"nbf": now - 1}, signHS256(testJWTSecret)), true},
+		{"tokens without times", hmacAuth, makeTestJWT(t, "HS256",
+			map[string]interface{}{"sub": "bob"}, signHS256(testJWTSecret)), true},
+		{"too few parts", hmacAuth, "abc.def", false},
+		{"too many parts", hmacAuth, "a.b.c.d", false},
+		{"bad headers", hmacAuth, "!!!.e30.", false},
+		{"bad signatures", hmacAuth, makeTestJWT(t, "HS256", valid, signHS256(testJWTSecret)) + "!", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.auth.parseJWT(tt.token)
+			if tt.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatalf("got claims %v, want an error", claims)
+			}
+		})
+	}
+}
+
+func TestParseJWTClaims(t *testing.T) {
+	auth, err := newAuthenticator(Conf{JWTKey: testJWTSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := makeTestJWT(t, "HS256", map[string]interface{}{
+		"sub":   "alice",
+		"scope": "read write",
+		"roles": []string{"editor"},
+	}, signHS256(testJWTSecret))
+
+	claims, err := auth.parseJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "alice" {
+		t.Errorf("got sub %v, want alice", claims["sub"])
+	}
+	if got := tokenScopes(claims); !reflect.DeepEqual(got, []string{"read", "write"}) {
+		t.Errorf("got scopes %v, want [read write]", got)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   []string
+	}{
+		{"scope claims", map[string]interface{}{"scope": "a  b c"}, []string{"a", "b", "c"}},
+		{"scp lists", map[string]interface{}{"scp": []interface{}{"a", 1, "b"}}, []string{"a", "b"}},
+		{"scope wins over scp", map[string]interface{}{"scope": "a", "scp": []interface{}{"b"}}, []string{"a"}},
+		{"no scopes", map[string]interface{}{}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenScopes(tt.claims); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorRoles(t *testing.T) {
+	auth := &authenticator{userRoles: map[string][]string{"alice": {"admin", "editor"}}}
+
+	tests := []struct {
+		name  string
+		authz *Authorization
+		want  []string
+	}{
+		{"roles claims", &Authorization{Claims: map[string]interface{}{
+			"roles": []interface{}{"editor", "viewer"}}}, []string{"editor", "viewer"}},
+		{"role claims", &Authorization{Claims: map[string]interface{}{"role": "viewer"}},
+			[]string{"viewer"}},
+		{"configured roles", &Authorization{User: "alice"}, []string{"admin", "editor"}},
+		{"claims and configured roles are merged", &Authorization{User: "alice",
+			Claims: map[string]interface{}{"roles": []interface{}{"editor", "viewer"}}},
+			[]string{"editor", "viewer", "admin"}},
+		{"no roles", &Authorization{User: "bob"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := auth.roles(tt.authz); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,13 @@
 package dragonfruit
 
+import "context"
+
+// Query params used for paging by every backend
+const (
+	LIMIT  = "limit"
+	OFFSET = "offset"
+)
+
 type qparam map[string]interface{}
 
 func (q qparam) Get(key string) interface{} {
@@ -25,6 +33,44 @@ type QueryParams struct {
 	PathParams  map[string]interface{}
 	QueryParams qparam
 	Body        []byte
+	// Fields limits the properties of returned documents (see ProjectFields)
+	Fields []string
+	// Sort orders the results of a collection query (see SortResults)
+	Sort []SortField
+	// Search is a full-text search across the SearchFields of a model
+	// (see TextSearcher)
+	Search       string
+	SearchFields []string
+	// Cursor is the position to page from, replacing the offset.  Backends
+	// which return cursors in ContainerMeta must accept them here.
+	Cursor *Cursor
+	// Aggregation is set on aggregate queries (see Aggregator)
+	Aggregation *Aggregation
+	// Version is the version a write expects the document to be at (from
+	// an If-Match header).  Backends return a PRECONDITIONFAILED error if
+	// the document has changed.
+	Version string
+	// PatchFormat is the format of a PATCH body (MERGEPATCH or JSONPATCH,
+	// see ApplyPatch)
+	PatchFormat string
+	// SoftDelete is set on removals which should mark the document as
+	// deleted instead (see Trasher)
+	SoftDelete bool
+	// Trash queries soft deleted documents instead of live ones
+	Trash bool
+	// Owner limits a query or write to the documents (and their
+	// sub-documents) whose owner property is set to it (see Conf.Ownership)
+	Owner string
+	// Context is the context of the request being served, if any.  It
+	// carries the request ID (see GetRequestID) and collects backend
+	// timings (see TimeBackend).
+	Context context.Context
+}
+
+// SortField is a single key from the sort query parameter.
+type SortField struct {
+	Name       string
+	Descending bool
 }
 
 // ContainerMeta is a list of metadata about a result set.
@@ -35,6 +81,15 @@ type ContainerMeta struct {
 	Limit           int    `json:"limit,omitempty"`
 	Total           int    `json:"total"`
 	Count           int    `json:"count"`
+	// links to the neighbouring pages (set by the frontend)
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+	// cursors for the neighbouring pages (set by backends, see EncodeCursor)
+	NextCursor string `json:"nextCursor,omitempty"`
+	PrevCursor string `json:"prevCursor,omitempty"`
+	// the version of the document holding the results, if they all come
+	// from one document (sent as an ETag)
+	Version string `json:"-"`
 }
 
 // A Container is a wrapper for a list of results, plus some meta information
@@ -0,0 +1,130 @@
+package couchdb
+
+import (
+	"context"
+	"math"
+
+	"github.com/dragonfruit-api/dragonfruit"
+	"github.com/fjl/go-couchdb"
+)
+
+// Aggregate runs an aggregate query (see dragonfruit.Aggregator).
+//
+// Unfiltered aggregates of top-level collections use the reduce views created
+// by Prep.  Filtered or owned aggregates and aggregates of sub-collections
+// load the matching documents and aggregate them in memory.
+func (d *DbBackendCouch) Aggregate(params dragonfruit.QueryParams) (dragonfruit.Container, error) {
+	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Aggregate", params.Path)
+	defer finish()
+	params.Context = ctx
+	agg := params.Aggregation
+	database := getDatabaseName(params)
+
+	if params.Path == "/"+database && len(params.QueryParams) == 0 && params.Owner == "" {
+		results, err := d.aggregateViews(params.Context, database, agg)
+		if err != nil {
+			return dragonfruit.Container{}, err
+		}
+		if results != nil {
+			return dragonfruit.MakeAggregateContainer(results), nil
+		}
+	}
+
+	// copy the query params, since queryView mutates them
+	scanParams := make(map[string]interface{})
+	for k, v := range params.QueryParams {
+		scanParams[k] = v
+	}
+	scanParams[dragonfruit.LIMIT] = int64(math.MaxInt32)
+
+	_, result, err := d.queryView(dragonfruit.QueryParams{
+		Path:        params.Path,
+		PathParams:  params.PathParams,
+		QueryParams: scanParams,
+		Owner:       params.Owner,
+		Context:     params.Context,
+	})
+	if err != nil {
+		return dragonfruit.Container{}, err
+	}
+
+	docs := make([]interface{}, 0)
+	for _, row := range result.Rows {
+		docs = append(docs, unwrapValue(row.Value))
+	}
+	return dragonfruit.MakeAggregateContainer(dragonfruit.AggregateDocuments(docs, agg)), nil
+}
+
+// aggregateViews queries the reduce views of a database.  It returns nil
+// results if the views don't exist.
+func (d *DbBackendCouch) aggregateViews(ctx context.Context, database string,
+	agg *dragonfruit.Aggregation) ([]*dragonfruit.AggregateResult, error) {
+
+	err := d.ensureConnection()
+	if err != nil {
+		return nil, err
+	}
+	db := d.db(ctx, database)
+
+	opts := map[string]interface{}{
+		"group": agg.GroupBy != "",
+	}
+
+	var counts reduceResponse
+	err = db.View("_design/core", makeAggregateViewName(agg.GroupBy, ""), &counts, opts)
+	if couchdb.NotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*dragonfruit.AggregateResult, 0)
+	groups := make(map[string]*dragonfruit.AggregateResult)
+	for _, row := range counts.Rows {
+		count, _ := row.Value.(float64)
+		result := &dragonfruit.AggregateResult{
+			Group: row.Key,
+			Count: int(count),
+		}
+		groups[dragonfruit.GroupKey(row.Key)] = result
+		results = append(results, result)
+	}
+
+	for _, field := range agg.Fields() {
+		var stats reduceResponse
+		err = db.View("_design/core", makeAggregateViewName(agg.GroupBy, field), &stats, opts)
+		if couchdb.NotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range stats.Rows {
+			result, ok := groups[dragonfruit.GroupKey(row.Key)]
+			values, isMap := row.Value.(map[string]interface{})
+			if !ok || !isMap {
+				continue
+			}
+			result.SetStats(agg, field, makeFieldStats(values))
+		}
+	}
+
+	dragonfruit.SortAggregates(results)
+	return results, nil
+}
+
+// makeFieldStats converts the value of a _stats reduce row.
+func makeFieldStats(values map[string]interface{}) dragonfruit.FieldStats {
+	count, _ := values["count"].(float64)
+	sum, _ := values["sum"].(float64)
+	min, _ := values["min"].(float64)
+	max, _ := values["max"].(float64)
+	return dragonfruit.FieldStats{
+		Count: int(count),
+		Sum:   sum,
+		Min:   min,
+		Max:   max,
+	}
+}
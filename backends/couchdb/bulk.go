@@ -0,0 +1,273 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+
+	"github.com/dragonfruit-api/dragonfruit"
+	"github.com/pborman/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Bulk applies a batch of operations (see dragonfruit.BulkWriter).
+//
+// Operations on top-level documents are sent in a single _bulk_docs request,
+// after loading the documents being changed with a single view query.
+// Operations on sub-documents change their parent document, so they're
+// applied one at a time.
+func (d *DbBackendCouch) Bulk(ops []*dragonfruit.BulkOperation) ([]*dragonfruit.BulkResult, error) {
+	results := make([]*dragonfruit.BulkResult, len(ops))
+	if len(ops) == 0 {
+		return results, nil
+	}
+	ctx, finish := dragonfruit.StartBackendCall(ops[0].Params.Context, "Bulk", ops[0].Params.Path)
+	defer finish()
+
+	for _, op := range ops {
+		if !isRootOperation(op) {
+			return dragonfruit.RunBulk(d, ops), nil
+		}
+	}
+
+	database := getDatabaseName(ops[0].Params)
+	existing, err := d.loadBulkDocs(ctx, ops)
+	if err != nil {
+		return results, err
+	}
+
+	docs := make([]interface{}, 0)
+	positions := make([]int, 0)
+	for i, op := range ops {
+		doc, err := makeBulkDoc(op, existing)
+		if err != nil {
+			results[i] = dragonfruit.BulkErrorResult(err)
+			continue
+		}
+		docs = append(docs, doc)
+		positions = append(positions, i)
+	}
+
+	saved, err := d.bulkDocs(ctx, database, docs)
+	if err != nil {
+		return results, err
+	}
+	if len(saved) != len(docs) {
+		return results, errors.New("CouchDB returned the wrong number of bulk results")
+	}
+
+	for j, result := range saved {
+		op := ops[positions[j]]
+		results[positions[j]] = makeBulkResult(op, result, docs[j])
+	}
+	return results, nil
+}
+
+// isRootOperation reports whether a bulk operation writes a whole top-level
+// document (e.g. /people or /people/:id).
+func isRootOperation(op *dragonfruit.BulkOperation) bool {
+	matches := dragonfruit.PathParamRe.FindAllStringSubmatch(op.Params.Path, -1)
+	if op.Op == dragonfruit.BULKCREATE {
+		return len(matches) == 1 && matches[0][4] == ""
+	}
+	return len(matches) == 1 && matches[0][4] != ""
+}
+
+// loadBulkDocs loads the documents changed by a set of bulk operations, keyed
+// by their path param (see dragonfruit.GroupKey).  Owned operations only load
+// their owner's documents, from the owner view.
+func (d *DbBackendCouch) loadBulkDocs(ctx context.Context, ops []*dragonfruit.BulkOperation) (map[string]couchdbRow, error) {
+	out := make(map[string]couchdbRow)
+
+	var params dragonfruit.QueryParams
+	keys := make([]interface{}, 0)
+	for _, op := range ops {
+		if op.Op == dragonfruit.BULKCREATE {
+			continue
+		}
+		params = op.Params
+		for _, v := range op.Params.PathParams {
+			if params.Owner != "" {
+				keys = append(keys, []interface{}{params.Owner, v})
+			} else {
+				keys = append(keys, v)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return out, nil
+	}
+
+	err := d.ensureConnection()
+	if err != nil {
+		return out, err
+	}
+
+	viewName := makePathViewName(params.Path)
+	if params.Owner != "" {
+		viewName = makeOwnerViewName(viewName)
+	}
+
+	var result couchDbResponse
+	opts := map[string]interface{}{
+		"keys": keys,
+	}
+	err = d.db(ctx, getDatabaseName(params)).View("_design/core",
+		viewName, &result, opts)
+	if err != nil {
+		return out, err
+	}
+
+	for _, row := range result.Rows {
+		key := row.Key
+		if ownerKey, ok := key.([]interface{}); ok && params.Owner != "" && len(ownerKey) == 2 {
+			key = ownerKey[1]
+		}
+		out[dragonfruit.GroupKey(key)] = row
+	}
+	return out, nil
+}
+
+// makeBulkDoc builds the document sent to _bulk_docs for an operation.
+func makeBulkDoc(op *dragonfruit.BulkOperation,
+	existing map[string]couchdbRow) (map[string]interface{}, error) {
+
+	var body interface{}
+	if len(op.Params.Body) > 0 {
+		err := json.Unmarshal(op.Params.Body, &body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if op.Op == dragonfruit.BULKCREATE {
+		doc, ok := body.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("new documents must be a map")
+		}
+		doc["_id"] = uuid.New()
+		return doc, nil
+	}
+
+	var key interface{}
+	for _, v := range op.Params.PathParams {
+		key = v
+	}
+	row, ok := existing[dragonfruit.GroupKey(key)]
+	if !ok {
+		return nil, errors.New(dragonfruit.NOTFOUNDERROR)
+	}
+	rev, _ := row.Value["_rev"].(string)
+	if op.Params.Version != "" && op.Params.Version != rev {
+		return nil, errors.New(dragonfruit.PRECONDITIONFAILED)
+	}
+
+	switch op.Op {
+	case dragonfruit.BULKDELETE:
+		if op.Params.SoftDelete {
+			dragonfruit.MarkTrashed(row.Value)
+			return row.Value, nil
+		}
+		return map[string]interface{}{
+			"_id":      row.ID,
+			"_rev":     rev,
+			"_deleted": true,
+		}, nil
+	case dragonfruit.BULKPATCH:
+		patched, err := patch(reflect.ValueOf(row.Value), reflect.ValueOf(body),
+			op.Params.PatchFormat)
+		if err != nil {
+			return nil, err
+		}
+		return patched.Interface().(map[string]interface{}), nil
+	}
+
+	doc, ok := body.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("body params must be a map")
+	}
+	doc["_id"] = row.ID
+	doc["_rev"] = rev
+	return doc, nil
+}
+
+// makeBulkResult converts a _bulk_docs result into a bulk result.
+func makeBulkResult(op *dragonfruit.BulkOperation, result bulkDocResult,
+	doc interface{}) *dragonfruit.BulkResult {
+
+	switch result.Error {
+	case "":
+	case "conflict":
+		if op.Params.Version != "" {
+			return dragonfruit.BulkErrorResult(errors.New(dragonfruit.PRECONDITIONFAILED))
+		}
+		return &dragonfruit.BulkResult{Status: 409, Error: result.Reason}
+	case "forbidden":
+		return &dragonfruit.BulkResult{Status: 403, Error: result.Reason}
+	default:
+		return &dragonfruit.BulkResult{Status: 500, Error: result.Reason}
+	}
+
+	switch op.Op {
+	case dragonfruit.BULKCREATE:
+		body, _ := sanitizeDoc(doc)
+		return &dragonfruit.BulkResult{Status: 201, Body: body}
+	case dragonfruit.BULKDELETE:
+		return &dragonfruit.BulkResult{Status: 200}
+	}
+	body, _ := sanitizeDoc(doc)
+	return &dragonfruit.BulkResult{Status: 200, Body: body}
+}
+
+// bulkDocs saves a set of documents with a single _bulk_docs request.  The
+// client library doesn't support _bulk_docs, so the request is made
+// directly.
+func (d *DbBackendCouch) bulkDocs(ctx context.Context, database string,
+	docs []interface{}) ([]bulkDocResult, error) {
+
+	out := make([]bulkDocResult, 0)
+	if len(docs) == 0 {
+		return out, nil
+	}
+
+	err := d.ensureConnection()
+	if err != nil {
+		return out, err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"docs": docs})
+	if err != nil {
+		return out, err
+	}
+
+	req, err := http.NewRequest("POST", d.url+"/"+database+"/_bulk_docs",
+		bytes.NewReader(body))
+	if err != nil {
+		return out, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	ctx, span := startRequestSpan(ctx, "POST", database, "/_bulk_docs")
+	span.SetAttributes(attribute.Int("couchdb.docs", len(docs)))
+	// unlike the client library, requests made here carry the trace
+	dragonfruit.InjectTrace(ctx, req.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		endRequestSpan(span, err)
+		return out, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		err = errors.New("_bulk_docs failed with status " + resp.Status)
+		endRequestSpan(span, err)
+		return out, err
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	endRequestSpan(span, err)
+	return out, err
+}
@@ -0,0 +1,275 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dragonfruit-api/dragonfruit"
+	"github.com/fjl/go-couchdb"
+)
+
+// how often CouchDB sends a heartbeat on idle change feeds, in milliseconds
+const changesHeartbeat = 30000
+
+// Changes streams the changes made to a collection (see
+// dragonfruit.ChangeFeed), using CouchDB's continuous _changes feed.
+//
+// Top-level collections get an event for every document that changes.
+// Nested collections (e.g. /people/:id/pets/:petId) are compared with their
+// previous state each time their parent document changes, so every
+// sub-document that changed gets its own event.  Events carry the owner of
+// their top-level document.
+func (d *DbBackendCouch) Changes(params dragonfruit.QueryParams, since string,
+	stop <-chan struct{}) (<-chan *dragonfruit.ChangeEvent, error) {
+
+	database := getDatabaseName(params)
+	pathmap := dragonfruit.PathParamRe.FindAllStringSubmatch(params.Path, -1)
+
+	var (
+		rootID   string
+		previous map[string]map[string]interface{}
+		err      error
+	)
+	if len(pathmap) > 1 {
+		_, rootID, err = d.getRootDocument(params)
+		if err != nil {
+			return nil, err
+		}
+		previous, err = d.loadNestedItems(params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = d.ensureConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	if since == "" {
+		since = "now"
+	}
+	feed, err := d.client.DB(database).Changes(couchdb.Options{
+		"feed":      "continuous",
+		"since":     since,
+		"heartbeat": changesHeartbeat,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// closing the feed ends the loop below
+	go func() {
+		<-stop
+		feed.Close()
+	}()
+
+	out := make(chan *dragonfruit.ChangeEvent)
+	go func() {
+		defer close(out)
+		for feed.Next() {
+			if strings.HasPrefix(feed.ID, "_design/") {
+				continue
+			}
+
+			var events []*dragonfruit.ChangeEvent
+			if len(pathmap) > 1 {
+				if feed.ID != rootID {
+					continue
+				}
+				current, loadErr := d.loadNestedItems(params)
+				if loadErr != nil {
+					continue
+				}
+				events = diffNestedItems(params, previous, current)
+				previous = current
+				for _, ev := range events {
+					ev.Owner = params.Owner
+				}
+			} else {
+				rev := ""
+				if len(feed.Changes) > 0 {
+					rev = feed.Changes[0].Rev
+				}
+				events = d.rootChanges(params, feed.ID, rev, feed.Deleted)
+			}
+
+			for _, ev := range events {
+				ev.Seq = fmt.Sprint(feed.Seq)
+				select {
+				case out <- ev:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// rootChanges returns the event for a top-level document.  Documents which
+// were soft deleted are sent as deletes, and the IDs of deleted documents are
+// found from their previous revision.
+func (d *DbBackendCouch) rootChanges(params dragonfruit.QueryParams, id string,
+	rev string, deleted bool) []*dragonfruit.ChangeEvent {
+
+	database := getDatabaseName(params)
+	pathmap := dragonfruit.PathParamRe.FindAllStringSubmatch(params.Path, -1)
+	idName := pathmap[0][4]
+	collectionPath := "/" + pathmap[0][2]
+
+	if deleted {
+		ev := &dragonfruit.ChangeEvent{Type: dragonfruit.CHANGEDELETE, Path: collectionPath}
+		if doc := d.loadPreviousRevision(params.Context, database, id, rev); doc != nil {
+			ev.Path = ev.Path + "/" + fmt.Sprint(doc[idName])
+			ev.Owner, _ = doc[dragonfruit.OWNER].(string)
+		}
+		return []*dragonfruit.ChangeEvent{ev}
+	}
+
+	err := d.ensureConnection()
+	if err != nil {
+		return nil
+	}
+	var doc map[string]interface{}
+	err = d.db(params.Context, database).Get(id, &doc, nil)
+	if err != nil {
+		return nil
+	}
+
+	ev := &dragonfruit.ChangeEvent{
+		Type: dragonfruit.CHANGEUPDATE,
+		Path: collectionPath + "/" + fmt.Sprint(doc[idName]),
+	}
+	ev.Owner, _ = doc[dragonfruit.OWNER].(string)
+	if dragonfruit.IsTrashed(doc) {
+		ev.Type = dragonfruit.CHANGEDELETE
+		return []*dragonfruit.ChangeEvent{ev}
+	}
+	if strings.HasPrefix(rev, "1-") {
+		ev.Type = dragonfruit.CHANGEINSERT
+	}
+	ev.Doc, _ = sanitizeDoc(dragonfruit.RemoveTrashed(doc))
+	return []*dragonfruit.ChangeEvent{ev}
+}
+
+// loadPreviousRevision loads the revision of a document before the passed
+// one, or nil if it has been compacted away.
+func (d *DbBackendCouch) loadPreviousRevision(ctx context.Context, database string, id string,
+	rev string) map[string]interface{} {
+
+	err := d.ensureConnection()
+	if err != nil {
+		return nil
+	}
+	db := d.db(ctx, database)
+
+	var revs struct {
+		Revisions struct {
+			Start int      `json:"start"`
+			IDs   []string `json:"ids"`
+		} `json:"_revisions"`
+	}
+	err = db.Get(id, &revs, couchdb.Options{"rev": rev, "revs": true})
+	if err != nil || len(revs.Revisions.IDs) < 2 {
+		return nil
+	}
+
+	prev := strconv.Itoa(revs.Revisions.Start-1) + "-" + revs.Revisions.IDs[1]
+	var doc map[string]interface{}
+	err = db.Get(id, &doc, couchdb.Options{"rev": prev})
+	if err != nil {
+		return nil
+	}
+	return doc
+}
+
+// loadNestedItems loads every item of a nested collection, keyed by their
+// path param (see dragonfruit.GroupKey), without any soft deleted
+// sub-documents.  params.Path is the item path.
+func (d *DbBackendCouch) loadNestedItems(params dragonfruit.QueryParams) (map[string]map[string]interface{}, error) {
+	idName := dragonfruit.EndOfPathRe.FindString(params.Path)[1:]
+	collectionPath := strings.TrimSuffix(params.Path, "/:"+idName)
+
+	pathParams := make(map[string]interface{})
+	for k, v := range params.PathParams {
+		pathParams[k] = v
+	}
+
+	_, result, err := d.queryView(dragonfruit.QueryParams{
+		Path:        collectionPath,
+		PathParams:  pathParams,
+		QueryParams: map[string]interface{}{dragonfruit.LIMIT: int64(math.MaxInt32)},
+		Owner:       params.Owner,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]map[string]interface{})
+	for _, row := range result.Rows {
+		item, _ := dragonfruit.RemoveTrashed(row.Value).(map[string]interface{})
+		out[dragonfruit.GroupKey(item[idName])] = item
+	}
+	return out, nil
+}
+
+// diffNestedItems compares two states of a nested collection and returns an
+// event for every item inserted, updated or deleted.
+func diffNestedItems(params dragonfruit.QueryParams,
+	previous map[string]map[string]interface{},
+	current map[string]map[string]interface{}) []*dragonfruit.ChangeEvent {
+
+	idName := dragonfruit.EndOfPathRe.FindString(params.Path)[1:]
+	itemPath := func(item map[string]interface{}) string {
+		pathParams := map[string]interface{}{idName: item[idName]}
+		for k, v := range params.PathParams {
+			pathParams[k] = v
+		}
+		return dragonfruit.FillPath(params.Path, pathParams)
+	}
+
+	keys := make([]string, 0)
+	for key := range current {
+		keys = append(keys, key)
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := make([]*dragonfruit.ChangeEvent, 0)
+	for _, key := range keys {
+		old, existed := previous[key]
+		item, exists := current[key]
+
+		switch {
+		case !existed:
+			out = append(out, &dragonfruit.ChangeEvent{
+				Type: dragonfruit.CHANGEINSERT,
+				Path: itemPath(item),
+				Doc:  item,
+			})
+		case !exists:
+			out = append(out, &dragonfruit.ChangeEvent{
+				Type: dragonfruit.CHANGEDELETE,
+				Path: itemPath(old),
+			})
+		case !reflect.DeepEqual(old, item):
+			out = append(out, &dragonfruit.ChangeEvent{
+				Type: dragonfruit.CHANGEUPDATE,
+				Path: itemPath(item),
+				Doc:  item,
+			})
+		}
+	}
+	return out
+}
@@ -1,9 +1,11 @@
 package couchdb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -12,6 +14,8 @@ import (
 
 	"github.com/gedex/inflector"
 	"github.com/pborman/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -46,6 +50,7 @@ func (d *DbBackendCouch) Connect(url string) error {
 
 	d.client = db
 	d.connection = make(chan bool, 1)
+	d.url = strings.TrimSuffix(url, "/")
 
 	return nil
 }
@@ -86,6 +91,9 @@ func (d *DbBackendCouch) getPathSpecificStuff(params dragonfruit.QueryParams) ([
 // TODO - partial document updates
 func (d *DbBackendCouch) Update(params dragonfruit.QueryParams, operation int) (interface{},
 	error) {
+	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Update", params.Path)
+	defer finish()
+	params.Context = ctx
 
 	pathmap, doc, id, v, err := d.getPathSpecificStuff(params)
 
@@ -101,9 +109,13 @@ func (d *DbBackendCouch) Update(params dragonfruit.QueryParams, operation int) (
 	if err != nil {
 		return nil, err
 	}
+	// nothing matched the path (or it was soft deleted)
+	if !partial.IsValid() {
+		return nil, errors.New(dragonfruit.NOTFOUNDERROR)
+	}
 
 	database := getDatabaseName(params)
-	_, out, err := d.save(database, id, newdoc.Interface())
+	_, out, err := d.saveVersion(params.Context, database, id, newdoc.Interface(), params.Version)
 	if err != nil {
 		return out, err
 	}
@@ -122,21 +134,17 @@ func findSubDoc(pathslice [][]string,
 
 	var partial reflect.Value
 
-	if len(pathslice) == 0 && (operation == dragonfruit.PUT || operation == dragonfruit.PATCH) {
+	if len(pathslice) == 0 && operation == dragonfruit.PATCH {
+		outdoc, err := patch(document, bodyParams, params.PatchFormat)
+		return outdoc, outdoc, err
+
+	} else if len(pathslice) == 0 && operation == dragonfruit.PUT {
 		switch bodyParams.Type().Kind() {
 		default:
 			return document, document, errors.New("body params must be a map")
 
 		case reflect.Map:
-
-			var manipulator func(reflect.Value, reflect.Value) (reflect.Value, error)
-
-			if operation == dragonfruit.PUT {
-				manipulator = replace
-			} else {
-				manipulator = partialReplace
-			}
-			outdoc, err := manipulator(document, bodyParams)
+			outdoc, err := replace(document, bodyParams)
 			return outdoc, outdoc, err
 		}
 
@@ -165,6 +173,10 @@ func findSubDoc(pathslice [][]string,
 			document = newdoc
 			partial = part
 		case reflect.Map:
+			// embedded models don't have a path parameter
+			if len(pathslice) > 0 && pathslice[0][3] == "" && operation != dragonfruit.POST {
+				return findEmbeddedDoc(pathslice, params, document, bodyParams, operation)
+			}
 			newdoc, part, err := findSubDoc(pathslice, params, document.MapIndex(currItem), bodyParams, operation)
 			if err != nil {
 				return document, part, err
@@ -180,6 +192,11 @@ func findSubDoc(pathslice [][]string,
 				return newDoc, bodyParams, nil
 			}
 
+			// deletes of items which aren't there don't change the
+			// document
+			found := false
+
+		valueLoop:
 			for i := 0; i < document.Len(); i++ {
 				d := document.Index(i)
 				if d.Kind() == reflect.Interface {
@@ -189,18 +206,30 @@ func findSubDoc(pathslice [][]string,
 				switch d.Type().Kind() {
 				default:
 					break
+
+				// arrays of primitives are addressed by value
+				case reflect.String, reflect.Float64, reflect.Bool:
+					if operation == dragonfruit.DELETE &&
+						matchInterfaceKeys(d, params.PathParams[currKey.String()]) {
+						document = removeSliceIndex(document, i)
+						partial = reflect.ValueOf(nil)
+						found = true
+						break valueLoop
+					}
 				case reflect.Map:
 
 					if matchInterfaceKeys(d.MapIndex(currKey).Elem(), params.PathParams[currKey.String()]) {
-						if operation == dragonfruit.DELETE {
-							if i == 0 {
-								document = document.Slice(1, document.Len())
-							} else if (i + 1) == document.Len() {
-								document = document.Slice(0, i)
-							} else {
-								document = reflect.AppendSlice(document.Slice(0, i), document.Slice(i+1, document.Len()))
-
-							}
+						// soft deleted items can only be found by
+						// restores, at the end of the path
+						if dragonfruit.IsTrashed(d.Interface()) != (params.Trash && len(pathslice) == 1) {
+							continue
+						}
+						found = true
+						if operation == dragonfruit.DELETE && params.SoftDelete {
+							dragonfruit.MarkTrashed(d.Interface().(map[string]interface{}))
+							partial = reflect.ValueOf(nil)
+						} else if operation == dragonfruit.DELETE {
+							document = removeSliceIndex(document, i)
 							partial = reflect.ValueOf(nil)
 						} else {
 							newdoc, part, err := findSubDoc(pathslice[1:], params, d, bodyParams, operation)
@@ -216,6 +245,10 @@ func findSubDoc(pathslice [][]string,
 
 			}
 
+			if operation == dragonfruit.DELETE && !found {
+				return document, partial, errors.New(dragonfruit.NOTFOUNDERROR)
+			}
+
 		}
 
 	}
@@ -223,6 +256,51 @@ func findSubDoc(pathslice [][]string,
 	return document, partial, nil
 }
 
+// findEmbeddedDoc finds a single model embedded in a document by its property
+// name, and updates or removes it.  Embedded models that don't exist yet are
+// created by PUT and PATCH operations.
+func findEmbeddedDoc(pathslice [][]string,
+	params dragonfruit.QueryParams,
+	document reflect.Value,
+	bodyParams reflect.Value,
+	operation int) (reflect.Value, reflect.Value, error) {
+
+	key := reflect.ValueOf(pathslice[0][2])
+	embedded := document.MapIndex(key)
+
+	if operation == dragonfruit.DELETE && len(pathslice) == 1 {
+		if !embedded.IsValid() {
+			return document, embedded, errors.New(dragonfruit.NOTFOUNDERROR)
+		}
+		document.SetMapIndex(key, reflect.Value{})
+		return document, reflect.ValueOf(nil), nil
+	}
+
+	if !embedded.IsValid() {
+		if operation == dragonfruit.DELETE || len(pathslice) > 1 {
+			return document, embedded, errors.New(dragonfruit.NOTFOUNDERROR)
+		}
+		embedded = reflect.ValueOf(make(map[string]interface{}))
+	}
+
+	newdoc, part, err := findSubDoc(pathslice[1:], params, embedded, bodyParams, operation)
+	if err != nil {
+		return document, part, err
+	}
+	document.SetMapIndex(key, newdoc)
+	return document, part, nil
+}
+
+// removeSliceIndex removes the element at index i from a slice value.
+func removeSliceIndex(document reflect.Value, i int) reflect.Value {
+	if i == 0 {
+		return document.Slice(1, document.Len())
+	} else if (i + 1) == document.Len() {
+		return document.Slice(0, i)
+	}
+	return reflect.AppendSlice(document.Slice(0, i), document.Slice(i+1, document.Len()))
+}
+
 func (d *DbBackendCouch) getRootDocument(params dragonfruit.QueryParams) (couchdbRow, string, error) {
 
 	viewpath := dragonfruit.ViewPathParamRe.FindAllStringSubmatch(params.Path, -1)
@@ -237,6 +315,8 @@ func (d *DbBackendCouch) getRootDocument(params dragonfruit.QueryParams) (couchd
 	newparams := dragonfruit.QueryParams{
 		Path:       newPath,
 		PathParams: newPathParams,
+		Owner:      params.Owner,
+		Context:    params.Context,
 	}
 
 	_, result, err := d.queryView(newparams)
@@ -260,17 +340,40 @@ func replace(original reflect.Value, newDoc reflect.Value) (reflect.Value, error
 	return newDoc, nil
 }
 
-func partialReplace(original reflect.Value, newDoc reflect.Value) (reflect.Value, error) {
+// patch applies a merge patch or JSON patch (see dragonfruit.ApplyPatch).
+// CouchDB's _id and _rev keys can't be patched.
+func patch(original reflect.Value, patchDoc reflect.Value,
+	format string) (reflect.Value, error) {
+
 	orig := fixStupidInterfaceRefs(original)
-	newer := fixStupidInterfaceRefs(newDoc)
-	if orig.Kind() != reflect.Map || newer.Kind() != reflect.Map {
-		return orig, errors.New("Both document and replacement must be a map")
+	if !patchDoc.IsValid() {
+		return orig, errors.New("A patch body is required")
+	}
+	if orig.Kind() != reflect.Map {
+		return orig, errors.New("Only maps can be patched")
 	}
-	for _, field := range newer.MapKeys() {
 
-		orig.SetMapIndex(field, newer.MapIndex(field))
+	origMap, _ := orig.Interface().(map[string]interface{})
+	reserved := make(map[string]interface{})
+	for _, key := range []string{"_id", "_rev"} {
+		if val, ok := origMap[key]; ok {
+			reserved[key] = val
+		}
 	}
-	return orig, nil
+
+	out, err := dragonfruit.ApplyPatch(format, orig.Interface(), patchDoc.Interface())
+	if err != nil {
+		return orig, err
+	}
+
+	outMap, ok := out.(map[string]interface{})
+	if !ok {
+		return orig, &dragonfruit.PatchError{Message: "The patched document must be a map."}
+	}
+	for key, val := range reserved {
+		outMap[key] = val
+	}
+	return reflect.ValueOf(outMap), nil
 }
 
 func fixStupidInterfaceRefs(val reflect.Value) reflect.Value {
@@ -284,9 +387,12 @@ func fixStupidInterfaceRefs(val reflect.Value) reflect.Value {
 // TODO - Add subdocuments
 func (d *DbBackendCouch) Insert(params dragonfruit.QueryParams) (interface{},
 	error) {
+	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Insert", params.Path)
+	defer finish()
+	params.Context = ctx
 
 	database := getDatabaseName(params)
-	var document map[string]interface{}
+	var document interface{}
 	err := json.Unmarshal(params.Body, &document)
 	if err != nil {
 		return nil, err
@@ -296,8 +402,11 @@ func (d *DbBackendCouch) Insert(params dragonfruit.QueryParams) (interface{},
 	// if there are no path parameters, this is a new primary document
 	// just save it
 	if len(params.PathParams) == 0 {
+		if _, ok := document.(map[string]interface{}); !ok {
+			return nil, errors.New("new documents must be a map")
+		}
 		docID := uuid.New()
-		_, doc, err = d.save(database, docID, document)
+		_, doc, err = d.save(params.Context, database, docID, document)
 	} else {
 		pathmap, couchdoc, id, newDoc, err := d.getPathSpecificStuff(params)
 		if err != nil {
@@ -311,7 +420,7 @@ func (d *DbBackendCouch) Insert(params dragonfruit.QueryParams) (interface{},
 		if err != nil {
 			return nil, err
 		}
-		_, _, err = d.save(database, id, docVal.Interface())
+		_, _, err = d.save(params.Context, database, id, docVal.Interface())
 		if err != nil {
 			return nil, err
 		}
@@ -332,7 +441,7 @@ func (d *DbBackendCouch) Insert(params dragonfruit.QueryParams) (interface{},
 func (d *DbBackendCouch) LoadDefinition(cnf dragonfruit.Conf) (*dragonfruit.Swagger, error) {
 
 	rd := &dragonfruit.Swagger{}
-	err := d.load(SwaggerResourceDB, ResourceDescriptionName, rd)
+	err := d.load(context.Background(), SwaggerResourceDB, ResourceDescriptionName, rd)
 
 	if err != nil {
 		//TODO - fix this stupid shadowing issue
@@ -346,15 +455,22 @@ func (d *DbBackendCouch) LoadDefinition(cnf dragonfruit.Conf) (*dragonfruit.Swag
 // (see the backend stuff and types).
 func (d *DbBackendCouch) SaveDefinition(sw *dragonfruit.Swagger) error {
 
-	_, _, err := d.save(SwaggerResourceDB, ResourceDescriptionName, sw)
+	_, _, err := d.save(context.Background(), SwaggerResourceDB, ResourceDescriptionName, sw)
 
 	return err
 }
 
 // Remove deletes a document from the database
 func (d *DbBackendCouch) Remove(params dragonfruit.QueryParams) error {
+	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Remove", params.Path)
+	defer finish()
+	params.Context = ctx
 	database := getDatabaseName(params)
-	if len(params.PathParams) == 1 {
+
+	// only paths pointing at a root document (e.g. /people/{id}) delete
+	// the whole document
+	pathmap := dragonfruit.PathParamRe.FindAllStringSubmatch(params.Path, -1)
+	if len(pathmap) == 1 {
 		_, result, err := d.queryView(params)
 		if err != nil {
 			return err
@@ -366,16 +482,30 @@ func (d *DbBackendCouch) Remove(params dragonfruit.QueryParams) error {
 
 		target := result.Rows[0]
 		id := target.ID
-		err = d.ensureConnection()
-		if err != nil {
+
+		if params.SoftDelete {
+			dragonfruit.MarkTrashed(target.Value)
+			_, _, err = d.saveVersion(params.Context, database, id, target.Value, params.Version)
 			return err
 		}
-		rev, err := d.client.DB(database).Rev(id)
+
+		err = d.ensureConnection()
 		if err != nil {
 			return err
 		}
+		rev := params.Version
+		if rev == "" {
+			rev, err = d.db(params.Context, database).Rev(id)
+			if err != nil {
+				return err
+			}
+		}
 
-		return d.delete(database, id, rev)
+		err = d.delete(params.Context, database, id, rev)
+		if couchdb.Conflict(err) && params.Version != "" {
+			return errors.New(dragonfruit.PRECONDITIONFAILED)
+		}
+		return err
 	}
 
 	pathmap, couchdoc, id, newDoc, err := d.getPathSpecificStuff(params)
@@ -393,7 +523,7 @@ func (d *DbBackendCouch) Remove(params dragonfruit.QueryParams) error {
 		return err
 	}
 
-	_, _, err = d.save(database, id, docVal.Interface())
+	_, _, err = d.saveVersion(params.Context, database, id, docVal.Interface(), params.Version)
 
 	return err
 
@@ -401,33 +531,48 @@ func (d *DbBackendCouch) Remove(params dragonfruit.QueryParams) error {
 
 // Delete removes a document from the database
 // this will be made private
-func (d *DbBackendCouch) delete(database string, id string,
+func (d *DbBackendCouch) delete(ctx context.Context, database string, id string,
 	rev string) error {
-	_, err := d.client.DB(database).Delete(id, rev)
+	_, err := d.db(ctx, database).Delete(id, rev)
 	return err
 }
 
 // Save saves a document to the database.
 // This should also be made
-func (d *DbBackendCouch) save(database string,
+func (d *DbBackendCouch) save(ctx context.Context, database string,
 	documentID string,
 	document interface{}) (string, interface{}, error) {
+	return d.saveVersion(ctx, database, documentID, document, "")
+}
+
+// saveVersion saves a document, as long as it's still at the passed
+// revision.  An empty revision overwrites the latest one.
+func (d *DbBackendCouch) saveVersion(ctx context.Context, database string,
+	documentID string,
+	document interface{},
+	version string) (string, interface{}, error) {
 	err := d.ensureConnection()
 	if err != nil {
 		return "", nil, err
 	}
 
-	db, err := d.client.EnsureDB(database)
+	db, err := d.ensureDB(ctx, database)
 	if err != nil {
 		return "", nil, err
 	}
 
-	rev, err := db.Rev(documentID)
-	if err != nil {
-		return "", nil, err
+	rev := version
+	if rev == "" {
+		rev, err = db.Rev(documentID)
+		if err != nil {
+			return "", nil, err
+		}
 	}
 
 	_, err = db.Put(documentID, document, rev)
+	if couchdb.Conflict(err) && version != "" {
+		return "", nil, errors.New(dragonfruit.PRECONDITIONFAILED)
+	}
 	if err != nil {
 		return "", nil, err
 	}
@@ -437,6 +582,9 @@ func (d *DbBackendCouch) save(database string,
 
 // Query queries a view and returns a result
 func (d *DbBackendCouch) Query(params dragonfruit.QueryParams) (dragonfruit.Container, error) {
+	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Query", params.Path)
+	defer finish()
+	params.Context = ctx
 
 	num, result, err := d.queryView(params)
 	if err != nil {
@@ -449,21 +597,60 @@ func (d *DbBackendCouch) Query(params dragonfruit.QueryParams) (dragonfruit.Cont
 	c.Meta.Count = len(result.Rows)
 	c.Meta.Total = num
 	c.Meta.Offset = result.Offset
+	c.Meta.Limit = result.Limit
 	c.Meta.ResponseCode = 200
 	c.Meta.ResponseMessage = "Ok."
+	if result.NextCursor != nil {
+		c.Meta.NextCursor = dragonfruit.EncodeCursor(result.NextCursor)
+	}
+	if result.PrevCursor != nil {
+		c.Meta.PrevCursor = dragonfruit.EncodeCursor(result.PrevCursor)
+	}
 	c.ContainerType = strings.Title(returnType + strings.Title(dragonfruit.ContainerName))
 	c.Results = make([]interface{}, 0)
+
+	// results from a single document share its revision
+	if len(params.PathParams) > 0 && len(result.Rows) > 0 {
+		c.Meta.Version, err = d.rowsVersion(params.Context, getDatabaseName(params), result.Rows)
+		if err != nil {
+			return c, err
+		}
+	}
+
 	for _, row := range result.Rows {
-		outRow, err := sanitizeDoc(row.Value)
+		outRow, err := sanitizeDoc(dragonfruit.RemoveTrashed(unwrapValue(row.Value)))
 		if err != nil {
 			return c, err
 		}
+		outRow = dragonfruit.ProjectFields(outRow, params.Fields)
 		c.Results = append(c.Results, outRow)
 	}
 
 	return c, err
 }
 
+// rowsVersion returns the revision of the document a set of rows came from,
+// or an empty string if they came from more than one document.
+func (d *DbBackendCouch) rowsVersion(ctx context.Context, database string, rows []couchdbRow) (string, error) {
+	id := rows[0].ID
+	for _, row := range rows {
+		if row.ID != id {
+			return "", nil
+		}
+	}
+
+	// views which emit the whole document include the revision
+	if rev, ok := rows[0].Value["_rev"].(string); ok {
+		return rev, nil
+	}
+
+	err := d.ensureConnection()
+	if err != nil {
+		return "", err
+	}
+	return d.db(ctx, database).Rev(id)
+}
+
 // queryView queries a couchDB view and returns the number of results,
 // a couchDbResponse object and/or an error object.
 //
@@ -474,6 +661,10 @@ func (d *DbBackendCouch) Query(params dragonfruit.QueryParams) (dragonfruit.Cont
 //
 // The pickView method selects the appropriate view, based on the inbound
 // parameters.
+//
+// When the view does the paging, cursors replace CouchDB's skip (which is slow
+// on large databases) with startkey and startkey_docid.  An extra row is
+// loaded to find out whether there's another page.
 func (d *DbBackendCouch) queryView(params dragonfruit.QueryParams) (int,
 	couchDbResponse, error) {
 
@@ -495,12 +686,44 @@ func (d *DbBackendCouch) queryView(params dragonfruit.QueryParams) (int,
 		return 0, couchDbResponse{}, err
 	}
 
-	db := d.client.DB(database)
+	db := d.db(params.Context, database)
 
 	// map to hold view query options
 	opts := make(map[string]interface{})
 
-	viewName, viewExists := d.pickView(params, opts, limit, offset)
+	// single sort keys can use a query view to order the results
+	// (the query params map is shared, so pickView's changes to it still
+	// apply)
+	viewParams := params
+	ctx, span := dragonfruit.StartSpan(params.Context, "pickView")
+	viewParams.Context = ctx
+	viewName, sortedByView := d.findSortView(viewParams, opts, limit, offset)
+	viewExists := sortedByView
+	if !sortedByView {
+		viewName, viewExists = d.pickView(viewParams, opts, limit, offset)
+	}
+	span.SetAttributes(attribute.String("couchdb.view", viewName),
+		attribute.Bool("couchdb.sorted_by_view", sortedByView))
+	span.End()
+
+	// anything else is sorted in memory, so the whole result set has to
+	// be loaded before it's paged
+	sortInMemory := len(params.Sort) > 0 && !sortedByView
+	if sortInMemory {
+		delete(opts, "limit")
+		delete(opts, "skip")
+	}
+
+	_, pagedByView := opts["limit"]
+	if pagedByView {
+		if params.Cursor != nil {
+			applyCursor(opts, params.Cursor)
+			// the row the cursor points at comes back too
+			opts["limit"] = limit + 2
+		} else {
+			opts["limit"] = limit + 1
+		}
+	}
 
 	// if we found a view, query it
 	if viewExists {
@@ -511,19 +734,108 @@ func (d *DbBackendCouch) queryView(params dragonfruit.QueryParams) (int,
 		opts["include_docs"] = true
 		err = db.AllDocs(&result, opts)
 	}
+	if err != nil {
+		return 0, result, err
+	}
 	result.Offset = offset
+	result.Limit = limit
 
 	totalResults := result.TotalRows
 
+	if pagedByView {
+		pageRows(&result, params.Cursor, limit, offset)
+		return totalResults, result, nil
+	}
+
 	// if there are any query params that were not applied using a view,
-	// run additional filters on the result set
-	if len(params.QueryParams) > 0 {
+	// run additional filters on the result set.  Owner views hold every
+	// owner's documents, so their total is counted here too.
+	if len(params.QueryParams) > 0 || sortInMemory || params.Cursor != nil ||
+		params.Owner != "" {
 		totalResults, result, err = filterResultSet(result, params, limit, offset)
 	}
 
 	return totalResults, result, err
 }
 
+// applyCursor replaces the skip option of a view query with the position of
+// a cursor.  Before cursors reverse the direction of the view, ending at the
+// key the query would have started from.
+func applyCursor(opts map[string]interface{}, cursor *dragonfruit.Cursor) {
+	delete(opts, "skip")
+
+	start, hasStart := opts["startkey"]
+	if key, ok := opts["key"]; ok {
+		delete(opts, "key")
+		start, hasStart = key, true
+		opts["endkey"] = key
+	}
+
+	if cursor.Before {
+		descending, _ := opts["descending"].(bool)
+		opts["descending"] = !descending
+		delete(opts, "endkey")
+		if hasStart {
+			opts["endkey"] = start
+		}
+	}
+
+	opts["startkey"] = cursor.Key
+	opts["startkey_docid"] = cursor.DocID
+}
+
+// pageRows trims a page loaded by a view (with an extra row to look ahead)
+// and sets its cursors.
+func pageRows(result *couchDbResponse, cursor *dragonfruit.Cursor,
+	limit int, offset int) {
+
+	rows := result.Rows
+	if cursor != nil && len(rows) > 0 && isCursorRow(rows[0], cursor) {
+		rows = rows[1:]
+	}
+
+	more := len(rows) > limit
+	if more {
+		rows = rows[:limit]
+	}
+
+	before := cursor != nil && cursor.Before
+	if before {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+	result.Rows = rows
+
+	if len(rows) == 0 {
+		return
+	}
+	// paging backwards always leaves a page after this one, and vice versa
+	hasNext := more || before
+	hasPrev := (more && before) || (!before && (cursor != nil || offset > 0))
+	if hasNext {
+		result.NextCursor = makeCursor(rows[len(rows)-1], false)
+	}
+	if hasPrev {
+		result.PrevCursor = makeCursor(rows[0], true)
+	}
+}
+
+// makeCursor returns a cursor pointing at a row.
+func makeCursor(row couchdbRow, before bool) *dragonfruit.Cursor {
+	return &dragonfruit.Cursor{
+		Key:    row.Key,
+		DocID:  row.ID,
+		Before: before,
+	}
+}
+
+// isCursorRow reports whether a cursor points at a row.  Rows in sub-document
+// views share a document ID, so the key has to match as well.
+func isCursorRow(row couchdbRow, cursor *dragonfruit.Cursor) bool {
+	return row.ID == cursor.DocID && reflect.DeepEqual(row.Key, cursor.Key)
+}
+
 // setLimitAndOffset parses limit and offset queries from a set of query params
 func setLimitAndOffset(params dragonfruit.QueryParams) (limit int,
 	offset int) {
@@ -561,46 +873,88 @@ func setLimitAndOffset(params dragonfruit.QueryParams) (limit int,
 // result set after it is loaded from an initial view (since the CouchDB views
 // created by Prep aren't set up to filter with more than one parameter)
 //
-// After a result set is returned from a view,
+// Filters are combined as described by dragonfruit.MatchFilters.
+//
+// After a result set is returned from a view, it's sorted (if needed) and
+// the limit and offset are applied.
 func filterResultSet(result couchDbResponse, params dragonfruit.QueryParams,
 	limit int, offset int) (int, couchDbResponse, error) {
 
-	if len(params.QueryParams) < 1 {
-		return len(result.Rows), result, nil
-	}
-	outResult := result
-
-	outResult.Rows = make([]couchdbRow, 0)
-	for _, v := range result.Rows {
-		for queryParam := range params.QueryParams {
+	_, span := dragonfruit.StartSpan(params.Context, "filterResultSet",
+		trace.WithAttributes(attribute.Int("couchdb.rows", len(result.Rows))))
+	defer span.End()
 
-			val, ok := v.Value[queryParam]
-			if ok && (params.QueryParams.Get(queryParam) == val) {
-				/*switch val.(type) {}*/
+	outResult := result
 
+	if len(params.QueryParams) > 0 {
+		filters := dragonfruit.ParseFilters(params.QueryParams)
+		outResult.Rows = make([]couchdbRow, 0)
+		for _, v := range result.Rows {
+			if dragonfruit.MatchFilters(v.Value, filters) {
 				outResult.Rows = append(outResult.Rows, v)
 			}
 		}
 	}
+
+	// sort before paging
+	if len(params.Sort) > 0 {
+		sortRows(outResult.Rows, params.Sort)
+	}
+
 	totalNum := len(outResult.Rows)
-	if int(offset) > totalNum {
+
+	// cursors page from the position of the row they point at
+	start := offset
+	if cursor := params.Cursor; cursor != nil {
+		idx := -1
+		for i, row := range outResult.Rows {
+			if isCursorRow(row, cursor) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return 0, outResult, dragonfruit.NewCursorError("The cursor is no longer valid.")
+		}
+
+		start = idx + 1
+		if cursor.Before {
+			start = idx - limit
+			if start < 0 {
+				start = 0
+			}
+			limit = idx - start
+		}
+	}
+
+	rows := outResult.Rows
+	if start > totalNum {
 		outResult.Rows = make([]couchdbRow, 0)
-	} else if int(limit+offset) > len(outResult.Rows) {
-		outResult.Rows = outResult.Rows[offset:len(outResult.Rows)]
+	} else if start+limit > totalNum {
+		outResult.Rows = rows[start:totalNum]
 	} else {
-		outResult.Rows = outResult.Rows[offset:(offset + limit)]
+		outResult.Rows = rows[start:(start + limit)]
+	}
+
+	if count := len(outResult.Rows); count > 0 {
+		if start+count < totalNum {
+			outResult.NextCursor = makeCursor(outResult.Rows[count-1], false)
+		}
+		if start > 0 {
+			outResult.PrevCursor = makeCursor(outResult.Rows[0], true)
+		}
 	}
 
 	return totalNum, outResult, nil
 }
 
 // Load loads a document from the database.
-func (d *DbBackendCouch) load(database string, documentID string, doc interface{}) error {
+func (d *DbBackendCouch) load(ctx context.Context, database string, documentID string, doc interface{}) error {
 	err := d.ensureConnection()
 	if err != nil {
 		return err
 	}
-	db, err := d.client.EnsureDB(database)
+	db, err := d.ensureDB(ctx, database)
 	if err != nil {
 		return err
 	}
@@ -627,6 +981,12 @@ func (d *DbBackendCouch) pickView(params dragonfruit.QueryParams,
 	offset int) (string, bool) {
 
 	viewName := makePathViewName(params.Path)
+	if params.Trash {
+		viewName = makeTrashViewName(params.Path)
+	}
+	if params.Owner != "" {
+		return pickOwnerView(params, opts, viewName), true
+	}
 	// if there's no query parameters to filter, you can go
 	// ahead and use the passed limit and offset
 	// and apply it during the query to the view
@@ -637,9 +997,10 @@ func (d *DbBackendCouch) pickView(params dragonfruit.QueryParams,
 	}
 
 	// if there aren't any path params (e.g. /paramname/{value}), use a query
-	// view.
+	// view.  Query views only hold live documents, so the trash is
+	// always filtered in memory.
 	if len(params.PathParams) == 0 {
-		if len(params.QueryParams) > 0 {
+		if len(params.QueryParams) > 0 && !params.Trash {
 			queryView, found := d.findQueryView(params, opts)
 			if found {
 
@@ -699,6 +1060,79 @@ func (d *DbBackendCouch) pickView(params dragonfruit.QueryParams,
 
 }
 
+// pickOwnerView picks the owner view of a path or trash view.  Its keys start
+// with the owner, followed by the path params.  Query params can't use query
+// views (which hold every owner's documents), so the limit and offset are
+// always applied during the filter step.
+//
+// The opts parameter gets mutated.
+func pickOwnerView(params dragonfruit.QueryParams,
+	opts map[string]interface{},
+	viewName string) string {
+
+	key := []interface{}{params.Owner}
+	complete := true
+	for _, pathElement := range dragonfruit.ViewPathParamRe.FindAllStringSubmatch(params.Path, -1) {
+		param, ok := params.PathParams[pathElement[3]]
+		if pathElement[3] == "" || !ok {
+			complete = false
+			continue
+		}
+		key = append(key, param)
+	}
+
+	if complete {
+		opts["key"] = key
+	} else {
+		opts["startkey"] = key
+		opts["endkey"] = append(key, make(map[string]interface{}))
+	}
+	return makeOwnerViewName(viewName)
+}
+
+// findSortView uses a query view to sort results when there is a single
+// sort key and nothing else to filter on, since query views are keyed on a
+// single property.  This mutates the opts map.
+//
+// It returns the name of the view and a boolean to indicate whether the view
+// can be used.
+func (d *DbBackendCouch) findSortView(params dragonfruit.QueryParams,
+	opts map[string]interface{},
+	limit int,
+	offset int) (string, bool) {
+
+	if len(params.Sort) != 1 || len(params.PathParams) > 0 ||
+		len(params.QueryParams) > 0 || params.Trash || params.Owner != "" {
+		return "", false
+	}
+
+	var vd viewDoc
+	database := getDatabaseName(params)
+	err := d.load(params.Context, database, "_design/core", &vd)
+	if err != nil {
+		return "", false
+	}
+
+	viewName := makeQueryViewName(params.Sort[0].Name)
+	if _, exists := vd.Views[viewName]; !exists {
+		return "", false
+	}
+
+	opts["limit"] = limit
+	opts["skip"] = offset
+	if params.Sort[0].Descending {
+		opts["descending"] = true
+	}
+	return viewName, true
+}
+
+// sortRows sorts couchdb rows in memory using the same ordering as views.
+func sortRows(rows []couchdbRow, fields []dragonfruit.SortField) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return dragonfruit.LessByFields(rows[i].Value, rows[j].Value, fields)
+	})
+}
+
 // findQueryView selects a view from the design document to query with the
 // passed QueryParams map.  This mutates both the opts and params maps.
 //
@@ -713,7 +1147,7 @@ func (d *DbBackendCouch) findQueryView(params dragonfruit.QueryParams,
 	var vd viewDoc
 	//d.L
 	database := getDatabaseName(params)
-	err := d.load(database, "_design/core", &vd)
+	err := d.load(params.Context, database, "_design/core", &vd)
 	if err != nil {
 		panic(err)
 	}
@@ -791,6 +1225,14 @@ func matchInterfaceKeys(needle reflect.Value, haystack interface{}) bool {
 	switch t := haystack.(type) {
 	case string:
 		return needle.String() == t
+	case float64:
+		if needle.Kind() == reflect.Float64 {
+			return needle.Float() == t
+		}
+	case bool:
+		if needle.Kind() == reflect.Bool {
+			return needle.Bool() == t
+		}
 	case int64:
 		switch needle.Kind() {
 		case reflect.Int:
@@ -0,0 +1,109 @@
+package couchdb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dragonfruit-api/dragonfruit"
+)
+
+// testRows makes rows keyed by their IDs.
+func testRows(ids ...string) []couchdbRow {
+	out := make([]couchdbRow, len(ids))
+	for i, id := range ids {
+		out[i] = couchdbRow{ID: id, Key: id}
+	}
+	return out
+}
+
+// rowIDs returns the IDs of a set of rows.
+func rowIDs(rows []couchdbRow) []string {
+	out := make([]string, len(rows))
+	for i, row := range rows {
+		out[i] = row.ID
+	}
+	return out
+}
+
+func TestApplyCursor(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   map[string]interface{}
+		cursor *dragonfruit.Cursor
+		want   map[string]interface{}
+	}{
+		{"cursors replace skip", map[string]interface{}{"skip": 10},
+			&dragonfruit.Cursor{Key: "b", DocID: "2"},
+			map[string]interface{}{"startkey": "b", "startkey_docid": "2"}},
+		{"keys become ranges", map[string]interface{}{"key": "red"},
+			&dragonfruit.Cursor{Key: "red", DocID: "2"},
+			map[string]interface{}{"startkey": "red", "startkey_docid": "2", "endkey": "red"}},
+		{"before cursors reverse the view", map[string]interface{}{"startkey": "a", "endkey": "z"},
+			&dragonfruit.Cursor{Key: "m", DocID: "5", Before: true},
+			map[string]interface{}{"startkey": "m", "startkey_docid": "5", "endkey": "a", "descending": true}},
+		{"before cursors on descending views", map[string]interface{}{"descending": true},
+			&dragonfruit.Cursor{Key: "m", DocID: "5", Before: true},
+			map[string]interface{}{"startkey": "m", "startkey_docid": "5", "descending": false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applyCursor(tt.opts, tt.cursor)
+			if !reflect.DeepEqual(tt.opts, tt.want) {
+				t.Errorf("got %v, want %v", tt.opts, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageRows(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     []couchdbRow
+		cursor   *dragonfruit.Cursor
+		limit    int
+		offset   int
+		wantIDs  []string
+		wantNext *dragonfruit.Cursor
+		wantPrev *dragonfruit.Cursor
+	}{
+		{"first page", testRows("a", "b", "c"), nil, 2, 0,
+			[]string{"a", "b"}, &dragonfruit.Cursor{Key: "b", DocID: "b"}, nil},
+		{"only page", testRows("a", "b"), nil, 2, 0,
+			[]string{"a", "b"}, nil, nil},
+		{"offset pages have a prev page", testRows("c", "d"), nil, 2, 2,
+			[]string{"c", "d"}, nil, &dragonfruit.Cursor{Key: "c", DocID: "c", Before: true}},
+		{"after cursors skip the cursor row", testRows("b", "c", "d", "e"),
+			&dragonfruit.Cursor{Key: "b", DocID: "b"}, 2, 0,
+			[]string{"c", "d"}, &dragonfruit.Cursor{Key: "d", DocID: "d"},
+			&dragonfruit.Cursor{Key: "c", DocID: "c", Before: true}},
+		{"last page after a cursor", testRows("b", "c"),
+			&dragonfruit.Cursor{Key: "b", DocID: "b"}, 2, 0,
+			[]string{"c"}, nil, &dragonfruit.Cursor{Key: "c", DocID: "c", Before: true}},
+		{"before cursors reverse the rows", testRows("d", "c", "b", "a"),
+			&dragonfruit.Cursor{Key: "d", DocID: "d", Before: true}, 2, 0,
+			[]string{"b", "c"}, &dragonfruit.Cursor{Key: "c", DocID: "c"},
+			&dragonfruit.Cursor{Key: "b", DocID: "b", Before: true}},
+		{"first page before a cursor", testRows("c", "b", "a"),
+			&dragonfruit.Cursor{Key: "c", DocID: "c", Before: true}, 2, 0,
+			[]string{"a", "b"}, &dragonfruit.Cursor{Key: "b", DocID: "b"}, nil},
+		{"empty pages", testRows(), &dragonfruit.Cursor{Key: "z", DocID: "z"}, 2, 0,
+			[]string{}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &couchDbResponse{Rows: tt.rows}
+			pageRows(result, tt.cursor, tt.limit, tt.offset)
+			if got := rowIDs(result.Rows); !reflect.DeepEqual(got, tt.wantIDs) {
+				t.Errorf("got rows %v, want %v", got, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(result.NextCursor, tt.wantNext) {
+				t.Errorf("got next cursor %+v, want %+v", result.NextCursor, tt.wantNext)
+			}
+			if !reflect.DeepEqual(result.PrevCursor, tt.wantPrev) {
+				t.Errorf("got prev cursor %+v, want %+v", result.PrevCursor, tt.wantPrev)
+			}
+		})
+	}
+}
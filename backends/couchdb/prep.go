@@ -1,6 +1,7 @@
 package couchdb
 
 import (
+	"context"
 	"strings"
 
 	"github.com/dragonfruit-api/dragonfruit"
@@ -18,15 +19,30 @@ import (
 //
 // - path views handle parameters embedded in a path
 //
+// - embedded views handle single models embedded in a document
+//
+// - the search view holds the search terms of top-level documents
+//
+// - aggregate views reduce top-level documents for aggregation APIs
+//
+// - trash views hold soft deleted items for paths which soft delete (every
+// other view leaves them out)
+//
+// - owner views are path, trash and embedded views keyed by the owner of the
+// document first, for owned paths (see dragonfruit.Conf.Ownership)
+//
 // the Query method defines access rules and priorities
 func (d *DbBackendCouch) Prep(database string,
 	resource *dragonfruit.Swagger) error {
 
+	ctx, finish := dragonfruit.StartBackendCall(context.Background(), "Prep", database)
+	defer finish()
+
 	vd := viewDoc{}
 	id := "_design/core"
 	vd.ID = id
 	vd.Views = make(map[string]view)
-	dbz, err := d.client.EnsureDB(database)
+	dbz, err := d.ensureDB(ctx, database)
 	if err != nil {
 		return err
 	}
@@ -38,20 +54,65 @@ func (d *DbBackendCouch) Prep(database string,
 
 	vd.Language = "javascript"
 
+	softDelete := softDeletes(database, resource)
+
 	// well this is ugly...
 	for path, api := range resource.Paths {
 		if strings.HasPrefix(path, "/"+database) {
-			vd.makePathParamView(api, path, api.Get, resource)
-			vd.makeQueryParamView(api, api.Get, resource)
+			if path == "/"+database+"/"+dragonfruit.AGGREGATE && api.Get != nil {
+				vd.makeAggregateViews(api.Get, resource, softDelete)
+			}
+			// other reserved paths (e.g. /people/_changes) are served
+			// from the views of their collection
+			if strings.Contains(path, "/_") {
+				continue
+			}
+			owned := isOwnedPath(api)
+			vd.makePathParamView(api, path, api.Get, resource, owned, softDelete)
+			vd.makeEmbeddedView(path, resource, owned, softDelete)
+			// paths to single primitive values only support DELETE
+			if api.Get != nil {
+				vd.makeQueryParamView(api, api.Get, resource, softDelete)
+			}
+			if path == "/"+database && api.Get != nil {
+				vd.makeSearchView(api.Get, resource, softDelete)
+			}
 		}
 	}
-	_, _, err = d.save(database, id, vd)
+	_, _, err = d.save(ctx, database, id, vd)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// softDeletes reports whether any DELETE operation of a database soft
+// deletes.  Only then do its views have to leave out soft deleted items.
+func softDeletes(database string, resource *dragonfruit.Swagger) bool {
+	for path, api := range resource.Paths {
+		if strings.HasPrefix(path, "/"+database) && api.Delete != nil && api.Delete.SoftDelete {
+			return true
+		}
+	}
+	return false
+}
+
+// trashedExpr returns a JavaScript expression which is truthy if the
+// (sub-)document held by a variable has been soft deleted.
+func trashedExpr(v string) string {
+	meta := v + "." + dragonfruit.METADATA
+	return "(" + meta + " && " + meta + "." + dragonfruit.DELETEDAT + ")"
+}
+
+// liveGuard returns the start of a map function statement which skips soft
+// deleted documents, or an empty string if the database doesn't soft delete.
+func liveGuard(softDelete bool) string {
+	if !softDelete {
+		return ""
+	}
+	return "if(!" + trashedExpr("doc") + ") "
+}
+
 // Add adds a view to a view doc.
 func (vd *viewDoc) add(viewname string, v view) {
 	vd.Views[viewname] = v
@@ -63,12 +124,18 @@ func (vd *viewDoc) add(viewname string, v view) {
 func (vd *viewDoc) makeQueryParamView(
 	api *dragonfruit.PathItem,
 	op *dragonfruit.Operation,
-	resource *dragonfruit.Swagger) {
+	resource *dragonfruit.Swagger,
+	softDelete bool) {
 
 	modelName := dragonfruit.DeRef(op.Responses["200"].Schema.Ref)
 	responseModel := strings.Replace(modelName, strings.Title(dragonfruit.ContainerName), "", -1)
 
-	model := resource.Definitions[responseModel]
+	// inline response schemas (e.g. arrays of primitives) don't have
+	// a model to query against
+	model, ok := resource.Definitions[responseModel]
+	if !ok {
+		return
+	}
 	for _, param := range op.Parameters {
 		if param.In == "query" {
 			for propname, prop := range model.Properties {
@@ -76,7 +143,7 @@ func (vd *viewDoc) makeQueryParamView(
 					if prop.Type != "array" {
 						viewname := makeQueryViewName(param.Name)
 						vw := view{}
-						vw.MapFunc = "function(doc){ emit(doc." + propname + ", doc); }"
+						vw.MapFunc = "function(doc){ " + liveGuard(softDelete) + "emit(doc." + propname + ", doc); }"
 						vd.add(viewname, vw)
 					}
 				}
@@ -85,11 +152,111 @@ func (vd *viewDoc) makeQueryParamView(
 	}
 }
 
-// makePathParamView creates views for values passed through path parameters
+// makeSearchView creates a view which emits every search term found in the
+// search fields of a document.  Terms are split the same way as
+// dragonfruit.Tokenize splits them.
+func (vd *viewDoc) makeSearchView(op *dragonfruit.Operation,
+	resource *dragonfruit.Swagger,
+	softDelete bool) {
+
+	modelName := dragonfruit.DeRef(op.Responses["200"].Schema.Ref)
+	responseModel := strings.Replace(modelName, strings.Title(dragonfruit.ContainerName), "", -1)
+
+	model, ok := resource.Definitions[responseModel]
+	if !ok || len(model.SearchFields) == 0 {
+		delete(vd.Views, searchViewName)
+		return
+	}
+
+	fields := make([]string, 0)
+	for _, field := range model.SearchFields {
+		fields = append(fields, "\""+field+"\"")
+	}
+
+	// walk each (possibly dotted) field, flattening arrays along the way
+	vw := view{}
+	vw.MapFunc = "function(doc){ " + liveGuard(softDelete) +
+		"[" + strings.Join(fields, ",") + "].forEach(function(field){ " +
+		"var vals = [doc]; " +
+		"field.split(\".\").forEach(function(segment){ var next = []; " +
+		"vals.forEach(function(v){ if(v === null || typeof v !== \"object\") return; " +
+		"var x = v[segment]; if(Array.isArray(x)){ next = next.concat(x); } else if(x !== undefined){ next.push(x); } }); " +
+		"vals = next; }); " +
+		"vals.forEach(function(v){ if(typeof v !== \"string\") return; " +
+		"v.toLowerCase().split(/[^a-z0-9]+/).forEach(function(term){ if(term) emit(term, null); }); }); " +
+		"}); }"
+	vd.add(searchViewName, vw)
+}
+
+// makeAggregateViews creates a _count view and a _stats view for every
+// numeric property, each of them ungrouped and grouped by every property
+// that can be grouped by.
+func (vd *viewDoc) makeAggregateViews(op *dragonfruit.Operation,
+	resource *dragonfruit.Swagger,
+	softDelete bool) {
+
+	groups := []string{""}
+	properties := []string{""}
+	for _, param := range op.Parameters {
+		switch param.Name {
+		case dragonfruit.GROUPBY:
+			for _, group := range param.Enum {
+				if name, ok := group.(string); ok {
+					groups = append(groups, name)
+				}
+			}
+		case dragonfruit.SUM:
+			// every aggregate function takes the same properties
+			for _, property := range param.Items.Enum {
+				if name, ok := property.(string); ok {
+					properties = append(properties, name)
+				}
+			}
+		}
+	}
+
+	for _, group := range groups {
+		key := "null"
+		if group != "" {
+			key = "(doc." + group + " === undefined ? null : doc." + group + ")"
+		}
+
+		for _, property := range properties {
+			vw := view{}
+			if property == "" {
+				vw.MapFunc = "function(doc){ " + liveGuard(softDelete) + "emit(" + key + ", 1); }"
+				vw.ReduceFunc = "_count"
+			} else {
+				vw.MapFunc = "function(doc){ " + liveGuard(softDelete) + "if(typeof doc." +
+					property + " === \"number\") emit(" + key + ", doc." + property + "); }"
+				vw.ReduceFunc = "_stats"
+			}
+			vd.add(makeAggregateViewName(group, property), vw)
+		}
+	}
+}
+
+// isOwnedPath reports whether the operations of a path only see the items
+// of their owner.
+func isOwnedPath(api *dragonfruit.PathItem) bool {
+	for _, op := range []*dragonfruit.Operation{api.Get, api.Put, api.Post,
+		api.Delete, api.Head, api.Patch} {
+
+		if op != nil && op.Owned {
+			return true
+		}
+	}
+	return false
+}
+
+// makePathParamView creates views for values passed through path parameters.
+// Owned paths get owner views as well.
 func (vd *viewDoc) makePathParamView(api *dragonfruit.PathItem,
 	path string,
 	op *dragonfruit.Operation,
-	resource *dragonfruit.Swagger) {
+	resource *dragonfruit.Swagger,
+	owned bool,
+	softDelete bool) {
 
 	if !dragonfruit.TerminalPath.MatchString(path) {
 		return
@@ -98,80 +265,232 @@ func (vd *viewDoc) makePathParamView(api *dragonfruit.PathItem,
 	matches := dragonfruit.PathRe.FindAllStringSubmatch(path, -1)
 	tpath := dragonfruit.TranslatePath(path)
 	viewname := makePathViewName(tpath)
+	// only paths which soft delete have trash views
+	trashView := api.Delete != nil && api.Delete.SoftDelete
 
 	if len(matches) == 1 {
 		// regex voodoo
 		paramName := matches[0][4]
 		//pathName := matches[0][2]
 		vw := view{}
-		vw.MapFunc = "function(doc){ emit(doc." + paramName + ", doc); }"
+		vw.MapFunc = "function(doc){ " + liveGuard(softDelete) + "emit(doc." + paramName + ", doc); }"
 		vd.add(viewname, vw)
+
+		if trashView {
+			trash := view{}
+			trash.MapFunc = "function(doc){ if(" + trashedExpr("doc") + ") emit(doc." + paramName + ", doc); }"
+			vd.add(makeTrashViewName(tpath), trash)
+		}
+
+		if owned {
+			ownerKey := "[doc." + dragonfruit.OWNER + ", doc." + paramName + "]"
+			vw := view{}
+			vw.MapFunc = "function(doc){ " + liveGuard(softDelete) + "emit(" + ownerKey + ", doc); }"
+			vd.add(makeOwnerViewName(viewname), vw)
+
+			if trashView {
+				trash := view{}
+				trash.MapFunc = "function(doc){ if(" + trashedExpr("doc") + ") emit(" + ownerKey + ", doc); }"
+				vd.add(makeOwnerViewName(makeTrashViewName(tpath)), trash)
+			}
+		}
 	}
 	if len(matches) > 1 {
 		vw := view{}
-		model := modelizePath(matches[0][2])
-		paramName := matches[0][4]
-		emit := make([]viewParam, 1)
-
-		emit[0] = viewParam{
-			path:         matches[0][2],
-			paramname:    paramName,
-			paramtype:    "id",
-			singlepath:   "doc",
-			propertyname: "doc",
-		}
-
-		for _, path := range matches[1:] {
-			propertyname, property := findPropertyFromPath(model, path[2], resource)
-			p := viewParam{
-				path:         path[2],
-				paramname:    path[4],
-				singlepath:   inflector.Singularize(path[2]),
-				propertyname: propertyname,
-			}
+		emit, _ := makeEmitParams(matches, resource)
+
+		last := emit[len(emit)-1]
+		emitValue := last.singlepath
+		if last.paramtype == "value" {
+			// couchdb rows are maps, so wrap primitive values
+			emitValue = "{" + primitiveValueKey + ": " + last.singlepath + "}"
+		}
+
+		vw.MapFunc = makeMapFunc(emit, emitValue, makeTrashGuard(emit, false, softDelete), false)
+		vd.add(viewname, vw)
+
+		if trashView && last.paramtype != "value" {
+			trash := view{}
+			trash.MapFunc = makeMapFunc(emit, emitValue, makeTrashGuard(emit, true, softDelete), false)
+			vd.add(makeTrashViewName(tpath), trash)
+		}
 
-			emit = append(emit, p)
-			if property != nil {
-				model = modelizeContainer(property.Ref)
+		if owned {
+			vw := view{}
+			vw.MapFunc = makeMapFunc(emit, emitValue, makeTrashGuard(emit, false, softDelete), true)
+			vd.add(makeOwnerViewName(viewname), vw)
+
+			if trashView && last.paramtype != "value" {
+				trash := view{}
+				trash.MapFunc = makeMapFunc(emit, emitValue, makeTrashGuard(emit, true, softDelete), true)
+				vd.add(makeOwnerViewName(makeTrashViewName(tpath)), trash)
 			}
 		}
+	}
+
+}
+
+// makeEmbeddedView creates views for single models embedded in a document,
+// i.e. paths ending with a property name like /people/{id}/address.  Owned
+// paths get an owner view as well.
+func (vd *viewDoc) makeEmbeddedView(path string,
+	resource *dragonfruit.Swagger,
+	owned bool,
+	softDelete bool) {
+
+	if dragonfruit.TerminalPath.MatchString(path) {
+		return
+	}
+
+	matches := dragonfruit.PathRe.FindAllStringSubmatch(path, -1)
+	if len(matches) == 0 {
+		return
+	}
+
+	emit, model := makeEmitParams(matches, resource)
+	propertyname := dragonfruit.EndOfPathRe.FindString(path)
+
+	// collections end with a property name too, so check that this is
+	// actually a model
+	m, ok := resource.Definitions[model]
+	if !ok {
+		return
+	}
+	property, ok := m.Properties[propertyname]
+	if !ok || property.Ref == "" {
+		return
+	}
 
-		emitholder := make([]string, 0)
+	emitValue := emit[len(emit)-1].singlepath + "." + propertyname
 
-		vw.MapFunc = "function(doc){"
-		for idx, emitted := range emit[:(len(emit) - 1)] {
-			// for the join later
+	viewname := makePathViewName(dragonfruit.TranslatePath(path))
+	guard := emitValue
+	if trashGuard := makeTrashGuard(emit, false, softDelete); trashGuard != "" {
+		guard = guard + " && " + trashGuard
+	}
+
+	vw := view{}
+	vw.MapFunc = makeMapFunc(emit, emitValue, guard, false)
+	vd.add(viewname, vw)
 
-			vw.MapFunc = vw.MapFunc + emitted.propertyname + "." + emit[(idx+1)].propertyname + ".forEach("
+	if owned {
+		ownerView := view{}
+		ownerView.MapFunc = makeMapFunc(emit, emitValue, guard, true)
+		vd.add(makeOwnerViewName(viewname), ownerView)
+	}
+}
 
-			vw.MapFunc = vw.MapFunc + " function(" + emit[(idx+1)].singlepath + "){ "
+// makeEmitParams walks the parameterized segments of a path and returns the
+// list of view params to emit, along with the name of the model found at the
+// end of the path.
+func makeEmitParams(matches [][]string,
+	resource *dragonfruit.Swagger) ([]viewParam, string) {
+
+	model := modelizePath(matches[0][2])
+	emit := make([]viewParam, 1)
+
+	emit[0] = viewParam{
+		path:         matches[0][2],
+		paramname:    matches[0][4],
+		paramtype:    "id",
+		singlepath:   "doc",
+		propertyname: "doc",
+	}
 
+	for _, path := range matches[1:] {
+		propertyname, property := findPropertyFromPath(model, path[2], resource)
+		p := viewParam{
+			path:         path[2],
+			paramname:    path[4],
+			singlepath:   inflector.Singularize(path[2]),
+			propertyname: propertyname,
 		}
 
-		for _, emitted := range emit {
-			var curvar string
-			if emitted.paramtype == "index" {
-				curvar = "(" + emitted.singlepath + "Index).toString()"
+		if property != nil && property.Items != nil {
+			if property.Items.Ref != "" {
+				model = dragonfruit.DeRef(property.Items.Ref)
 			} else {
-				curvar = emitted.singlepath + "." + emitted.paramname
+				// arrays of primitives emit the value itself
+				p.paramtype = "value"
 			}
-			emitholder = append(emitholder, curvar)
 		}
+		emit = append(emit, p)
+	}
+	return emit, model
+}
+
+// makeMapFunc builds a map function which iterates through nested arrays and
+// emits a compound key made from the emit params.  If guard is set, only
+// rows where the guard expression is truthy are emitted.  If owned is set,
+// the key starts with the owner of the document.
+func makeMapFunc(emit []viewParam, emitValue string, guard string, owned bool) string {
+	emitholder := make([]string, 0)
+	if owned {
+		emitholder = append(emitholder, "doc."+dragonfruit.OWNER)
+	}
+
+	mapFunc := "function(doc){"
+	for idx, emitted := range emit[:(len(emit) - 1)] {
+		// for the join later
 
-		vw.MapFunc = vw.MapFunc + " emit(["
+		mapFunc = mapFunc + emitted.propertyname + "." + emit[(idx+1)].propertyname + ".forEach("
 
-		vw.MapFunc = vw.MapFunc + strings.Join(emitholder, ",")
+		mapFunc = mapFunc + " function(" + emit[(idx+1)].singlepath + "){ "
 
-		vw.MapFunc = vw.MapFunc + "]," + emit[len(emit)-1].singlepath + "); "
+	}
 
-		for range emit[:(len(emit) - 1)] {
-			vw.MapFunc = vw.MapFunc + " } );"
+	for _, emitted := range emit {
+		var curvar string
+		if emitted.paramtype == "index" {
+			curvar = "(" + emitted.singlepath + "Index).toString()"
+		} else if emitted.paramtype == "value" {
+			curvar = emitted.singlepath
+		} else {
+			curvar = emitted.singlepath + "." + emitted.paramname
 		}
+		emitholder = append(emitholder, curvar)
+	}
 
-		vw.MapFunc = vw.MapFunc + "} "
+	if guard != "" {
+		mapFunc = mapFunc + " if(" + guard + ")"
+	}
 
-		vd.add(viewname, vw)
+	mapFunc = mapFunc + " emit(["
+
+	mapFunc = mapFunc + strings.Join(emitholder, ",")
+
+	mapFunc = mapFunc + "]," + emitValue + "); "
+
+	for range emit[:(len(emit) - 1)] {
+		mapFunc = mapFunc + " } );"
+	}
+
+	mapFunc = mapFunc + "} "
+
+	return mapFunc
+}
 
+// makeTrashGuard returns a guard expression (see makeMapFunc) which leaves
+// out soft deleted documents and sub-documents.  If trashed is set, the last
+// level of the path has to be soft deleted instead.  Databases which don't
+// soft delete get an empty guard.
+func makeTrashGuard(emit []viewParam, trashed bool, softDelete bool) string {
+	if !softDelete {
+		return ""
 	}
+	guards := make([]string, 0)
+	for idx, emitted := range emit {
+		// primitive values can't be marked
+		if emitted.paramtype == "value" {
+			continue
+		}
 
+		deleted := trashedExpr(emitted.singlepath)
+		if trashed && idx == len(emit)-1 {
+			guards = append(guards, deleted)
+		} else {
+			guards = append(guards, "!"+deleted)
+		}
+	}
+	return strings.Join(guards, " && ")
 }
@@ -0,0 +1,149 @@
+package couchdb
+
+import (
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/dragonfruit-api/dragonfruit"
+	"github.com/fjl/go-couchdb"
+)
+
+// Search runs a full-text search (see dragonfruit.TextSearcher).
+//
+// Searches of top-level collections use the search view created by Prep to
+// find the documents containing any of the search terms.  The view indexes
+// every search field of the model, so the documents are then scored against
+// the fields of the request (which leave out hidden properties).  Other paths (e.g. arrays of
+// models inside a document) are loaded through the regular views and scored
+// in memory.
+func (d *DbBackendCouch) Search(params dragonfruit.QueryParams) (dragonfruit.Container, error) {
+	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Search", params.Path)
+	defer finish()
+	params.Context = ctx
+	limit, offset := setLimitAndOffset(params)
+	if limit < 1 {
+		return dragonfruit.Container{}, errors.New("Limit must be greater than 0")
+	}
+
+	database := getDatabaseName(params)
+	terms := dragonfruit.Tokenize(params.Search)
+
+	var (
+		hits []*dragonfruit.SearchHit
+		err  error
+	)
+	if params.Path == "/"+database {
+		hits, err = d.searchView(database, terms, params)
+	}
+	if hits == nil && err == nil {
+		hits, err = d.searchScan(terms, params)
+	}
+	if err != nil {
+		return dragonfruit.Container{}, err
+	}
+
+	dragonfruit.OrderHits(hits, params.Sort)
+
+	c := dragonfruit.Container{}
+	c.Meta.Total = len(hits)
+	c.Meta.Offset = offset
+	c.Meta.ResponseCode = 200
+	c.Meta.ResponseMessage = "Ok."
+	c.ContainerType = strings.Title(makeTypeName(params.Path) + strings.Title(dragonfruit.ContainerName))
+	c.Results = make([]interface{}, 0)
+	for i := offset; i < len(hits) && i < offset+limit; i++ {
+		outRow, err := sanitizeDoc(hits[i].Doc)
+		if err != nil {
+			return c, err
+		}
+		c.Results = append(c.Results, dragonfruit.ProjectFields(outRow, params.Fields))
+	}
+	c.Meta.Count = len(c.Results)
+
+	return c, nil
+}
+
+// searchView looks up each search term in the search view of a database,
+// and scores the documents found against the search fields of the params.
+// The remaining query params (and the owner) are applied as filters.  It
+// returns nil hits if the database doesn't have a search view.
+func (d *DbBackendCouch) searchView(database string, terms []string,
+	params dragonfruit.QueryParams) ([]*dragonfruit.SearchHit, error) {
+
+	err := d.ensureConnection()
+	if err != nil {
+		return nil, err
+	}
+	db := d.db(params.Context, database)
+
+	filters := dragonfruit.ParseFilters(params.QueryParams)
+	seen := make(map[string]bool)
+	hits := make([]*dragonfruit.SearchHit, 0)
+
+	for _, term := range terms {
+		var result couchDbResponse
+		opts := map[string]interface{}{
+			"key":          term,
+			"include_docs": true,
+		}
+		err = db.View("_design/core", searchViewName, &result, opts)
+		if couchdb.NotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// rows are emitted once per occurrence of the term
+		for _, row := range result.Rows {
+			if seen[row.ID] {
+				continue
+			}
+			seen[row.ID] = true
+			if !dragonfruit.MatchFilters(row.Doc, filters) {
+				continue
+			}
+			if params.Owner != "" && row.Doc[dragonfruit.OWNER] != params.Owner {
+				continue
+			}
+			if hit := dragonfruit.ScoreDocument(row.Doc, params.SearchFields, terms); hit != nil {
+				hits = append(hits, hit)
+			}
+		}
+	}
+	return hits, nil
+}
+
+// searchScan loads every result matching the query params and scores each of
+// them against the search terms.
+func (d *DbBackendCouch) searchScan(terms []string,
+	params dragonfruit.QueryParams) ([]*dragonfruit.SearchHit, error) {
+
+	// copy the query params, since queryView mutates them
+	scanParams := make(map[string]interface{})
+	for k, v := range params.QueryParams {
+		scanParams[k] = v
+	}
+	scanParams[dragonfruit.LIMIT] = int64(math.MaxInt32)
+
+	_, result, err := d.queryView(dragonfruit.QueryParams{
+		Path:        params.Path,
+		PathParams:  params.PathParams,
+		QueryParams: scanParams,
+		Owner:       params.Owner,
+		Context:     params.Context,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]*dragonfruit.SearchHit, 0)
+	for _, row := range result.Rows {
+		doc := unwrapValue(row.Value)
+		if hit := dragonfruit.ScoreDocument(doc, params.SearchFields, terms); hit != nil {
+			hits = append(hits, hit)
+		}
+	}
+	return hits, nil
+}
@@ -0,0 +1,114 @@
+package couchdb
+
+import (
+	"context"
+
+	"github.com/dragonfruit-api/dragonfruit"
+	"github.com/fjl/go-couchdb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedDB is a database handle which traces each HTTP request it makes to
+// CouchDB as a client span of a context.  The client library doesn't take
+// contexts, so the spans are made around its calls.
+type tracedDB struct {
+	db   *couchdb.DB
+	name string
+	ctx  context.Context
+}
+
+// db returns the traced handle of a database.
+func (d *DbBackendCouch) db(ctx context.Context, database string) *tracedDB {
+	return &tracedDB{db: d.client.DB(database), name: database, ctx: ctx}
+}
+
+// ensureDB creates a database if it doesn't exist yet, and returns its
+// traced handle.
+func (d *DbBackendCouch) ensureDB(ctx context.Context, database string) (*tracedDB, error) {
+	_, span := startRequestSpan(ctx, "PUT", database, "")
+	db, err := d.client.EnsureDB(database)
+	endRequestSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedDB{db: db, name: database, ctx: ctx}, nil
+}
+
+// startRequestSpan starts the span of a CouchDB request, named after its
+// method and (templated) path, and returns a context holding it.
+func startRequestSpan(ctx context.Context, method string, database string,
+	path string) (context.Context, trace.Span) {
+
+	return dragonfruit.StartSpan(ctx, method+" /"+database+path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "couchdb"),
+			attribute.String("db.name", database),
+			attribute.String("http.request.method", method)))
+}
+
+// endRequestSpan ends the span of a CouchDB request.  Documents which don't
+// exist are an answer rather than a failure.
+func endRequestSpan(span trace.Span, err error) {
+	if err != nil && !couchdb.NotFound(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Get loads a document.
+func (t *tracedDB) Get(id string, doc interface{}, opts couchdb.Options) error {
+	_, span := startRequestSpan(t.ctx, "GET", t.name, "/{docid}")
+	span.SetAttributes(attribute.String("couchdb.doc_id", id))
+	err := t.db.Get(id, doc, opts)
+	endRequestSpan(span, err)
+	return err
+}
+
+// Rev loads the latest revision of a document.
+func (t *tracedDB) Rev(id string) (string, error) {
+	_, span := startRequestSpan(t.ctx, "HEAD", t.name, "/{docid}")
+	span.SetAttributes(attribute.String("couchdb.doc_id", id))
+	rev, err := t.db.Rev(id)
+	endRequestSpan(span, err)
+	return rev, err
+}
+
+// Put saves a document.
+func (t *tracedDB) Put(id string, doc interface{}, rev string) (string, error) {
+	_, span := startRequestSpan(t.ctx, "PUT", t.name, "/{docid}")
+	span.SetAttributes(attribute.String("couchdb.doc_id", id))
+	newrev, err := t.db.Put(id, doc, rev)
+	endRequestSpan(span, err)
+	return newrev, err
+}
+
+// Delete deletes a document.
+func (t *tracedDB) Delete(id string, rev string) (string, error) {
+	_, span := startRequestSpan(t.ctx, "DELETE", t.name, "/{docid}")
+	span.SetAttributes(attribute.String("couchdb.doc_id", id))
+	newrev, err := t.db.Delete(id, rev)
+	endRequestSpan(span, err)
+	return newrev, err
+}
+
+// View queries a view.
+func (t *tracedDB) View(ddoc string, view string, result interface{},
+	opts couchdb.Options) error {
+
+	_, span := startRequestSpan(t.ctx, "GET", t.name, "/"+ddoc+"/_view/"+view)
+	err := t.db.View(ddoc, view, result, opts)
+	endRequestSpan(span, err)
+	return err
+}
+
+// AllDocs queries the _all_docs view.
+func (t *tracedDB) AllDocs(result interface{}, opts couchdb.Options) error {
+	_, span := startRequestSpan(t.ctx, "GET", t.name, "/_all_docs")
+	err := t.db.AllDocs(result, opts)
+	endRequestSpan(span, err)
+	return err
+}
@@ -0,0 +1,73 @@
+package couchdb
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/dragonfruit-api/dragonfruit"
+)
+
+// Trash lists the soft deleted items of a collection
+// (see dragonfruit.Trasher).  Items are loaded from the trash views created
+// by Prep.
+func (d *DbBackendCouch) Trash(params dragonfruit.QueryParams) (dragonfruit.Container, error) {
+	params.Trash = true
+	return d.Query(params)
+}
+
+// Restore un-deletes a soft deleted item (see dragonfruit.Trasher).
+// Sub-documents are restored in place, so their parent document has to be
+// live.
+func (d *DbBackendCouch) Restore(params dragonfruit.QueryParams) (interface{}, error) {
+	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Restore", params.Path)
+	defer finish()
+	params.Context = ctx
+	params.Trash = true
+	database := getDatabaseName(params)
+
+	_, result, err := d.queryView(params)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Rows) == 0 {
+		return nil, errors.New(dragonfruit.NOTFOUNDERROR)
+	}
+
+	pathmap := dragonfruit.PathParamRe.FindAllStringSubmatch(params.Path, -1)
+	if len(pathmap) == 1 {
+		target := result.Rows[0]
+		dragonfruit.UnmarkTrashed(target.Value)
+		_, doc, err := d.saveVersion(params.Context, database, target.ID, target.Value, params.Version)
+		if err != nil {
+			return nil, err
+		}
+		return sanitizeDoc(dragonfruit.RemoveTrashed(doc))
+	}
+
+	couchdoc, id, err := d.getRootDocument(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// a merge patch removing the marker (the metadata only holds the
+	// marker)
+	params.PatchFormat = dragonfruit.MERGEPATCH
+	restore := map[string]interface{}{dragonfruit.METADATA: nil}
+	docVal, partial, err := findSubDoc(pathmap[1:],
+		params,
+		reflect.ValueOf(couchdoc.Value),
+		reflect.ValueOf(restore),
+		dragonfruit.PATCH)
+	if err != nil {
+		return nil, err
+	}
+	if !partial.IsValid() {
+		return nil, errors.New(dragonfruit.NOTFOUNDERROR)
+	}
+
+	_, _, err = d.saveVersion(params.Context, database, id, docVal.Interface(), params.Version)
+	if err != nil {
+		return nil, err
+	}
+	return sanitizeDoc(dragonfruit.RemoveTrashed(partial.Interface()))
+}
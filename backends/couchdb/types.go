@@ -1,9 +1,25 @@
 package couchdb
 
 import (
+	"github.com/dragonfruit-api/dragonfruit"
 	"github.com/fjl/go-couchdb"
 )
 
+// The key used to wrap primitive values emitted by views
+const primitiveValueKey = "_value"
+
+// The name of the view holding the search terms of top-level documents
+const searchViewName = "by_search"
+
+// The prefix of reduce views used for aggregate queries
+const aggregateViewPrefix = "aggregate_"
+
+// The prefix of path views holding soft deleted items
+const trashViewPrefix = "trash_"
+
+// The prefix of path views keyed by the owner of the document first
+const ownerViewPrefix = "owner_"
+
 // A CouchDB view.
 type view struct {
 	MapFunc    string `json:"map"`
@@ -22,6 +38,8 @@ type viewDoc struct {
 type DbBackendCouch struct {
 	client     *couchdb.Client
 	connection chan bool
+	// the server URL, for requests the client library doesn't support
+	url string
 }
 
 // viewParams are used to create design documents during the prep phase
@@ -41,10 +59,33 @@ type couchdbRow struct {
 	Value map[string]interface{} `json:"value"`
 }
 
+// Represents a row returned by a reduce view.  Values are numbers for _count
+// views and maps for _stats views.
+type reduceRow struct {
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// Represents a reduce view result
+type reduceResponse struct {
+	Rows []reduceRow `json:"rows"`
+}
+
 // Represents a couchdb result
 type couchDbResponse struct {
 	Rows      []couchdbRow `json:"rows"`
 	Offset    int          `json:"offset"`
 	TotalRows int          `json:"total_rows"`
 	Limit     int          `json:"-"`
+	// cursors for the neighbouring pages, if any
+	NextCursor *dragonfruit.Cursor `json:"-"`
+	PrevCursor *dragonfruit.Cursor `json:"-"`
+}
+
+// Represents the result of a single document sent to _bulk_docs
+type bulkDocResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
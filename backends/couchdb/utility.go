@@ -30,6 +30,10 @@ func sanitizeDocInternal(doc reflect.Value) (reflect.Value, error) {
 	case reflect.Interface:
 		return sanitizeDocInternal(doc.Elem())
 
+	// values from arrays of primitives don't need sanitizing
+	case reflect.String, reflect.Float64, reflect.Bool:
+		return doc, nil
+
 	case reflect.Map:
 
 		for _, key := range doc.MapKeys() {
@@ -43,6 +47,15 @@ func sanitizeDocInternal(doc reflect.Value) (reflect.Value, error) {
 	return doc, nil
 }
 
+// unwrapValue returns the primitive value from a row emitted by a view on an
+// array of primitives.  Other rows are returned as is.
+func unwrapValue(row map[string]interface{}) interface{} {
+	if val, ok := row[primitiveValueKey]; ok && len(row) == 1 {
+		return val
+	}
+	return row
+}
+
 // modelizePath inflects a model name
 func modelizePath(modelName string) string {
 	return strings.Title(inflector.Singularize(modelName))
@@ -58,6 +71,32 @@ func makeQueryViewName(param string) string {
 	return "by_query_" + param
 }
 
+// makeAggregateViewName returns the name of the reduce view used to
+// aggregate a property (or count documents, if property is empty) grouped by
+// another property.
+func makeAggregateViewName(groupBy string, property string) string {
+	name := aggregateViewPrefix + "count"
+	if property != "" {
+		name = aggregateViewPrefix + "stats_" + property
+	}
+	if groupBy != "" {
+		name = name + "_by_" + groupBy
+	}
+	return name
+}
+
+// makeTrashViewName makes canonical view names for the soft deleted items
+// of a path view
+func makeTrashViewName(path string) string {
+	return trashViewPrefix + makePathViewName(path)
+}
+
+// makeOwnerViewName makes canonical view names for the owned variant of a
+// path or trash view
+func makeOwnerViewName(viewName string) string {
+	return ownerViewPrefix + viewName
+}
+
 // makePathViewName makes canonical view names for path parameters
 func makePathViewName(path string) string {
 	matches := dragonfruit.PathParamRe.FindAllStringSubmatch(path, -1)
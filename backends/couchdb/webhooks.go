@@ -0,0 +1,57 @@
+package couchdb
+
+import (
+	"context"
+
+	"github.com/dragonfruit-api/dragonfruit"
+	"github.com/fjl/go-couchdb"
+)
+
+// WebhooksDocName is the document which stores webhook subscriptions, next
+// to the API definition.
+const WebhooksDocName = "webhooks"
+
+// webhooksDoc is the stored form of the webhook subscriptions.
+type webhooksDoc struct {
+	Rev      string                 `json:"_rev,omitempty"`
+	Webhooks []*dragonfruit.Webhook `json:"webhooks"`
+}
+
+// LoadWebhooks loads the webhook subscriptions (see
+// dragonfruit.WebhookStore).
+func (d *DbBackendCouch) LoadWebhooks() ([]*dragonfruit.Webhook, error) {
+	doc := &webhooksDoc{}
+	err := d.load(context.Background(), SwaggerResourceDB, WebhooksDocName, doc)
+	if couchdb.NotFound(err) {
+		return make([]*dragonfruit.Webhook, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if doc.Webhooks == nil {
+		doc.Webhooks = make([]*dragonfruit.Webhook, 0)
+	}
+	return doc.Webhooks, nil
+}
+
+// SaveWebhooks replaces the stored webhook subscriptions.
+func (d *DbBackendCouch) SaveWebhooks(hooks []*dragonfruit.Webhook) error {
+	err := d.ensureConnection()
+	if err != nil {
+		return err
+	}
+	db, err := d.ensureDB(context.Background(), SwaggerResourceDB)
+	if err != nil {
+		return err
+	}
+
+	// the document doesn't exist until the first webhook is added
+	existing := &webhooksDoc{}
+	err = db.Get(WebhooksDocName, existing, nil)
+	if err != nil && !couchdb.NotFound(err) {
+		return err
+	}
+
+	_, err = db.Put(WebhooksDocName, &webhooksDoc{Webhooks: hooks}, existing.Rev)
+	return err
+}
@@ -0,0 +1,421 @@
+package dragonfruit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gedex/inflector"
+	"github.com/go-martini/martini"
+)
+
+// The bulk path segment and operation names
+// (e.g. POST /people/_bulk with [{"op": "delete", "id": 4}]).
+const (
+	BULK       = "_bulk"
+	BULKCREATE = "create"
+	BULKUPDATE = "update"
+	BULKPATCH  = "patch"
+	BULKDELETE = "delete"
+)
+
+// A BulkItem is a single operation sent to a bulk API.
+type BulkItem struct {
+	Op string `json:"op"`
+	// the ID of the item to update, patch or delete
+	ID interface{} `json:"id,omitempty"`
+	// the new, replacement or (merge) patch body
+	Body json.RawMessage `json:"body,omitempty"`
+	// the version an update, patch or delete expects (see QueryParams)
+	Version string `json:"version,omitempty"`
+}
+
+// A BulkOperation is a bulk item translated into the QueryParams of a
+// single item, as if it had been sent to its own path.  Creates use the
+// collection's path.
+type BulkOperation struct {
+	Op     string
+	Params QueryParams
+
+	// the relation policy changes of a delete, made once it has succeeded
+	integrity *integrityPlan
+}
+
+// A BulkResult is the outcome of a single bulk operation, with the status
+// code the operation would have returned by itself.
+type BulkResult struct {
+	Status int         `json:"status"`
+	Body   interface{} `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// A BulkWriter is a backend which can apply a batch of writes in one go.
+// Backends which don't implement it have bulk operations applied one at a
+// time.
+type BulkWriter interface {
+	// Bulk applies a list of operations and returns a result for each of
+	// them, in the same order.  A failed operation doesn't stop the others.
+	Bulk([]*BulkOperation) ([]*BulkResult, error)
+}
+
+// RunBulk applies bulk operations one at a time using the regular backend
+// methods.
+func RunBulk(db DbBackend, ops []*BulkOperation) []*BulkResult {
+	out := make([]*BulkResult, 0)
+	for _, op := range ops {
+		var (
+			doc    interface{}
+			err    error
+			status = 200
+		)
+
+		switch op.Op {
+		case BULKCREATE:
+			doc, err = db.Insert(op.Params)
+			status = 201
+		case BULKUPDATE:
+			doc, err = db.Update(op.Params, PUT)
+		case BULKPATCH:
+			doc, err = db.Update(op.Params, PATCH)
+		case BULKDELETE:
+			err = db.Remove(op.Params)
+		default:
+			err = errors.New("The operation " + op.Op + " is not valid.")
+		}
+
+		if err != nil {
+			out = append(out, BulkErrorResult(err))
+			continue
+		}
+		out = append(out, &BulkResult{Status: status, Body: doc})
+	}
+	return out
+}
+
+// BulkErrorResult returns the result of a failed bulk operation, using the
+// status codes of the single item APIs.
+func BulkErrorResult(err error) *BulkResult {
+	status := 500
+	switch e := err.(type) {
+	case *IntegrityError, *PatchError:
+		status = 409
+	case *AccessError:
+		status = 403
+	default:
+		switch e.Error() {
+		case NOTFOUNDERROR:
+			status = 404
+		case PRECONDITIONFAILED:
+			status = 412
+		}
+	}
+	return &BulkResult{Status: status, Error: err.Error()}
+}
+
+// makeBulkAPI creates the bulk API of a collection (e.g. /people/_bulk).
+func makeBulkAPI(schemaName string,
+	upstreamParams []*Parameter, cnf Conf) *PathItem {
+
+	postOp := &Operation{
+		OperationID: "bulk" + inflector.Pluralize(schemaName),
+		Summary:     "Create, update and delete multiple " + inflector.Pluralize(inflector.Singularize(schemaName)) + ".",
+		Description: "Each operation returns the status code it would have returned by itself.  " +
+			"A failed operation doesn't stop the others.",
+		Responses: make(map[string]*Response),
+		Bulk:      schemaName,
+		Audit:     cnf.Audit,
+	}
+
+	postOp.Responses["200"] = &Response{
+		Description: "The result of each operation, in the order they were sent",
+		Schema: &Schema{
+			Type: "array",
+			Items: &Schema{
+				Properties: map[string]*Schema{
+					"status": &Schema{Type: "integer"},
+					"body":   &Schema{Ref: MakeRef(schemaName)},
+					"error":  &Schema{Type: "string"},
+				},
+			},
+		},
+	}
+
+	ops := make([]interface{}, 0)
+	for _, op := range []string{BULKCREATE, BULKUPDATE, BULKPATCH, BULKDELETE} {
+		ops = append(ops, op)
+	}
+
+	bodyParam := &Parameter{
+		Name:        "body",
+		In:          "body",
+		Description: "A list of operations.  Updates, patches and deletes need the id of a " + schemaName + ".",
+		Required:    true,
+		Schema: &Schema{
+			Type: "array",
+			Items: &Schema{
+				Properties: map[string]*Schema{
+					"op":      &Schema{Type: "string", Enum: ops},
+					"id":      &Schema{},
+					"body":    &Schema{Ref: MakeRef(schemaName)},
+					"version": &Schema{Type: "string"},
+				},
+				Required: []string{"op"},
+			},
+		},
+	}
+
+	postOp.Parameters = append(postOp.Parameters, bodyParam)
+	postOp.Parameters = append(postOp.Parameters, upstreamParams...)
+
+	return &PathItem{
+		Post:    postOp,
+		Options: makeOptionsOperation("POST", upstreamParams),
+	}
+}
+
+// serveBulk applies a list of bulk items for the frontend.  path is the
+// (Martini formatted) path of the bulk API.  Each item needs the roles of the
+// operation it stands for (e.g. DELETE /people/{id} for deletes).
+func serveBulk(db DbBackend, rd *Swagger, bulkOp *Operation, path string,
+	pathParams map[string]interface{}, body []byte, req *http.Request) (int, string) {
+
+	stamp := newAuditStamp(bulkOp, req)
+	guard := newFieldGuard(rd, bulkOp, req)
+	roles := requestRoles(req)
+	owner := requestOwner(bulkOp, req)
+
+	// ids are decoded as numbers so they can be coerced like path params
+	var items []*BulkItem
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&items)
+	if err != nil {
+		outerr, _ := json.Marshal("The body must be a list of operations.")
+		return 409, string(outerr)
+	}
+
+	collectionPath := strings.TrimSuffix(path, "/"+BULK)
+	itemPath, itemOp := findItemPath(rd, collectionPath)
+	if itemOp == nil {
+		outerr, _ := json.Marshal("The collection has no single item path.")
+		return 500, string(outerr)
+	}
+	idName := EndOfPathRe.FindString(itemPath)[1:]
+
+	// operations which fail before reaching the backend keep their result
+	results := make([]*BulkResult, len(items))
+	ops := make([]*BulkOperation, 0)
+	positions := make([]int, 0)
+
+	for i, item := range items {
+		if !bulkItemAllowed(rd, item, collectionPath, itemPath, roles) {
+			results[i] = BulkErrorResult(newAccessError(ROLEERROR))
+			continue
+		}
+		op, err := makeBulkOperation(db, rd, item, collectionPath, itemPath,
+			idName, itemOp, pathParams, stamp, guard, owner, req.Context())
+		if err != nil {
+			results[i] = BulkErrorResult(err)
+			continue
+		}
+		ops = append(ops, op)
+		positions = append(positions, i)
+	}
+
+	var applied []*BulkResult
+	if writer, ok := db.(BulkWriter); ok {
+		applied, err = writer.Bulk(ops)
+		if err != nil {
+			outerr, _ := json.Marshal(err.Error())
+			return 500, string(outerr)
+		}
+	} else {
+		applied = RunBulk(db, ops)
+	}
+
+	for i, result := range applied {
+		results[positions[i]] = result
+		publishBulkChange(db, rd, ops[i], result)
+		result.Body = guard.hide(result.Body)
+
+		// relation policies change other resources only once a delete
+		// has succeeded
+		if result.Status < 300 {
+			if err := ops[i].integrity.apply(req.Context(), db, rd); err != nil {
+				results[positions[i]] = BulkErrorResult(err)
+			}
+		}
+	}
+
+	out, err := json.Marshal(results)
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+	return 200, string(out)
+}
+
+// makeBulkOperation checks a bulk item and builds its operation.  Relation
+// policies, field access rules, owners and audit properties are applied
+// here, the same way they are for single items, except that the changes
+// a delete's relation policies make are left for serveBulk.
+func makeBulkOperation(db DbBackend, rd *Swagger, item *BulkItem,
+	collectionPath string, itemPath string, idName string, itemOp *Operation,
+	pathParams map[string]interface{}, stamp *auditStamp,
+	guard *fieldGuard, owner string, ctx context.Context) (*BulkOperation, error) {
+
+	op := &BulkOperation{
+		Op: item.Op,
+		Params: QueryParams{
+			Path:        itemPath,
+			PathParams:  make(map[string]interface{}),
+			Body:        []byte(item.Body),
+			Version:     item.Version,
+			PatchFormat: MERGEPATCH,
+			SoftDelete:  item.Op == BULKDELETE && isSoftDelete(rd, itemPath),
+			Owner:       owner,
+			Context:     ctx,
+		},
+	}
+	for k, v := range pathParams {
+		op.Params.PathParams[k] = v
+	}
+	if item.Op != BULKDELETE {
+		body, err := stripMetadata(MERGEPATCH, op.Params.Body)
+		if err != nil {
+			return nil, err
+		}
+		op.Params.Body = body
+	}
+
+	switch item.Op {
+	case BULKCREATE:
+		op.Params.Path = collectionPath
+		body, err := guard.create(op.Params.Body)
+		if err != nil {
+			return nil, err
+		}
+		body, err = stamp.create(body)
+		if err != nil {
+			return nil, err
+		}
+		body, err = stampOwner(collectionPath, owner, body)
+		if err != nil {
+			return nil, err
+		}
+		op.Params.Body = body
+		return op, checkWriteIntegrity(ctx, db, rd, collectionPath, op.Params.Body, owner)
+	case BULKUPDATE, BULKPATCH, BULKDELETE:
+	default:
+		return nil, errors.New("The operation " + item.Op + " is not valid.")
+	}
+
+	if item.ID == nil {
+		return nil, errors.New("The operation " + item.Op + " needs an id.")
+	}
+
+	// coerce the id the same way a path param is coerced
+	id, err := coerceParam(martini.Params{idName: fmt.Sprint(item.ID)}, itemOp.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	op.Params.PathParams[idName] = id[idName]
+
+	if item.Op == BULKDELETE {
+		err = checkOwner(db, itemPath, op.Params.PathParams, owner)
+		if err != nil {
+			return nil, err
+		}
+		err = checkVersion(db, itemPath, op.Params.PathParams, item.Version)
+		if err != nil {
+			return nil, err
+		}
+		op.integrity, err = planDeleteIntegrity(ctx, db, rd, itemPath, op.Params.PathParams, owner)
+		return op, err
+	}
+
+	if item.Op == BULKPATCH {
+		op.Params.Body, err = guard.patch(MERGEPATCH, op.Params.Body)
+		if err == nil {
+			op.Params.Body, err = stamp.patch(MERGEPATCH, op.Params.Body)
+		}
+		if err == nil {
+			op.Params.Body, err = checkOwnerPatch(itemPath, owner, MERGEPATCH, op.Params.Body)
+		}
+	} else if stamp != nil || guard != nil {
+		existing := loadExisting(db, itemPath, op.Params.PathParams)
+		op.Params.Body, err = guard.replace(op.Params.Body, existing)
+		if err == nil && stamp != nil {
+			op.Params.Body, err = stamp.replace(op.Params.Body, existing)
+		}
+	}
+	if err == nil && item.Op == BULKUPDATE {
+		op.Params.Body, err = stampOwner(itemPath, owner, op.Params.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return op, checkWriteIntegrity(ctx, db, rd, itemPath, op.Params.Body, owner)
+}
+
+// bulkItemAllowed reports whether a user's roles allow the operation a bulk
+// item stands for.  Items standing for operations the API doesn't have are
+// never allowed.
+func bulkItemAllowed(rd *Swagger, item *BulkItem, collectionPath string,
+	itemPath string, roles []string) bool {
+
+	var op *Operation
+	for path, pathitem := range rd.Paths {
+		switch TranslatePath(path) {
+		case collectionPath:
+			if item.Op == BULKCREATE {
+				op = pathitem.Post
+			}
+		case itemPath:
+			switch item.Op {
+			case BULKUPDATE:
+				op = pathitem.Put
+			case BULKPATCH:
+				op = pathitem.Patch
+			case BULKDELETE:
+				op = pathitem.Delete
+			}
+		}
+	}
+	return op != nil && (len(op.Roles) == 0 || hasRole(roles, op.Roles))
+}
+
+// publishBulkChange publishes the change made by a successful bulk
+// operation.
+func publishBulkChange(db DbBackend, rd *Swagger, op *BulkOperation, result *BulkResult) {
+	if result.Status >= 300 {
+		return
+	}
+	switch op.Op {
+	case BULKCREATE:
+		publishInsert(db, rd, op.Params.Path, op.Params.PathParams, result.Body, op.Params.Owner)
+	case BULKDELETE:
+		publishChange(db, CHANGEDELETE, FillPath(op.Params.Path, op.Params.PathParams), nil,
+			op.Params.Owner)
+	default:
+		publishChange(db, CHANGEUPDATE, FillPath(op.Params.Path, op.Params.PathParams), result.Body,
+			op.Params.Owner)
+	}
+}
+
+// findItemPath finds the (Martini formatted) single item path of a
+// collection (e.g. /people/:id for /people), along with its GET operation.
+func findItemPath(rd *Swagger, collectionPath string) (string, *Operation) {
+	for path, pathitem := range rd.Paths {
+		translated := TranslatePath(path)
+		rest := strings.TrimPrefix(translated, collectionPath+"/:")
+		if rest != translated && !strings.Contains(rest, "/") && pathitem.Get != nil {
+			return translated, pathitem.Get
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,343 @@
+package dragonfruit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gedex/inflector"
+)
+
+// The change feed path segment and query param
+// (e.g. GET /people/_changes?since=42).
+const (
+	CHANGES = "_changes"
+	SINCE   = "since"
+)
+
+// Change event types
+const (
+	CHANGEINSERT = "insert"
+	CHANGEUPDATE = "update"
+	CHANGEDELETE = "delete"
+)
+
+// the number of events buffered for each subscriber, and how often idle
+// streams are pinged to keep them open
+const (
+	changeBufferSize = 64
+	changeKeepAlive  = 30 * time.Second
+)
+
+// A ChangeEvent describes a single item being inserted, updated or deleted.
+type ChangeEvent struct {
+	// the position of the event in the feed, used to resume it
+	Seq  string `json:"seq,omitempty"`
+	Type string `json:"type"`
+	// the URL path of the item (e.g. /people/4/pets/2)
+	Path string `json:"path"`
+	// the item after the change (empty for deletes)
+	Doc interface{} `json:"doc,omitempty"`
+	// the owner of the item, used to filter owned feeds (see Conf.Ownership)
+	Owner string `json:"-"`
+}
+
+// A ChangeFeed is a backend which can stream the changes made to a
+// collection, including changes made by other processes.  Backends which
+// don't implement it get the changes made through the frontend, from an
+// in-process publisher.
+type ChangeFeed interface {
+	// Changes streams the changes made to the items at the Path of a
+	// QueryParams struct (a single item path, e.g. /people/:id/pets/:petId)
+	// after a sequence, or from now on if the sequence is empty.  The
+	// channel is closed after the stop channel is.
+	Changes(q QueryParams, since string, stop <-chan struct{}) (<-chan *ChangeEvent, error)
+}
+
+// publisher sends the changes made through the frontend to subscribers.
+// Subscribers which fall behind miss events rather than blocking writes.
+type publisher struct {
+	sync.Mutex
+	seq         int64
+	subscribers map[chan *ChangeEvent]string
+}
+
+// changePublisher publishes changes for backends which don't implement
+// ChangeFeed.
+var changePublisher = &publisher{
+	subscribers: make(map[chan *ChangeEvent]string),
+}
+
+// subscribe returns a channel receiving the events for paths starting with
+// a prefix.
+func (p *publisher) subscribe(prefix string) chan *ChangeEvent {
+	p.Lock()
+	defer p.Unlock()
+	ch := make(chan *ChangeEvent, changeBufferSize)
+	p.subscribers[ch] = prefix
+	return ch
+}
+
+// unsubscribe stops sending events to a channel.
+func (p *publisher) unsubscribe(ch chan *ChangeEvent) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.subscribers, ch)
+}
+
+// publish numbers an event and sends it to its subscribers.
+func (p *publisher) publish(ev *ChangeEvent) {
+	p.Lock()
+	defer p.Unlock()
+	p.seq++
+	ev.Seq = strconv.FormatInt(p.seq, 10)
+	for ch, prefix := range p.subscribers {
+		if !strings.HasPrefix(ev.Path, prefix) {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publishChange sends a change made through the frontend to its webhooks,
+// and publishes it unless the backend has its own change feed.  The owner
+// defaults to the one in the document.
+func publishChange(db DbBackend, eventType string, path string, doc interface{},
+	owner string) {
+
+	if d, ok := doc.(map[string]interface{}); ok && owner == "" {
+		owner, _ = d[OWNER].(string)
+	}
+	ev := &ChangeEvent{
+		Type:  eventType,
+		Path:  path,
+		Doc:   doc,
+		Owner: owner,
+	}
+	webhooks.dispatch(ev)
+	if _, ok := db.(ChangeFeed); ok {
+		return
+	}
+	changePublisher.publish(ev)
+}
+
+// publishInsert publishes a new item added to a (Martini formatted)
+// collection path.  The event's path uses the item's ID when the collection
+// has a single item path.
+func publishInsert(db DbBackend, rd *Swagger, path string,
+	pathParams map[string]interface{}, doc interface{}, owner string) {
+
+	out := FillPath(path, pathParams)
+	if itemPath, _ := findItemPath(rd, path); itemPath != "" {
+		idName := EndOfPathRe.FindString(itemPath)[1:]
+		if d, ok := doc.(map[string]interface{}); ok && d[idName] != nil {
+			out = out + "/" + fmt.Sprint(d[idName])
+		}
+	}
+	publishChange(db, CHANGEINSERT, out, doc, owner)
+}
+
+// filterEvents passes events through a function, which returns the event to
+// send or nil to drop it.
+func filterEvents(events <-chan *ChangeEvent, stop <-chan struct{},
+	fn func(*ChangeEvent) *ChangeEvent) <-chan *ChangeEvent {
+
+	out := make(chan *ChangeEvent)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				ev = fn(ev)
+				if ev == nil {
+					continue
+				}
+				select {
+				case out <- ev:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// FillPath replaces the params of a (Martini formatted) path with their
+// values (e.g. /people/:id becomes /people/4).
+func FillPath(path string, pathParams map[string]interface{}) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") {
+			continue
+		}
+		if val, ok := pathParams[segment[1:]]; ok {
+			segments[i] = fmt.Sprint(val)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// makeChangesAPI creates the change feed of a collection
+// (e.g. /people/_changes).
+func makeChangesAPI(schemaName string, upstreamParams []*Parameter,
+	cnf Conf) *PathItem {
+
+	pluralName := inflector.Pluralize(inflector.Singularize(schemaName))
+	getOp := &Operation{
+		OperationID: "get" + schemaName + "Changes",
+		Summary:     "Stream changes to " + pluralName + ".",
+		Description: "Sends a server-sent event for every " + schemaName + " inserted, updated or deleted " +
+			"(including changes to their sub-resources).  WebSocket upgrades receive the same events as " +
+			"JSON messages.  Reconnecting clients can resume with the Last-Event-ID header or the since parameter.",
+		Produces:  []string{"text/event-stream"},
+		Responses: make(map[string]*Response),
+		Changes:   schemaName,
+	}
+
+	getOp.Responses["200"] = &Response{
+		Description: "A stream of changes",
+		Schema: &Schema{
+			Properties: map[string]*Schema{
+				"seq":  &Schema{Type: "string"},
+				"type": &Schema{Type: "string", Enum: []interface{}{CHANGEINSERT, CHANGEUPDATE, CHANGEDELETE}},
+				"path": &Schema{Type: "string"},
+				"doc":  &Schema{Ref: MakeRef(schemaName)},
+			},
+		},
+	}
+
+	getOp.Parameters = append(getOp.Parameters, &Parameter{
+		Name:        SINCE,
+		In:          "query",
+		Description: "The seq of the last event received.  Only changes after it are sent.",
+		Type:        "string",
+	})
+	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
+
+	return &PathItem{
+		Get:     getOp,
+		Options: makeOptionsOperation("GET", upstreamParams),
+	}
+}
+
+// serveChanges streams the change feed of a collection for the frontend.
+// path is the (Martini formatted) path of the change feed.
+func serveChanges(db DbBackend, rd *Swagger, path string,
+	pathParams map[string]interface{}, res http.ResponseWriter, req *http.Request,
+	guard *fieldGuard, owner string) {
+
+	collectionPath := strings.TrimSuffix(path, "/"+CHANGES)
+	since := req.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = req.URL.Query().Get(SINCE)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var events <-chan *ChangeEvent
+	if feed, ok := db.(ChangeFeed); ok {
+		itemPath, _ := findItemPath(rd, collectionPath)
+		if itemPath == "" {
+			writeError(res, 500, "The collection has no single item path.")
+			return
+		}
+
+		var err error
+		events, err = feed.Changes(QueryParams{
+			Path:       itemPath,
+			PathParams: pathParams,
+			Owner:      owner,
+			Context:    req.Context(),
+		}, since, stop)
+		if err != nil && err.Error() == NOTFOUNDERROR {
+			writeError(res, 404, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(res, 500, err.Error())
+			return
+		}
+	} else {
+		// the in-process publisher has no history, so since is ignored
+		ch := changePublisher.subscribe(FillPath(collectionPath, pathParams) + "/")
+		defer changePublisher.unsubscribe(ch)
+		events = ch
+	}
+	events = filterOwner(events, owner, stop)
+	events = guard.hideEvents(events, stop)
+
+	if isWebSocket(req) {
+		serveWebSocket(res, req, events)
+		return
+	}
+	serveEventStream(res, req, events)
+}
+
+// serveEventStream sends events as server-sent events until the client
+// disconnects.
+func serveEventStream(res http.ResponseWriter, req *http.Request,
+	events <-chan *ChangeEvent) {
+
+	h := res.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	res.WriteHeader(200)
+
+	flusher, _ := res.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	ticker := time.NewTicker(changeKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if ev.Seq != "" {
+				fmt.Fprintf(res, "id: %s\n", ev.Seq)
+			}
+			fmt.Fprintf(res, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flush()
+		case <-ticker.C:
+			fmt.Fprint(res, ": keep-alive\n\n")
+			flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// writeError writes a JSON error for handlers which write their own
+// responses.
+func writeError(res http.ResponseWriter, code int, message string) {
+	outerr, _ := json.Marshal(message)
+	res.Header().Set("Content-Type", "application/json;charset=utf-8")
+	res.WriteHeader(code)
+	res.Write(outerr)
+}
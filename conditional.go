@@ -0,0 +1,180 @@
+package dragonfruit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Conditional request headers
+const (
+	IFMATCH     = "If-Match"
+	IFNONEMATCH = "If-None-Match"
+)
+
+// makeETag returns the ETag of a response.  Responses from a single document
+// use the document's version, others use a weak tag made from the body.
+func makeETag(version string, body []byte) string {
+	if version != "" {
+		return "\"" + version + "\""
+	}
+	sum := sha1.Sum(body)
+	return "W/\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+// matchETag reports whether an If-None-Match header matches an ETag, using
+// weak comparison.
+func matchETag(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// An ifMatch is the precondition of an If-Match header.
+type ifMatch struct {
+	// any version of an existing resource matches (*)
+	any bool
+	// the versions which match
+	versions []string
+}
+
+// parseIfMatch parses an If-Match header.  It returns nil for an empty
+// header.  Weak tags never match, since they don't identify a version, and
+// malformed tags return PRECONDITIONFAILED.
+func parseIfMatch(header string) (*ifMatch, error) {
+	if strings.TrimSpace(header) == "" {
+		return nil, nil
+	}
+
+	m := &ifMatch{versions: make([]string, 0)}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			m.any = true
+			continue
+		}
+		weak := strings.HasPrefix(tag, "W/")
+		tag = strings.TrimPrefix(tag, "W/")
+		if len(tag) < 2 || !strings.HasPrefix(tag, "\"") || !strings.HasSuffix(tag, "\"") {
+			return nil, errors.New(PRECONDITIONFAILED)
+		}
+		if !weak {
+			m.versions = append(m.versions, strings.Trim(tag, "\""))
+		}
+	}
+	return m, nil
+}
+
+// matches reports whether the version of an existing resource meets the
+// precondition.
+func (m *ifMatch) matches(version string) bool {
+	return m.any || containsString(m.versions, version)
+}
+
+// checkIfMatch checks an If-Match header against the current version of a
+// resource, and returns the version writes must expect, so the backend
+// fails them if the resource changes in the meantime.  Without a header any
+// version will do and an empty version is returned.  A resource which
+// doesn't exist (or isn't the owner's) never matches.
+func checkIfMatch(ctx context.Context, db DbBackend, path string,
+	pathParams map[string]interface{}, owner string, header string) (string, error) {
+
+	m, err := parseIfMatch(header)
+	if err != nil || m == nil {
+		return "", err
+	}
+
+	c, err := db.Query(QueryParams{
+		Path:        path,
+		PathParams:  pathParams,
+		QueryParams: make(qparam),
+		Owner:       owner,
+		Context:     ctx,
+	})
+	if err != nil {
+		return "", err
+	}
+	if c.Meta.Count == 0 || !m.matches(c.Meta.Version) {
+		return "", errors.New(PRECONDITIONFAILED)
+	}
+	return c.Meta.Version, nil
+}
+
+// makeIfMatchParam makes the If-Match header used by write operations.
+func makeIfMatchParam() *Parameter {
+	return &Parameter{
+		Name:        IFMATCH,
+		In:          "header",
+		Description: "The ETags of the versions which may be changed, or * for any version.  If the resource has changed since (or doesn't exist), a 412 is returned.",
+		Type:        "string",
+	}
+}
+
+// makeIfNoneMatchParam makes the If-None-Match header used by GET operations.
+func makeIfNoneMatchParam() *Parameter {
+	return &Parameter{
+		Name:        IFNONEMATCH,
+		In:          "header",
+		Description: "The ETag of a cached response.  If the response hasn't changed, a 304 is returned.",
+		Type:        "string",
+	}
+}
+
+// addETagResponses documents the ETag header and the 304 response of GET
+// operations.
+func addETagResponses(op *Operation) {
+	op.Parameters = append(op.Parameters, makeIfNoneMatchParam())
+	if resp, ok := op.Responses["200"]; ok {
+		if resp.Headers == nil {
+			resp.Headers = make(map[string]*Items)
+		}
+		resp.Headers["ETag"] = &Items{Type: "string"}
+	}
+	op.Responses["304"] = &Response{
+		Description: "Not modified",
+	}
+}
+
+// addPreconditionResponses documents the If-Match header and the 412
+// response of write operations.
+func addPreconditionResponses(op *Operation) {
+	op.Parameters = append(op.Parameters, makeIfMatchParam())
+	op.Responses["412"] = &Response{
+		Description: "The resource has changed since the If-Match version",
+	}
+}
+
+// checkVersion compares the version of a resource with the version a client
+// expects, before changes are made which the backend can't roll back.
+func checkVersion(db DbBackend, path string, pathParams map[string]interface{},
+	version string) error {
+
+	if version == "" {
+		return nil
+	}
+
+	c, err := db.Query(QueryParams{
+		Path:        path,
+		PathParams:  pathParams,
+		QueryParams: make(qparam),
+	})
+	if err != nil {
+		return err
+	}
+	if c.Meta.Count == 0 {
+		return errors.New(NOTFOUNDERROR)
+	}
+	if c.Meta.Version != version {
+		return errors.New(PRECONDITIONFAILED)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package dragonfruit
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMakeETag(t *testing.T) {
+	if got := makeETag("3-abc", []byte("{}")); got != `"3-abc"` {
+		t.Errorf("got %s, want a strong tag of the version", got)
+	}
+
+	weak := makeETag("", []byte(`{"a":1}`))
+	if !strings.HasPrefix(weak, `W/"`) || !strings.HasSuffix(weak, `"`) {
+		t.Errorf("got %s, want a weak tag", weak)
+	}
+	if makeETag("", []byte(`{"a":1}`)) != weak {
+		t.Error("the same body made different tags")
+	}
+	if makeETag("", []byte(`{"a":2}`)) == weak {
+		t.Error("different bodies made the same tag")
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		want   bool
+	}{
+		{"no header", "", `"1-a"`, false},
+		{"same tag", `"1-a"`, `"1-a"`, true},
+		{"different tag", `"1-a"`, `"2-b"`, false},
+		{"any tag", `*`, `"1-a"`, true},
+		{"lists", `"0-z", "1-a"`, `"1-a"`, true},
+		{"lists without a match", `"0-z","2-b"`, `"1-a"`, false},
+		{"weak headers match strong tags", `W/"1-a"`, `"1-a"`, true},
+		{"strong headers match weak tags", `"abc"`, `W/"abc"`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchETag(tt.header, tt.etag); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   *ifMatch
+		fails  bool
+	}{
+		{"no header", "", nil, false},
+		{"blank headers", "  ", nil, false},
+		{"one tag", `"1-a"`, &ifMatch{versions: []string{"1-a"}}, false},
+		{"lists", `"1-a", "2-b" ,"3-c"`, &ifMatch{versions: []string{"1-a", "2-b", "3-c"}}, false},
+		{"any version", `*`, &ifMatch{any: true, versions: []string{}}, false},
+		{"weak tags are ignored", `W/"1-a", "2-b"`, &ifMatch{versions: []string{"2-b"}}, false},
+		{"only weak tags", `W/"1-a"`, &ifMatch{versions: []string{}}, false},
+		{"unquoted tags", `1-a`, nil, true},
+		{"half quoted tags", `"1-a`, nil, true},
+		{"bare quotes", `"`, nil, true},
+		{"malformed tags in lists", `"1-a", 2-b`, nil, true},
+		{"empty list entries", `"1-a",`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIfMatch(tt.header)
+			if tt.fails {
+				if err == nil || err.Error() != PRECONDITIONFAILED {
+					t.Fatalf("got error %v, want %s", err, PRECONDITIONFAILED)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIfMatchMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		version string
+		want    bool
+	}{
+		{"same version", `"1-a"`, "1-a", true},
+		{"other version", `"1-a"`, "2-b", false},
+		{"any tag in a list", `"1-a", "2-b"`, "2-b", true},
+		{"any version", `*`, "7-x", true},
+		{"weak tags never match", `W/"1-a"`, "1-a", false},
+		{"versions are case-sensitive", `"1-A"`, "1-a", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseIfMatch(tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.matches(tt.version); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package dragonfruit
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/cors"
+)
+
+// CORSConf is the cross-origin resource sharing policy of an API.  Empty
+// lists use the ones of defaultCORS.
+type CORSConf struct {
+	// the origins which may call the API, where * matches any part of an
+	// origin (e.g. https://*.example.com)
+	AllowOrigins []string `json:"allowOrigins"`
+	// the methods which may be called cross-origin.  Each path only allows
+	// the ones it has operations for.
+	AllowMethods []string `json:"allowMethods"`
+	// the request headers which may be sent
+	AllowHeaders []string `json:"allowHeaders"`
+	// the response headers scripts may read
+	ExposeHeaders []string `json:"exposeHeaders"`
+	// allow cookies and HTTP authentication
+	AllowCredentials bool `json:"allowCredentials"`
+	// how long browsers may cache preflight responses, in seconds
+	MaxAge int `json:"maxAge"`
+}
+
+// defaultCORS is the policy of APIs which don't configure one: any origin
+// may call any operation.
+var defaultCORS = CORSConf{
+	AllowOrigins: []string{"*"},
+	AllowMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+	AllowHeaders: []string{"Origin", "Expires", "Cache-Control", "X-Requested-With",
+		"Content-Type", "Authorization", IFMATCH, IFNONEMATCH, REQUESTIDHEADER},
+	ExposeHeaders: []string{"ETag", "Link", "Accept-Patch", "WWW-Authenticate", "Retry-After",
+		RATELIMITLIMIT, RATELIMITREMAINING, RATELIMITRESET, REQUESTIDHEADER},
+}
+
+// corsPolicy returns the CORS policy of a configuration.
+func corsPolicy(cnf Conf) CORSConf {
+	if cnf.CORS == nil {
+		return defaultCORS
+	}
+	out := *cnf.CORS
+	if len(out.AllowOrigins) == 0 {
+		out.AllowOrigins = defaultCORS.AllowOrigins
+	}
+	if len(out.AllowMethods) == 0 {
+		out.AllowMethods = defaultCORS.AllowMethods
+	}
+	if len(out.AllowHeaders) == 0 {
+		out.AllowHeaders = defaultCORS.AllowHeaders
+	}
+	if len(out.ExposeHeaders) == 0 {
+		out.ExposeHeaders = defaultCORS.ExposeHeaders
+	}
+	return out
+}
+
+// options returns the cors options of a policy for a set of methods.
+func (c CORSConf) options(methods []string) *cors.Options {
+	out := &cors.Options{
+		AllowCredentials: c.AllowCredentials,
+		AllowMethods:     methods,
+		AllowHeaders:     c.AllowHeaders,
+		ExposeHeaders:    c.ExposeHeaders,
+		MaxAge:           time.Duration(c.MaxAge) * time.Second,
+	}
+	// credentialed requests need the origin echoed back rather than *
+	if len(c.AllowOrigins) == 1 && c.AllowOrigins[0] == "*" && !c.AllowCredentials {
+		out.AllowAllOrigins = true
+	} else {
+		out.AllowOrigins = c.AllowOrigins
+	}
+	return out
+}
+
+// pathMethods returns the methods of a policy which a path has operations
+// for.
+func (c CORSConf) pathMethods(pathitem *PathItem) []string {
+	ops := map[string]*Operation{
+		"GET":     pathitem.Get,
+		"HEAD":    pathitem.Head,
+		"POST":    pathitem.Post,
+		"PUT":     pathitem.Put,
+		"PATCH":   pathitem.Patch,
+		"DELETE":  pathitem.Delete,
+		"OPTIONS": pathitem.Options,
+	}
+	out := make([]string, 0)
+	for _, method := range c.AllowMethods {
+		method = strings.ToUpper(method)
+		if ops[method] != nil {
+			out = append(out, method)
+		}
+	}
+	return out
+}
+
+// corsRoute is the CORS handler of a single path.
+type corsRoute struct {
+	pattern *regexp.Regexp
+	handler http.HandlerFunc
+}
+
+// corsHandler returns a handler which applies the CORS policy of a
+// configuration, allowing the methods each path of a definition has
+// operations for.  Other paths (e.g. /api-docs) allow every method of the
+// policy.
+func corsHandler(rd *Swagger, cnf Conf) martini.Handler {
+	policy := corsPolicy(cnf)
+	fallback := cors.Allow(policy.options(policy.AllowMethods))
+
+	// reserved paths are matched before the path params they look like
+	routes := make([]corsRoute, 0)
+	for _, path := range routeOrder(rd.Paths) {
+		routes = append(routes, corsRoute{
+			pattern: pathPattern(TranslatePath(rd.BasePath + path)),
+			handler: cors.Allow(policy.options(policy.pathMethods(rd.Paths[path]))),
+		})
+	}
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		for _, route := range routes {
+			if route.pattern.MatchString(req.URL.Path) {
+				route.handler(res, req)
+				return
+			}
+		}
+		fallback(res, req)
+	}
+}
+
+// pathPattern returns a regular expression matching the URL paths of a
+// (Martini formatted) path.
+func pathPattern(path string) *regexp.Regexp {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "[^/]+"
+		} else {
+			segments[i] = regexp.QuoteMeta(segment)
+		}
+	}
+	return regexp.MustCompile("^" + strings.Join(segments, "/") + "/?$")
+}
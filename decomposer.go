@@ -131,6 +131,9 @@ func buildProperty(propName string,
 			Ref: MakeRef(strings.Title(propName)),
 		}
 		err = buildSchema(propName, models, sanitized)
+		// embedded models are served as sub-resources, so they need
+		// a container too
+		appendSubtype(propName, models)
 		models[modelName].Properties[propName] = prop
 
 	case "array":
@@ -262,7 +265,7 @@ func processNumber(v reflect.Value) *Schema {
 // buildSliceProperty parses array values passed through sample data.
 // The function ranges over the values in the array, introspects the first
 // element, determines its type, and traverses deeper into the model tree if
-// the first element is a model type.
+// the first element is a model type.  Nested arrays are handled recursively.
 // It returns an error if something blows up.
 func (prop *Schema) buildSliceProperty(name string, i *Schema,
 	v reflect.Value,
@@ -290,6 +293,12 @@ func (prop *Schema) buildSliceProperty(name string, i *Schema,
 			i.Type = datatype
 			prop.Type = "array"
 			prop.Items = i
+		case "array":
+			// nested arrays recurse with a fresh item schema so that
+			// [[1,2],[3,4]] becomes an array of arrays of numbers
+			nested := &Schema{}
+			err = nested.buildSliceProperty(name, &Schema{}, sanitized, m)
+			prop.Items = nested
 		default:
 			prop.Type = "array"
 			prop.Items = i
@@ -0,0 +1,119 @@
+package dragonfruit
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	FIELDS = "fields"
+)
+
+// fieldTree is a parsed set of (possibly dotted) field names.  For example
+// name,address.city becomes {name: {}, address: {city: {}}}.
+type fieldTree map[string]fieldTree
+
+// ProjectFields returns a copy of a document containing only the passed
+// fields.  Fields may be dotted paths into embedded models or arrays of
+// models (e.g. address.city).  Values which aren't maps are returned as is.
+func ProjectFields(doc interface{}, fields []string) interface{} {
+	if len(fields) == 0 {
+		return doc
+	}
+	return makeFieldTree(fields).project(doc)
+}
+
+// makeFieldTree parses a list of dotted field names into a tree.
+func makeFieldTree(fields []string) fieldTree {
+	tree := make(fieldTree)
+	for _, field := range fields {
+		curr := tree
+		for _, segment := range strings.Split(strings.TrimSpace(field), ".") {
+			if segment == "" {
+				break
+			}
+			next, ok := curr[segment]
+			if !ok {
+				next = make(fieldTree)
+				curr[segment] = next
+			}
+			curr = next
+		}
+	}
+	return tree
+}
+
+// project applies a field tree to a document.
+func (tree fieldTree) project(doc interface{}) interface{} {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for key, subtree := range tree {
+			val, ok := d[key]
+			if !ok {
+				continue
+			}
+			if len(subtree) > 0 {
+				val = subtree.project(val)
+			}
+			out[key] = val
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(d))
+		for i, val := range d {
+			out[i] = tree.project(val)
+		}
+		return out
+	}
+	return doc
+}
+
+// fieldsForBackend returns the fields a backend should return, adding the
+// properties needed to expand relations.
+func fieldsForBackend(fields []string, relations []*Relation, expand []string) []string {
+	if len(fields) == 0 {
+		return fields
+	}
+	out := append([]string{}, fields...)
+	for _, name := range expand {
+		rel := findRelation(relations, strings.TrimSpace(name))
+		if rel != nil {
+			out = append(out, rel.Property)
+		}
+	}
+	return out
+}
+
+// validateFields checks that every field refers to a property of the model
+// returned by an operation.  The names of expandable relations are valid
+// too, and are checked against the related model.
+func validateFields(rd *Swagger, op *Operation, fields []string) error {
+	for _, field := range fields {
+		notFound := errors.New("The field " + field + " does not exist.")
+		model := rd.Definitions[modelFromResponse(op)]
+
+		for _, segment := range strings.Split(field, ".") {
+			if model == nil {
+				return notFound
+			}
+
+			if prop, exists := model.Properties[segment]; exists {
+				// descend into embedded models and arrays of models
+				ref := prop.Ref
+				if prop.Items != nil {
+					ref = prop.Items.Ref
+				}
+				model = nil
+				if ref != "" {
+					model = rd.Definitions[DeRef(ref)]
+				}
+			} else if rel := findRelation(model.Relations, segment); rel != nil {
+				model = rd.Definitions[rel.Model]
+			} else {
+				return notFound
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package dragonfruit
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Filter operators.  Operators are sent in brackets after the property
+// name (e.g. name[startsWith]=Jo).  Range operators are sent with the
+// RangeStart and RangeEnd suffixes.
+const (
+	EQ         = "eq"
+	NE         = "ne"
+	IN         = "in"
+	CONTAINS   = "contains"
+	STARTSWITH = "startsWith"
+	GTE        = "gte"
+	LTE        = "lte"
+)
+
+// OrGroupRe matches the prefix of filters which belong to an OR group
+// (e.g. or1.color=red&or1.size=large).
+var OrGroupRe = regexp.MustCompile(`^(or[0-9]+)\.`)
+
+// filterOpRe matches the operator suffix of a filter (e.g. name[ne]).
+var filterOpRe = regexp.MustCompile(`^(.+)\[([[:alpha:]]+)\]$`)
+
+// A Filter is a single condition parsed from a query parameter.
+//
+// Filters without a group are combined with AND.  Filters in the same group
+// are combined with OR, and the group as a whole is combined with the rest
+// of the filters using AND.
+type Filter struct {
+	Group    string
+	Property string
+	Operator string
+	Value    interface{}
+}
+
+// ParseFilters turns a set of query parameters into filters.  Properties
+// can be dotted paths into embedded models and arrays (e.g. address.city).
+func ParseFilters(params map[string]interface{}) []Filter {
+	out := make([]Filter, 0)
+	for key, val := range params {
+		group, property, operator := parseFilterKey(key)
+		out = append(out, Filter{
+			Group:    group,
+			Property: property,
+			Operator: operator,
+			Value:    val,
+		})
+	}
+	return out
+}
+
+// parseFilterKey splits a query parameter name into its OR group, property
+// and operator.
+func parseFilterKey(key string) (group string, property string, operator string) {
+	property = key
+	if match := OrGroupRe.FindStringSubmatch(property); match != nil {
+		group = match[1]
+		property = strings.TrimPrefix(property, match[0])
+	}
+
+	if match := filterOpRe.FindStringSubmatch(property); match != nil {
+		return group, match[1], match[2]
+	}
+
+	if strings.HasSuffix(property, RANGESTART) {
+		return group, strings.TrimSuffix(property, RANGESTART), GTE
+	}
+	if strings.HasSuffix(property, RANGEEND) {
+		return group, strings.TrimSuffix(property, RANGEEND), LTE
+	}
+	return group, property, EQ
+}
+
+// stripFilterGroup removes the OR group prefix from a query parameter name,
+// returning the name of the parameter as it's defined in the API.
+func stripFilterGroup(key string) string {
+	return OrGroupRe.ReplaceAllString(key, "")
+}
+
+// MatchFilters reports whether a document matches a set of filters.
+func MatchFilters(doc interface{}, filters []Filter) bool {
+	groups := make(map[string]bool)
+
+	for _, filter := range filters {
+		matched := filter.Match(doc)
+		if filter.Group == "" {
+			if !matched {
+				return false
+			}
+			continue
+		}
+		groups[filter.Group] = groups[filter.Group] || matched
+	}
+
+	for _, matched := range groups {
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether a document matches a single filter.  If the property
+// holds an array (or sits inside an array of models), the filter matches if
+// any of the values match, except for ne which requires all of them not to
+// match.
+func (f Filter) Match(doc interface{}) bool {
+	values := lookupPath(doc, strings.Split(f.Property, "."))
+
+	if f.Operator == NE {
+		for _, val := range values {
+			if CompareValues(val, f.Value) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, val := range values {
+		if matchValue(f.Operator, val, f.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupPath returns every value found at a dotted path in a document.
+// Arrays are flattened along the way.
+func lookupPath(doc interface{}, segments []string) []interface{} {
+	switch d := doc.(type) {
+	case []interface{}:
+		out := make([]interface{}, 0)
+		for _, item := range d {
+			out = append(out, lookupPath(item, segments)...)
+		}
+		return out
+	case map[string]interface{}:
+		if len(segments) == 0 {
+			return []interface{}{doc}
+		}
+		val, ok := d[segments[0]]
+		if !ok {
+			return nil
+		}
+		return lookupPath(val, segments[1:])
+	}
+
+	if len(segments) == 0 {
+		return []interface{}{doc}
+	}
+	return nil
+}
+
+// matchValue compares a value from a document with a value from a filter.
+// String matching with contains and startsWith is case-insensitive.
+func matchValue(operator string, val interface{}, expected interface{}) bool {
+	switch operator {
+	case IN:
+		list, ok := expected.([]interface{})
+		if !ok {
+			return CompareValues(val, expected) == 0
+		}
+		for _, item := range list {
+			if CompareValues(val, item) == 0 {
+				return true
+			}
+		}
+		return false
+	case CONTAINS, STARTSWITH:
+		str, ok := val.(string)
+		sub, subOk := expected.(string)
+		if !ok || !subOk {
+			return false
+		}
+		if operator == CONTAINS {
+			return strings.Contains(strings.ToLower(str), strings.ToLower(sub))
+		}
+		return strings.HasPrefix(strings.ToLower(str), strings.ToLower(sub))
+	case GTE:
+		return collationRank(val) == collationRank(expected) &&
+			CompareValues(val, expected) >= 0
+	case LTE:
+		return collationRank(val) == collationRank(expected) &&
+			CompareValues(val, expected) <= 0
+	}
+	return CompareValues(val, expected) == 0
+}
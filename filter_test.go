@@ -0,0 +1,111 @@
+package dragonfruit
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		want   []Filter
+	}{
+		{"equality", map[string]interface{}{"color": "red"},
+			[]Filter{{"", "color", EQ, "red"}}},
+		{"operators", map[string]interface{}{"name[startsWith]": "Jo", "size[ne]": "large"},
+			[]Filter{{"", "name", STARTSWITH, "Jo"}, {"", "size", NE, "large"}}},
+		{"ranges", map[string]interface{}{"priceRangeStart": 1.0, "priceRangeEnd": 9.0},
+			[]Filter{{"", "price", GTE, 1.0}, {"", "price", LTE, 9.0}}},
+		{"dotted paths", map[string]interface{}{"address.city[in]": []interface{}{"Oslo"}},
+			[]Filter{{"", "address.city", IN, []interface{}{"Oslo"}}}},
+		{"OR groups", map[string]interface{}{"or1.color": "red", "or1.size[ne]": "large", "or2.priceRangeEnd": 5.0},
+			[]Filter{{"or1", "color", EQ, "red"}, {"or1", "size", NE, "large"}, {"or2", "price", LTE, 5.0}}},
+		{"no filters", map[string]interface{}{}, []Filter{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseFilters(tt.params)
+			// parameters come from a map, so the order is random
+			sort.Slice(got, func(i, j int) bool {
+				if got[i].Group != got[j].Group {
+					return got[i].Group < got[j].Group
+				}
+				if got[i].Property != got[j].Property {
+					return got[i].Property < got[j].Property
+				}
+				return got[i].Operator < got[j].Operator
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripFilterGroup(t *testing.T) {
+	tests := map[string]string{
+		"or1.color":      "color",
+		"or12.size[ne]":  "size[ne]",
+		"color":          "color",
+		"order.total":    "order.total",
+		"address.or1.id": "address.or1.id",
+	}
+	for key, want := range tests {
+		if got := stripFilterGroup(key); got != want {
+			t.Errorf("stripFilterGroup(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMatchFilters(t *testing.T) {
+	doc := unmarshalTest(t, `{
+		"color": "red",
+		"size": "large",
+		"price": 5,
+		"name": "Jonas",
+		"tags": ["sale", "new"],
+		"address": {"city": "Oslo"},
+		"variants": [{"sku": "a1", "stock": 0}, {"sku": "b2", "stock": 3}]
+	}`)
+
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		want   bool
+	}{
+		{"no filters", map[string]interface{}{}, true},
+		{"equality", map[string]interface{}{"color": "red"}, true},
+		{"inequality", map[string]interface{}{"color[ne]": "red"}, false},
+		{"AND of ungrouped filters", map[string]interface{}{"color": "red", "size": "small"}, false},
+		{"contains ignores case", map[string]interface{}{"name[contains]": "ONA"}, true},
+		{"startsWith", map[string]interface{}{"name[startsWith]": "jo"}, true},
+		{"startsWith misses", map[string]interface{}{"name[startsWith]": "na"}, false},
+		{"in lists", map[string]interface{}{"color[in]": []interface{}{"blue", "red"}}, true},
+		{"in misses", map[string]interface{}{"color[in]": []interface{}{"blue"}}, false},
+		{"ranges", map[string]interface{}{"priceRangeStart": 1.0, "priceRangeEnd": 5.0}, true},
+		{"ranges miss", map[string]interface{}{"priceRangeStart": 6.0}, false},
+		{"ranges don't match other types", map[string]interface{}{"priceRangeStart": "1"}, false},
+		{"dotted paths", map[string]interface{}{"address.city": "Oslo"}, true},
+		{"missing properties", map[string]interface{}{"weight": 1.0}, false},
+		{"missing properties aren't equal", map[string]interface{}{"weight[ne]": 1.0}, true},
+		{"any array value matches", map[string]interface{}{"tags": "new"}, true},
+		{"ne requires every array value to differ", map[string]interface{}{"tags[ne]": "new"}, false},
+		{"paths into arrays of models", map[string]interface{}{"variants.sku": "b2"}, true},
+		{"OR groups match any filter", map[string]interface{}{"or1.color": "blue", "or1.size": "large"}, true},
+		{"OR groups match no filter", map[string]interface{}{"or1.color": "blue", "or1.size": "small"}, false},
+		{"OR groups are ANDed with the rest", map[string]interface{}{"or1.color": "blue", "or1.size": "large", "price": 6.0}, false},
+		{"every OR group must match", map[string]interface{}{"or1.color": "red", "or2.size": "small", "or2.name": "Bob"}, false},
+		{"several OR groups", map[string]interface{}{"or1.color": "red", "or2.size": "small", "or2.name": "Jonas"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchFilters(doc, ParseFilters(tt.params)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
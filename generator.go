@@ -1,6 +1,7 @@
 package dragonfruit
 
 import (
+	"sort"
 	"strings"
 
 	"github.com/gedex/inflector"
@@ -32,6 +33,11 @@ func RegisterType(d DbBackend, byt []byte, cnf Conf, resourceType string, path s
 	}
 
 	for k, v := range modelMap {
+		applyFieldAccess(k, v, cnf)
+		// keep any relations from a previous registration
+		if existing, ok := sw.Definitions[k]; ok {
+			v.Relations = existing.Relations
+		}
 		sw.Definitions[k] = v
 	}
 
@@ -47,6 +53,15 @@ func RegisterType(d DbBackend, byt []byte, cnf Conf, resourceType string, path s
 		sw.Paths[k] = v
 	}
 
+	linkResources(sw, cnf)
+	err = secureOperations(sw, cnf)
+	if err != nil {
+		return err
+	}
+	applyRoles(sw, cnf)
+	applyOwnership(sw, cnf)
+	applyRateLimits(sw, cnf)
+
 	err = d.SaveDefinition(sw)
 	preperror := d.Prep(path, sw)
 	if preperror != nil {
@@ -76,30 +91,48 @@ func MakeCommonAPIs(
 ) map[string]*PathItem {
 
 	schema := schemaMap[schemaName]
+	schema.SearchFields = makeSearchFields(schemaName, schema, cnf)
+	if cnf.Audit {
+		addAuditFields(schema)
+	}
 	out := make(map[string]*PathItem)
 	//modelDescription := inflector.Pluralize(inflector.Singularize(schemaName))
 
 	// make the collection api - get lists of models and create new models
 	collectionPath := prefix + "/" + pathRoot
 	collectionAPI := &PathItem{}
-	collectionAPI.Get = makeCollectionOperation(schemaName, schema, upstreamParams, cnf)
+	collectionAPI.Get = makeCollectionOperation(schemaName, schema, schemaMap, upstreamParams, cnf)
 	collectionAPI.Post = makePostOperation(schemaName, schema, upstreamParams, cnf)
+	collectionAPI.Post.Audit = cnf.Audit
 	collectionAPI.Options = makeCollectionOptionsOperation()
 
 	out[collectionPath] = collectionAPI
+	out[collectionPath+"/"+AGGREGATE] = makeAggregateAPI(schemaName, schema, upstreamParams, cnf)
+	out[collectionPath+"/"+BULK] = makeBulkAPI(schemaName, upstreamParams, cnf)
+	out[collectionPath+"/"+CHANGES] = makeChangesAPI(schemaName, upstreamParams, cnf)
 
 	// make a single API - use this for sub collections too
 	idName, idparam := makePathID(schema)
+	if cnf.SoftDelete {
+		trashApis := makeTrashAPIs(collectionPath, schemaName, idName, idparam,
+			upstreamParams, cnf)
+		for k, v := range trashApis {
+			out[k] = v
+		}
+	}
 	upstreamParams = append(upstreamParams, idparam)
 
 	// TODO - parallelize this...
 	individualPath := prefix + "/" + pathRoot + "/{" + idName + "}"
 	individualAPI := &PathItem{}
 	individualAPI.Delete = makeDeleteOperation(schemaName, upstreamParams, cnf)
+	individualAPI.Delete.SoftDelete = cnf.SoftDelete
 
 	individualAPI.Get = makeSingleGetOperation(schemaName, upstreamParams, cnf)
 	individualAPI.Put = makePutOperation(schemaName, schema, upstreamParams, cnf)
+	individualAPI.Put.Audit = cnf.Audit
 	individualAPI.Patch = makePatchOperation(schemaName, upstreamParams, cnf)
+	individualAPI.Patch.Audit = cnf.Audit
 	individualAPI.Options = makeSingleOptionsOperation(upstreamParams)
 
 	out[individualPath] = individualAPI
@@ -112,7 +145,9 @@ func MakeCommonAPIs(
 	return out
 }
 
-// makeSubApis creates APIs for arrays of models which appear in models.
+// makeSubApis creates APIs for arrays of models and single embedded models
+// which appear in models.  If the PrimitiveSubResources option is set, arrays
+// of primitive values get sub-resources as well.
 func makeSubApis(
 	prefix string,
 	schema *Schema,
@@ -124,20 +159,121 @@ func makeSubApis(
 	out := make(map[string]*PathItem)
 
 	for propertyName, propSchema := range schema.Properties {
-		if (propSchema.Type == "array") && (propSchema.Items.Ref != "") {
+		if propSchema.Ref != "" {
+			subModelName := DeRef(propSchema.Ref)
+			embeddedApis := makeEmbeddedAPI(prefix, propertyName, subModelName,
+				schemaMap, upstreamParams, cnf)
+
+			for k, v := range embeddedApis {
+				out[k] = v
+			}
+			continue
+		}
+
+		if propSchema.Type != "array" || propSchema.Items == nil {
+			continue
+		}
+		resourceroot := inflector.Pluralize(inflector.Singularize(propertyName))
+
+		if propSchema.Items.Ref != "" {
 			subModelName := DeRef(propSchema.Items.Ref)
-			resourceroot := inflector.Pluralize(inflector.Singularize(propertyName))
 			commonApis := MakeCommonAPIs(prefix, resourceroot, subModelName,
 				schemaMap, upstreamParams, cnf)
 
 			for k, v := range commonApis {
 				out[k] = v
 			}
+		} else if cnf.PrimitiveSubResources && isPrimitiveType(propSchema.Items.Type) {
+			valueApis := makePrimitiveSubApis(prefix, resourceroot,
+				schema.Title, propSchema.Items, upstreamParams, cnf)
+
+			for k, v := range valueApis {
+				out[k] = v
+			}
 		}
 	}
 	return out
 }
 
+// makeEmbeddedAPI creates an API for a single model embedded in another
+// model (e.g. a person's address).  One path is created:
+// /{propertyName} (GET, PUT, PATCH, DELETE)
+// Embedded models are addressed by their property name, so they don't get
+// any sub-APIs of their own.
+func makeEmbeddedAPI(
+	prefix string,
+	propertyName string,
+	schemaName string,
+	schemaMap map[string]*Schema,
+	upstreamParams []*Parameter,
+	cnf Conf,
+) map[string]*PathItem {
+
+	schema := schemaMap[schemaName]
+	out := make(map[string]*PathItem)
+
+	embeddedAPI := &PathItem{}
+	embeddedAPI.Get = makeSingleGetOperation(schemaName, upstreamParams, cnf)
+	embeddedAPI.Put = makePutOperation(schemaName, schema, upstreamParams, cnf)
+	embeddedAPI.Patch = makePatchOperation(schemaName, upstreamParams, cnf)
+	embeddedAPI.Delete = makeDeleteOperation(schemaName, upstreamParams, cnf)
+	embeddedAPI.Options = makeSingleOptionsOperation(upstreamParams)
+
+	out[prefix+"/"+propertyName] = embeddedAPI
+	return out
+}
+
+// makePrimitiveSubApis creates APIs for arrays of primitive values.
+// Two paths are created:
+// /{pathRoot} (GET to list the values and POST to append a value)
+// /{pathRoot}/{value} (DELETE to remove a value)
+func makePrimitiveSubApis(
+	prefix string,
+	pathRoot string,
+	schemaName string,
+	items *Schema,
+	upstreamParams []*Parameter,
+	cnf Conf,
+) map[string]*PathItem {
+
+	out := make(map[string]*PathItem)
+	valueName := inflector.Singularize(pathRoot)
+	opName := schemaName + strings.Title(valueName)
+
+	collectionAPI := &PathItem{}
+	collectionAPI.Get = makePrimitiveCollectionOperation(opName, items, upstreamParams, cnf)
+	collectionAPI.Post = makePostOperation(opName, items, upstreamParams, cnf)
+	collectionAPI.Post.Responses["201"].Schema = items
+	collectionAPI.Options = makeCollectionOptionsOperation()
+	out[prefix+"/"+pathRoot] = collectionAPI
+
+	valueParam := &Parameter{
+		Name:     valueName,
+		Type:     items.Type,
+		In:       "path",
+		Format:   items.Format,
+		Required: true,
+	}
+	upstreamParams = append(upstreamParams, valueParam)
+
+	valueAPI := &PathItem{}
+	valueAPI.Delete = makeDeleteOperation(opName, upstreamParams, cnf)
+	valueAPI.Options = makeOptionsOperation("DELETE", upstreamParams)
+	out[prefix+"/"+pathRoot+"/{"+valueName+"}"] = valueAPI
+
+	return out
+}
+
+// isPrimitiveType returns true for Swagger types which hold a single value
+// (i.e. not arrays or models).
+func isPrimitiveType(typ string) bool {
+	switch typ {
+	case "string", "number", "integer", "boolean":
+		return true
+	}
+	return false
+}
+
 // makePathID determines what property to use as the ID param when for paths
 // which have parameterized IDs (e.g. /model_name/{id}
 func makePathID(schema *Schema) (propName string, idparam *Parameter) {
@@ -209,6 +345,7 @@ func makeDeleteOperation(schemaName string,
 	}
 
 	deleteOp.Parameters = append(deleteOp.Parameters, upstreamParams...)
+	addPreconditionResponses(deleteOp)
 	return
 
 }
@@ -234,7 +371,9 @@ func makeSingleGetOperation(schemaName string, upstreamParams []*Parameter,
 		Description: "A single " + schemaName,
 	}
 
+	getOp.Parameters = append(getOp.Parameters, makeFieldsParam())
 	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
+	addETagResponses(getOp)
 	return
 }
 
@@ -263,15 +402,19 @@ func makePatchOperation(schemaName string,
 
 	// The patch body
 	bodyParam := &Parameter{
-		Name:        "body",
-		In:          "body",
-		Description: "A partial " + schemaName,
-		Required:    true,
-		Schema:      ioSchema,
+		Name: "body",
+		In:   "body",
+		Description: "A partial " + schemaName + " (" + MERGEPATCH + ") or a list of " +
+			"JSON Patch operations (" + JSONPATCH + ").  Nulls in a partial " +
+			schemaName + " remove properties.",
+		Required: true,
+		Schema:   ioSchema,
 	}
 
+	patchOp.Consumes = []string{MERGEPATCH, JSONPATCH}
 	patchOp.Parameters = append(patchOp.Parameters, bodyParam)
 	patchOp.Parameters = append(patchOp.Parameters, upstreamParams...)
+	addPreconditionResponses(patchOp)
 	return
 }
 
@@ -309,6 +452,7 @@ func makePutOperation(schemaName string, schema *Schema,
 
 	putOp.Parameters = append(putOp.Parameters, bodyParam)
 	putOp.Parameters = append(putOp.Parameters, upstreamParams...)
+	addPreconditionResponses(putOp)
 	return
 }
 
@@ -349,13 +493,16 @@ func makePostOperation(schemaName string, schema *Schema,
 // makeCollectionOperations defines GET calls for collections of the model.
 // Basically, GET operations on URLs ending with /
 func makeCollectionOperation(schemaName string, schema *Schema,
+	schemaMap map[string]*Schema,
 	upstreamParams []*Parameter,
 	cnf Conf) (getOp *Operation) {
 
 	getOp = &Operation{
 		OperationID: "get" + schemaName + "Collection",
 		Summary:     "Get multiple " + inflector.Pluralize(inflector.Singularize(schemaName)) + ".",
-		Responses:   copyResponseMap(cnf.CommonCollectionResponses),
+		Description: "Filters are combined with AND.  To combine filters with OR, " +
+			"prefix them with a group name (e.g. or1.color=red&or1.size=large).",
+		Responses: copyResponseMap(cnf.CommonCollectionResponses),
 	}
 
 	ref := MakeRef(schemaName + strings.Title(ContainerName))
@@ -370,44 +517,83 @@ func makeCollectionOperation(schemaName string, schema *Schema,
 	}
 
 	// add the parameters
-	getOp.Parameters = getCommonGetParams(cnf)
+	getOp.Parameters = append(getOp.Parameters, getCommonGetParams(cnf)...)
+	getOp.Parameters = append(getOp.Parameters, makeCursorParam())
+	getOp.Parameters = append(getOp.Parameters, makeFieldsParam())
+	if sortParam := makeSortParam(schema); sortParam != nil {
+		getOp.Parameters = append(getOp.Parameters, sortParam)
+	}
+	if len(schema.SearchFields) > 0 {
+		getOp.Parameters = append(getOp.Parameters, &Parameter{
+			Name:        SEARCH,
+			In:          "query",
+			Description: "Full-text search across " + strings.Join(schema.SearchFields, ", ") + ".  Results are ordered by relevance unless sorted.",
+			Type:        "string",
+		})
+	}
 	for propName, prop := range schema.Properties {
-
-		switch prop.Type {
-		// if there is no type, the item is a ref
-		// don't add any properties...
-		case "":
-			break
-
-		// strings check for dates and add ranges for date fields
-		case "string":
-			params := makeStringParams(propName, prop)
-			getOp.Parameters = append(getOp.Parameters, params...)
-
-		// arrays query against their type
-		case "array":
-			if prop.Items.Type != "" {
-				param := makeArrayParams(propName, prop)
-				getOp.Parameters = append(getOp.Parameters, param...)
+		// embedded models and arrays of models can be filtered by the
+		// properties of the sub-model (e.g. address.city)
+		ref := prop.Ref
+		if prop.Type == "array" && prop.Items != nil {
+			ref = prop.Items.Ref
+		}
+		if subSchema, ok := schemaMap[DeRef(ref)]; ok && ref != "" {
+			for subPropName, subProp := range subSchema.Properties {
+				params := makePropertyParams(propName+"."+subPropName, subProp)
+				getOp.Parameters = append(getOp.Parameters, params...)
 			}
+			continue
+		}
 
-		// ints and numbers...
-		case "number":
-			params := makeNumParams(propName, prop)
-			getOp.Parameters = append(getOp.Parameters, params...)
+		params := makePropertyParams(propName, prop)
+		getOp.Parameters = append(getOp.Parameters, params...)
+	}
+	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
+	addETagResponses(getOp)
 
-		case "integer":
-			params := makeNumParams(propName, prop)
-			getOp.Parameters = append(getOp.Parameters, params...)
+	return
+}
 
-		// anything else (bools)
-		default:
-			param := makeGenParams(propName, prop)
-			getOp.Parameters = append(getOp.Parameters, param...)
-		}
+// makePrimitiveCollectionOperation defines GET calls for arrays of primitive
+// values.  The results of the container are the values themselves.
+func makePrimitiveCollectionOperation(schemaName string, items *Schema,
+	upstreamParams []*Parameter,
+	cnf Conf) (getOp *Operation) {
+
+	getOp = &Operation{
+		OperationID: "get" + schemaName + "Collection",
+		Summary:     "Get multiple " + inflector.Pluralize(inflector.Singularize(schemaName)) + ".",
+		Responses:   copyResponseMap(cnf.CommonCollectionResponses),
+	}
+
+	// there's no model to reference, so the container is described inline
+	containerSchema := &Schema{
+		Properties: map[string]*Schema{
+			"results": &Schema{
+				Type:  "array",
+				Items: items,
+			},
+			"containerType": &Schema{
+				Type: "string",
+			},
+		},
+		Required: []string{"containerType"},
+		AllOf: []*Schema{
+			&Schema{
+				Ref: MakeRef(strings.Title(ContainerName)),
+			},
+		},
 	}
-	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
 
+	getOp.Responses["200"] = &Response{
+		Schema:      containerSchema,
+		Description: "A collection of " + inflector.Pluralize(schemaName),
+	}
+
+	getOp.Parameters = append(getOp.Parameters, getCommonGetParams(cnf)...)
+	getOp.Parameters = append(getOp.Parameters, makeCursorParam())
+	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
 	return
 }
 
@@ -457,12 +643,124 @@ func makeSingleOptionsOperation(upstreamParams []*Parameter) (optOp *Operation)
 	return
 }
 
+// makeOptionsOperation returns the options on a url which allows the
+// passed (comma separated) list of methods
+func makeOptionsOperation(allow string, upstreamParams []*Parameter) (optOp *Operation) {
+	headers := make(map[string]*Items)
+
+	optOp = &Operation{}
+	optOp.Responses = make(map[string]*Response)
+
+	var header = &Items{
+		Type:    "string",
+		Default: allow,
+	}
+
+	headers["Allow"] = header
+
+	optOp.Responses["200"] = &Response{
+		Description: "This url allows " + allow + " operations.",
+		Headers:     headers,
+	}
+
+	optOp.Parameters = append(optOp.Parameters, upstreamParams...)
+
+	return
+}
+
+// makePropertyParams makes the query parameters used to filter a collection
+// by a single property.
+func makePropertyParams(propName string, prop *Schema) (p []*Parameter) {
+	switch prop.Type {
+	// if there is no type, the item is a ref
+	// don't add any properties...
+	case "":
+		break
+
+	// strings check for dates and add ranges for date fields
+	case "string":
+		p = append(p, makeStringParams(propName, prop)...)
+		p = append(p, makeOperatorParams(propName, prop)...)
+
+	// arrays query against their type
+	// (arrays of arrays can't be queried)
+	case "array":
+		if prop.Items != nil && isPrimitiveType(prop.Items.Type) {
+			p = append(p, makeArrayParams(propName, prop)...)
+			p = append(p, makeOperatorParams(propName, prop.Items)...)
+		}
+
+	// ints and numbers...
+	case "number":
+		p = append(p, makeNumParams(propName, prop)...)
+		p = append(p, makeOperatorParams(propName, prop)...)
+
+	case "integer":
+		p = append(p, makeNumParams(propName, prop)...)
+		p = append(p, makeOperatorParams(propName, prop)...)
+
+	// anything else (bools)
+	default:
+		p = append(p, makeGenParams(propName, prop)...)
+		p = append(p, makeOperatorParams(propName, prop)...)
+	}
+	return
+}
+
 /* The following make*Param functions look at Swagger model properties and
 translate them into query params for the APIs being generated. Swagger
 properties and params have the same structure so these functions return
 []*Property. Some of the functions only return slices with a length of one, but
 slices are always returned to keep the API consistent. */
 
+// makeFieldsParam makes the fields parameter used to limit the properties
+// returned by GET operations.
+func makeFieldsParam() *Parameter {
+	return &Parameter{
+		Name:        FIELDS,
+		In:          "query",
+		Description: "A comma separated list of properties to return.  Use dots for nested properties (e.g. address.city).",
+		Type:        "array",
+		Items: &Items{
+			Type: "string",
+		},
+		CollectionFormat: "csv",
+	}
+}
+
+// makeSortParam makes the sort parameter for collection operations.  Results
+// can be sorted by any primitive property, prefixed with a - to sort in
+// descending order.  It returns nil if the model has no primitive properties.
+func makeSortParam(schema *Schema) *Parameter {
+	names := make([]string, 0)
+	for propName, prop := range schema.Properties {
+		if isPrimitiveType(prop.Type) {
+			names = append(names, propName)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	enum := make([]interface{}, 0)
+	for _, name := range names {
+		enum = append(enum, name, "-"+name)
+	}
+
+	return &Parameter{
+		Name:        SORT,
+		In:          "query",
+		Description: "A comma separated list of properties to sort by.  Prefix a property with - to sort in descending order.",
+		Type:        "array",
+		Items: &Items{
+			Type: "string",
+			Enum: enum,
+		},
+		CollectionFormat: "csv",
+	}
+}
+
 // makeGenParam makes a generic parameter using the type, enum, name and
 // format of the property.
 func makeGenParams(propName string, schema *Schema) (p []*Parameter) {
@@ -490,6 +788,48 @@ func makeArrayParams(propName string, schema *Schema) (p []*Parameter) {
 	return
 }
 
+// makeOperatorParams makes query parameters for the filter operators
+// (e.g. name[ne], name[in], name[startsWith]).  contains and startsWith are
+// only added for strings without an enum.
+func makeOperatorParams(propName string, schema *Schema) (p []*Parameter) {
+	neField := &Parameter{
+		Type:   schema.Type,
+		Enum:   schema.Enum,
+		In:     "query",
+		Name:   propName + "[" + NE + "]",
+		Format: schema.Format,
+	}
+	p = append(p, neField)
+
+	if schema.Type == "boolean" {
+		return
+	}
+
+	inField := &Parameter{
+		Type: "array",
+		In:   "query",
+		Name: propName + "[" + IN + "]",
+		Items: &Items{
+			Type:   schema.Type,
+			Format: schema.Format,
+			Enum:   schema.Enum,
+		},
+		CollectionFormat: "csv",
+	}
+	p = append(p, inField)
+
+	if schema.Type == "string" && len(schema.Enum) == 0 {
+		for _, op := range []string{CONTAINS, STARTSWITH} {
+			p = append(p, &Parameter{
+				Type: schema.Type,
+				In:   "query",
+				Name: propName + "[" + op + "]",
+			})
+		}
+	}
+	return
+}
+
 // makeNumParam makes query parameters for numerical values.  If the
 // property does NOT have an enum property, a range query is defined.
 func makeNumParams(propName string, schema *Schema) (p []*Parameter) {
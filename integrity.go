@@ -0,0 +1,333 @@
+package dragonfruit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gedex/inflector"
+)
+
+// Relation policies (see Relation.OnDelete)
+const (
+	RESTRICT = "restrict"
+	CASCADE  = "cascade"
+	SETNULL  = "set-null"
+)
+
+// the page size used when looking for references to a deleted resource
+const referencePageSize = 100
+
+// A Reference points at a resource which breaks a relation policy.
+type Reference struct {
+	Path     string      `json:"path"`
+	Property string      `json:"property"`
+	Value    interface{} `json:"value"`
+}
+
+// An IntegrityError is returned when a write or delete would break a
+// relation policy.  The frontend returns it with a 409.
+type IntegrityError struct {
+	Message    string       `json:"message"`
+	References []*Reference `json:"references"`
+}
+
+func (e *IntegrityError) Error() string {
+	return e.Message
+}
+
+// integrityPlan collects the changes needed to delete a resource
+// without leaving dangling references.  Owned plans only see (and change)
+// the owner's resources.
+type integrityPlan struct {
+	owner      string
+	violations []*Reference
+	removals   []*pendingChange
+	nulls      map[string]*pendingChange
+	visited    map[string]bool
+}
+
+// pendingChange is a resource which will be removed or updated once all
+// policies have been checked.
+type pendingChange struct {
+	root *rootResource
+	id   interface{}
+	doc  map[string]interface{}
+}
+
+// SetRelationPolicy sets the policy (restrict, cascade or set-null) of a
+// relation between two registered resources.  An empty policy turns off
+// integrity checks for the relation.
+func SetRelationPolicy(d DbBackend, cnf Conf, resourceType string,
+	relationName string, policy string) error {
+
+	switch policy {
+	case "", RESTRICT, CASCADE, SETNULL:
+	default:
+		return errors.New("The policy " + policy + " is not valid.")
+	}
+
+	sw, err := d.LoadDefinition(cnf)
+	if err != nil {
+		return err
+	}
+
+	model, ok := sw.Definitions[strings.Title(inflector.Singularize(resourceType))]
+	if !ok {
+		return errors.New("The resource " + resourceType + " is not registered.")
+	}
+
+	rel := findRelation(model.Relations, relationName)
+	if rel == nil {
+		return errors.New("The relation " + relationName + " does not exist.")
+	}
+	rel.OnDelete = policy
+
+	return d.SaveDefinition(sw)
+}
+
+// checkWriteIntegrity makes sure that every reference in a body sent to a
+// top-level resource points at an existing resource, of the same owner for
+// owned requests.  Only relations with a policy are checked.
+func checkWriteIntegrity(ctx context.Context, db DbBackend, rd *Swagger, path string,
+	body []byte, owner string) error {
+
+	root := rootForPath(findRootResources(rd), path)
+	if root == nil {
+		return nil
+	}
+
+	// bodies which aren't maps are rejected by the backends
+	var doc map[string]interface{}
+	if json.Unmarshal(body, &doc) != nil {
+		return nil
+	}
+
+	violations := make([]*Reference, 0)
+	for _, rel := range rd.Definitions[root.model].Relations {
+		val, ok := doc[rel.Property]
+		if rel.OnDelete == "" || !ok || val == nil {
+			continue
+		}
+
+		related, err := queryRelated(ctx, db, rel, val, owner)
+		if err != nil {
+			return err
+		}
+		if related.Meta.Count == 0 {
+			violations = append(violations, &Reference{
+				Path:     rel.Path + "/" + fmt.Sprint(val),
+				Property: rel.Property,
+				Value:    val,
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &IntegrityError{
+			Message:    "The body refers to resources which do not exist.",
+			References: violations,
+		}
+	}
+	return nil
+}
+
+// planDeleteIntegrity finds the changes relation policies make when a
+// top-level resource is deleted, without making them: referencing resources
+// are removed (cascade) or have their reference cleared (set-null) once the
+// resource itself has been deleted (see apply).  If any restrict policy
+// fails an IntegrityError is returned.  The plan is nil for paths which
+// aren't top-level resources.
+func planDeleteIntegrity(ctx context.Context, db DbBackend, rd *Swagger, path string,
+	pathParams map[string]interface{}, owner string) (*integrityPlan, error) {
+
+	roots := findRootResources(rd)
+	root := rootForPath(roots, path)
+	if root == nil || root.path == path {
+		return nil, nil
+	}
+
+	plan := &integrityPlan{
+		owner:      owner,
+		violations: make([]*Reference, 0),
+		removals:   make([]*pendingChange, 0),
+		nulls:      make(map[string]*pendingChange),
+		visited:    make(map[string]bool),
+	}
+
+	err := plan.add(ctx, db, rd, roots, root, pathParams[root.idName])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plan.violations) > 0 {
+		return nil, &IntegrityError{
+			Message:    "The resource is still referenced by other resources.",
+			References: plan.violations,
+		}
+	}
+
+	return plan, nil
+}
+
+// add finds every resource referring to the target resource and adds it
+// to the plan according to the relation's policy.  Cascades are followed
+// recursively.
+func (plan *integrityPlan) add(ctx context.Context, db DbBackend, rd *Swagger,
+	roots map[string]*rootResource, target *rootResource, id interface{}) error {
+
+	plan.visited[referencePath(target, id)] = true
+
+	for _, source := range roots {
+		for _, rel := range rd.Definitions[source.model].Relations {
+			if rel.Model != target.model || rel.OnDelete == "" {
+				continue
+			}
+
+			docs, err := findReferences(ctx, db, source, rel, id, plan.owner)
+			if err != nil {
+				return err
+			}
+
+			for _, doc := range docs {
+				sourceID := doc[source.idName]
+				key := referencePath(source, sourceID)
+
+				switch rel.OnDelete {
+				case RESTRICT:
+					plan.violations = append(plan.violations, &Reference{
+						Path:     key,
+						Property: rel.Property,
+						Value:    id,
+					})
+				case SETNULL:
+					change, ok := plan.nulls[key]
+					if !ok {
+						change = &pendingChange{root: source, id: sourceID, doc: doc}
+						plan.nulls[key] = change
+					}
+					change.doc[rel.Property] = nil
+				case CASCADE:
+					if plan.visited[key] {
+						continue
+					}
+					plan.removals = append(plan.removals,
+						&pendingChange{root: source, id: sourceID})
+					err = plan.add(ctx, db, rd, roots, source, sourceID)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// apply clears references and removes cascaded resources, after the
+// resource itself has been deleted.  Cascades soft delete resources whose
+// own DELETE operation would.  Backends can't roll changes back, so if one
+// of them fails the ones already made are kept and the rest are skipped.
+func (plan *integrityPlan) apply(ctx context.Context, db DbBackend, rd *Swagger) error {
+	if plan == nil {
+		return nil
+	}
+	for _, change := range plan.nulls {
+		body, err := json.Marshal(change.doc)
+		if err != nil {
+			return err
+		}
+
+		params := change.root.itemParams(ctx, change.id, body, plan.owner)
+		doc, err := db.Update(params, PUT)
+		if err != nil && err.Error() != NOTFOUNDERROR {
+			return err
+		}
+		if err == nil {
+			publishChange(db, CHANGEUPDATE, FillPath(params.Path, params.PathParams), doc, "")
+		}
+	}
+
+	for _, change := range plan.removals {
+		params := change.root.itemParams(ctx, change.id, nil, plan.owner)
+		params.SoftDelete = isSoftDelete(rd, params.Path)
+		err := db.Remove(params)
+		if err != nil && err.Error() != NOTFOUNDERROR {
+			return err
+		}
+		if err == nil {
+			publishChange(db, CHANGEDELETE, FillPath(params.Path, params.PathParams), nil, "")
+		}
+	}
+	return nil
+}
+
+// findReferences loads every resource (of an owner, if one is passed)
+// whose relation property holds the passed id.
+func findReferences(ctx context.Context, db DbBackend, source *rootResource, rel *Relation,
+	id interface{}, owner string) ([]map[string]interface{}, error) {
+
+	out := make([]map[string]interface{}, 0)
+	offset := 0
+
+	for {
+		// backends mutate the query params, so build them fresh each time
+		c, err := db.Query(QueryParams{
+			Path:       source.path,
+			PathParams: make(map[string]interface{}),
+			QueryParams: qparam{
+				rel.Property: id,
+				LIMIT:        int64(referencePageSize),
+				OFFSET:       int64(offset),
+			},
+			Owner:   owner,
+			Context: ctx,
+		})
+		if err != nil {
+			return out, err
+		}
+
+		for _, result := range c.Results {
+			if doc, ok := result.(map[string]interface{}); ok {
+				out = append(out, doc)
+			}
+		}
+
+		offset = offset + referencePageSize
+		if len(c.Results) == 0 || offset >= c.Meta.Total {
+			return out, nil
+		}
+	}
+}
+
+// rootForPath returns the top-level resource served by a (Martini
+// formatted) collection or single item path, or nil.
+func rootForPath(roots map[string]*rootResource, path string) *rootResource {
+	for _, root := range roots {
+		if root.path == path || TranslatePath(root.path+"/{"+root.idName+"}") == path {
+			return root
+		}
+	}
+	return nil
+}
+
+// itemParams builds the QueryParams for a single item of a top-level
+// resource.
+func (root *rootResource) itemParams(ctx context.Context, id interface{}, body []byte,
+	owner string) QueryParams {
+
+	return QueryParams{
+		Path:       TranslatePath(root.path + "/{" + root.idName + "}"),
+		PathParams: map[string]interface{}{root.idName: id},
+		Body:       body,
+		Owner:      owner,
+		Context:    ctx,
+	}
+}
+
+// referencePath returns the URL path of a single top-level resource.
+func referencePath(root *rootResource, id interface{}) string {
+	return root.path + "/" + fmt.Sprint(id)
+}
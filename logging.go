@@ -0,0 +1,254 @@
+package dragonfruit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// REQUESTIDHEADER carries the ID of a request.  Requests may send their own
+// (e.g. from a proxy), and every response gets one.
+const REQUESTIDHEADER = "X-Request-ID"
+
+// request IDs sent by clients which don't match this are replaced
+var requestIDRe = regexp.MustCompile(`^[[:alnum:]._:-]{1,128}$`)
+
+// A LogEntry describes a single request to the frontend.
+type LogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Method    string    `json:"method"`
+	// the path template of the matched operation (e.g. /people/{id}), or
+	// the URL path if no operation matched
+	Path        string  `json:"path"`
+	URL         string  `json:"url"`
+	OperationID string  `json:"operationId,omitempty"`
+	Status      int     `json:"status"`
+	Bytes       int     `json:"bytes"`
+	LatencyMs   float64 `json:"latencyMs"`
+	User        string  `json:"user,omitempty"`
+	RemoteAddr  string  `json:"remoteAddr"`
+	// the trace the request belongs to, if it's traced (see TracingConf)
+	TraceID string `json:"traceId,omitempty"`
+	// the calls the backend made while serving the request (see
+	// TimeBackend)
+	Backend []*BackendTiming `json:"backend,omitempty"`
+
+	mu sync.Mutex
+}
+
+// A BackendTiming is the time a single backend call took.
+type BackendTiming struct {
+	// the DbBackend method (e.g. Query)
+	Call string `json:"call"`
+	// the path the call was made for, if any
+	Path string  `json:"path,omitempty"`
+	Ms   float64 `json:"ms"`
+}
+
+// A LogSink receives the log entry of every request.  Sinks must be safe to
+// call from more than one goroutine.
+type LogSink interface {
+	Log(entry *LogEntry)
+}
+
+// A LogSinkFunc is a function used as a LogSink.
+type LogSinkFunc func(entry *LogEntry)
+
+// Log calls the function.
+func (f LogSinkFunc) Log(entry *LogEntry) {
+	f(entry)
+}
+
+// JSONLogSink writes log entries as lines of JSON.
+type JSONLogSink struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewJSONLogSink makes a JSONLogSink.
+func NewJSONLogSink(w io.Writer) *JSONLogSink {
+	return &JSONLogSink{w: w}
+}
+
+// Log writes an entry.
+func (s *JSONLogSink) Log(entry *LogEntry) {
+	out, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.w.Write(append(out, '\n'))
+}
+
+// accessLog sends log entries to its sinks.
+type accessLog struct {
+	sync.RWMutex
+	sinks []LogSink
+}
+
+// requestLog holds the sinks of the frontend's request log.
+var requestLog = &accessLog{}
+
+// AddLogSink adds a sink to the request log.
+func AddLogSink(sink LogSink) {
+	requestLog.Lock()
+	defer requestLog.Unlock()
+	requestLog.sinks = append(requestLog.sinks, sink)
+}
+
+// log sends an entry to every sink.
+func (l *accessLog) log(entry *LogEntry) {
+	l.RLock()
+	defer l.RUnlock()
+	for _, sink := range l.sinks {
+		sink.Log(entry)
+	}
+}
+
+// openLogSink returns the JSON sink of the AccessLog of a configuration.
+func openLogSink(path string) (LogSink, error) {
+	w, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLogSink(w), nil
+}
+
+// openLogFile opens the destination of a log: stdout, stderr or a file to
+// append to.
+func openLogFile(path string) (io.Writer, error) {
+	switch path {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// the request context keys of the request ID and log entry of a request
+type (
+	requestIDKey struct{}
+	logEntryKey  struct{}
+)
+
+// GetRequestID returns the ID of the request a context belongs to, or an
+// empty string.
+func GetRequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// TimeBackend records a backend call, which started at start, in the backend
+// metrics and in the log entry of the request a context belongs to (if any).
+// The finish func of StartBackendCall calls it, so backends rarely need to.
+func TimeBackend(ctx context.Context, call string, path string, start time.Time) {
+	d := time.Since(start)
+	var entry *LogEntry
+	if ctx != nil {
+		entry, _ = ctx.Value(logEntryKey{}).(*LogEntry)
+	}
+	if entry == nil {
+		metrics.observeBackend(call, "", d)
+		return
+	}
+
+	timing := &BackendTiming{Call: call, Path: path, Ms: milliseconds(d)}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	metrics.observeBackend(call, entry.OperationID, d)
+	entry.Backend = append(entry.Backend, timing)
+}
+
+// milliseconds converts a duration to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// logRequests returns a handler which gives every request an ID and sends
+// its log entry to the request log and metrics once it has been served.  It runs before
+// any other frontend handler.
+func logRequests() martini.Handler {
+	return func(c martini.Context, req *http.Request, res http.ResponseWriter) {
+		id := req.Header.Get(REQUESTIDHEADER)
+		if !requestIDRe.MatchString(id) {
+			var err error
+			id, err = newWebhookID()
+			if err != nil {
+				// request IDs only need to be unique, not secret
+				id = strconv.FormatInt(time.Now().UnixNano(), 16)
+			}
+		}
+		res.Header().Set(REQUESTIDHEADER, id)
+
+		start := time.Now()
+		entry := &LogEntry{
+			Time:       start.UTC(),
+			RequestID:  id,
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			URL:        req.URL.RequestURI(),
+			RemoteAddr: req.RemoteAddr,
+		}
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, logEntryKey{}, entry)
+		c.Map(req.WithContext(ctx))
+
+		// panics are logged as 500s on their way to the recovery handler
+		defer func() {
+			panicked := recover()
+			entry.LatencyMs = milliseconds(time.Since(start))
+			if rw, ok := res.(martini.ResponseWriter); ok {
+				entry.Status = rw.Status()
+				entry.Bytes = rw.Size()
+			}
+			if panicked != nil {
+				entry.Status = 500
+			}
+			if entry.Status == 0 {
+				entry.Status = 200
+			}
+			// later handlers map the authenticated request
+			if mapped, ok := c.Get(reflect.TypeOf(req)).Interface().(*http.Request); ok {
+				if auth := GetAuthorization(mapped); auth != nil {
+					entry.User = auth.User
+				}
+			}
+			requestLog.log(entry)
+			metrics.observeRequest(entry)
+			if panicked != nil {
+				panic(panicked)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// describeRoute returns a handler which adds the path template and
+// operation ID of a route to the log entry of its requests.
+func describeRoute(path string, op *Operation) martini.Handler {
+	return func(req *http.Request) {
+		entry, ok := req.Context().Value(logEntryKey{}).(*LogEntry)
+		if !ok {
+			return
+		}
+		entry.Path = path
+		if op != nil {
+			entry.OperationID = op.OperationID
+		}
+	}
+}
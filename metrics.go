@@ -0,0 +1,216 @@
+package dragonfruit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// METRICS is the path of the Prometheus metrics endpoint.
+const METRICS = "/metrics"
+
+// the upper bounds of the latency histograms, in seconds
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations in metricBuckets.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// observe adds an observation, in seconds.
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricBuckets))
+	}
+	for i, bound := range metricBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// the labels of the request counters
+type requestLabels struct {
+	operation string
+	method    string
+	status    int
+}
+
+// the labels of the backend histograms
+type backendLabels struct {
+	call      string
+	operation string
+}
+
+// metricSet holds the metrics of the frontend and backend.  Requests are
+// labelled with the operation ID they matched (or an empty string).
+type metricSet struct {
+	sync.Mutex
+	requests map[requestLabels]uint64
+	errors   map[requestLabels]uint64
+	latency  map[string]*histogram
+	backend  map[backendLabels]*histogram
+}
+
+// newMetricSet makes an empty metricSet.
+func newMetricSet() *metricSet {
+	return &metricSet{
+		requests: make(map[requestLabels]uint64),
+		errors:   make(map[requestLabels]uint64),
+		latency:  make(map[string]*histogram),
+		backend:  make(map[backendLabels]*histogram),
+	}
+}
+
+// metrics collects the metrics served by /metrics.
+var metrics = newMetricSet()
+
+// observeRequest counts a request which has been served.
+func (s *metricSet) observeRequest(entry *LogEntry) {
+	s.Lock()
+	defer s.Unlock()
+
+	labels := requestLabels{
+		operation: entry.OperationID,
+		method:    entry.Method,
+		status:    entry.Status,
+	}
+	s.requests[labels]++
+	if entry.Status >= 400 {
+		s.errors[labels]++
+	}
+
+	h, ok := s.latency[entry.OperationID]
+	if !ok {
+		h = &histogram{}
+		s.latency[entry.OperationID] = h
+	}
+	h.observe(entry.LatencyMs / 1000)
+}
+
+// observeBackend times a backend call made while serving an operation.
+func (s *metricSet) observeBackend(call string, operation string, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	labels := backendLabels{call: call, operation: operation}
+	h, ok := s.backend[labels]
+	if !ok {
+		h = &histogram{}
+		s.backend[labels] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// write writes the metrics in the Prometheus text format.
+func (s *metricSet) write(w io.Writer) {
+	s.Lock()
+	defer s.Unlock()
+
+	var buf bytes.Buffer
+	writeCounters(&buf, "dragonfruit_requests_total",
+		"Requests served, by operation, method and status.", s.requests)
+	writeCounters(&buf, "dragonfruit_request_errors_total",
+		"Requests answered with an error status, by operation, method and status.", s.errors)
+
+	writeHeader(&buf, "dragonfruit_request_duration_seconds",
+		"How long requests took to serve, by operation.", "histogram")
+	operations := make([]string, 0)
+	for operation := range s.latency {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		writeHistogram(&buf, "dragonfruit_request_duration_seconds",
+			`operation="`+escapeLabel(operation)+`"`, s.latency[operation])
+	}
+
+	writeHeader(&buf, "dragonfruit_backend_duration_seconds",
+		"How long backend calls took, by call and operation.", "histogram")
+	calls := make([]backendLabels, 0)
+	for labels := range s.backend {
+		calls = append(calls, labels)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].call != calls[j].call {
+			return calls[i].call < calls[j].call
+		}
+		return calls[i].operation < calls[j].operation
+	})
+	for _, labels := range calls {
+		writeHistogram(&buf, "dragonfruit_backend_duration_seconds",
+			`call="`+escapeLabel(labels.call)+`",operation="`+escapeLabel(labels.operation)+`"`,
+			s.backend[labels])
+	}
+
+	w.Write(buf.Bytes())
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(buf *bytes.Buffer, name string, help string, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeCounters writes a counter for every set of request labels.
+func writeCounters(buf *bytes.Buffer, name string, help string,
+	counters map[requestLabels]uint64) {
+
+	writeHeader(buf, name, help, "counter")
+	keys := make([]requestLabels, 0)
+	for labels := range counters {
+		keys = append(keys, labels)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.operation != b.operation {
+			return a.operation < b.operation
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, labels := range keys {
+		fmt.Fprintf(buf, "%s{operation=\"%s\",method=\"%s\",status=\"%d\"} %d\n", name,
+			escapeLabel(labels.operation), escapeLabel(labels.method), labels.status,
+			counters[labels])
+	}
+}
+
+// writeHistogram writes the buckets, sum and count of a histogram.
+func writeHistogram(buf *bytes.Buffer, name string, labels string, h *histogram) {
+	for i, bound := range metricBuckets {
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels,
+			strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(buf, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(val)
+}
+
+// ServeMetrics adds the Prometheus metrics endpoint to a Martini instance.
+// The handlers (e.g. authentication) run before the endpoint.
+func ServeMetrics(m *martini.ClassicMartini, handlers ...martini.Handler) {
+	m.Get(METRICS, withHandlers(handlers, func(res http.ResponseWriter) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		res.WriteHeader(200)
+		metrics.write(res)
+	})...)
+}
@@ -0,0 +1,172 @@
+package dragonfruit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// OWNER is the property holding the user who owns a top-level document (see
+// Conf.Ownership).
+const OWNER = "owner"
+
+// requestOwner returns the user whose items a request is limited to, or an
+// empty string if the operation isn't owned.
+func requestOwner(op *Operation, req *http.Request) string {
+	if !op.Owned {
+		return ""
+	}
+	if auth := GetAuthorization(req); auth != nil {
+		return auth.User
+	}
+	return ""
+}
+
+// requireOwner returns a handler which rejects requests to owned operations
+// without an authenticated user, since they have nothing to be limited to.
+// It runs after authenticate.
+func requireOwner(rd *Swagger, op *Operation) martini.Handler {
+	return func(req *http.Request, res http.ResponseWriter) {
+		if !op.Owned || requestOwner(op, req) != "" {
+			return
+		}
+		for _, challenge := range challenges(rd, operationSecurity(rd, op), 401) {
+			res.Header().Add("WWW-Authenticate", challenge)
+		}
+		writeError(res, 401, UNAUTHORIZEDERROR)
+	}
+}
+
+// applyOwnership marks every operation of a definition as owned, and adds
+// the (read only) owner property to top-level models.
+func applyOwnership(sw *Swagger, cnf Conf) {
+	if !cnf.Ownership {
+		return
+	}
+
+	for modelName := range findRootResources(sw) {
+		model, ok := sw.Definitions[modelName]
+		if !ok {
+			continue
+		}
+		if model.Properties == nil {
+			model.Properties = make(map[string]*Schema)
+		}
+		model.Properties[OWNER] = &Schema{
+			Type:     "string",
+			ReadOnly: true,
+		}
+	}
+
+	for _, pathitem := range sw.Paths {
+		for _, op := range []*Operation{pathitem.Get, pathitem.Put, pathitem.Post,
+			pathitem.Delete, pathitem.Head, pathitem.Patch} {
+
+			if op != nil {
+				op.Owned = true
+			}
+		}
+	}
+}
+
+// isRootPath reports whether a (Martini formatted) path is a top-level
+// collection or document (e.g. /people or /people/:id), which hold the owner
+// property.
+func isRootPath(path string) bool {
+	return strings.Count(path, "/") <= 2
+}
+
+// stampOwner sets the owner of a new or replaced top-level document.  Owners
+// sent by the client are replaced, and bodies which aren't maps are left for
+// the backend to reject.
+func stampOwner(path string, owner string, body []byte) ([]byte, error) {
+	if owner == "" || !isRootPath(path) {
+		return body, nil
+	}
+	var doc map[string]interface{}
+	if json.Unmarshal(body, &doc) != nil || doc == nil {
+		return body, nil
+	}
+	doc[OWNER] = owner
+	return json.Marshal(doc)
+}
+
+// checkOwnerPatch removes the owner from a merge patch of a top-level
+// document.  JSON patches can't change the owner, so they return a
+// PatchError if they try to.
+func checkOwnerPatch(path string, owner string, format string, body []byte) ([]byte, error) {
+	if owner == "" || !isRootPath(path) {
+		return body, nil
+	}
+
+	if format != JSONPATCH {
+		var doc map[string]interface{}
+		if json.Unmarshal(body, &doc) != nil || doc == nil {
+			return body, nil
+		}
+		if _, ok := doc[OWNER]; !ok {
+			return body, nil
+		}
+		delete(doc, OWNER)
+		return json.Marshal(doc)
+	}
+
+	var ops []PatchOperation
+	if json.Unmarshal(body, &ops) != nil {
+		return body, nil
+	}
+	for _, op := range ops {
+		if op.Op == "test" {
+			continue
+		}
+		for _, pointer := range []string{op.Path, op.From} {
+			segments, err := parsePointer(pointer)
+			if err == nil && len(segments) > 0 && segments[0] == OWNER {
+				return body, newPatchError("The property " + OWNER + " is read only.")
+			}
+		}
+	}
+	return body, nil
+}
+
+// checkOwner returns a NOTFOUNDERROR if the item at a path doesn't belong to
+// an owner.  Deletes check this before changing the items which refer to the
+// item.
+func checkOwner(db DbBackend, path string, pathParams map[string]interface{},
+	owner string) error {
+
+	if owner == "" {
+		return nil
+	}
+	c, err := db.Query(QueryParams{
+		Path:        path,
+		PathParams:  pathParams,
+		QueryParams: make(qparam),
+		Owner:       owner,
+	})
+	if err != nil {
+		return err
+	}
+	if c.Meta.Count == 0 {
+		return errors.New(NOTFOUNDERROR)
+	}
+	return nil
+}
+
+// filterOwner passes on the change events for an owner's items.
+func filterOwner(events <-chan *ChangeEvent, owner string,
+	stop <-chan struct{}) <-chan *ChangeEvent {
+
+	if owner == "" {
+		return events
+	}
+	return filterEvents(events, stop, func(ev *ChangeEvent) *ChangeEvent {
+		if ev.Owner != owner {
+			return nil
+		}
+		return ev
+	})
+}
@@ -0,0 +1,128 @@
+package dragonfruit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	CURSOR = "cursor"
+)
+
+// A Cursor marks a position in a result set.  Cursors are sent to clients as
+// opaque tokens (see EncodeCursor), so backends are free to page with
+// whatever the position describes - the CouchDB backend uses the view key and
+// document ID of a row as its startkey and startkey_docid.
+type Cursor struct {
+	// the key and document ID of the row the cursor points at
+	Key   interface{} `json:"k"`
+	DocID string      `json:"id"`
+	// Before cursors load the page before the row, others load the page
+	// after it
+	Before bool `json:"b,omitempty"`
+}
+
+// A CursorError is returned by backends when a cursor no longer points at a
+// row (e.g. the row has been deleted).  The frontend returns it with a 410.
+type CursorError struct {
+	Message string `json:"message"`
+}
+
+func (e *CursorError) Error() string {
+	return e.Message
+}
+
+// NewCursorError makes a CursorError.
+func NewCursorError(message string) error {
+	return &CursorError{Message: message}
+}
+
+// EncodeCursor turns a cursor into an opaque, URL-safe token.
+func EncodeCursor(c *Cursor) string {
+	out, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// DecodeCursor parses a token made by EncodeCursor.
+func DecodeCursor(token string) (*Cursor, error) {
+	invalid := errors.New("The cursor " + token + " is not valid.")
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, invalid
+	}
+
+	c := &Cursor{}
+	if json.Unmarshal(raw, c) != nil {
+		return nil, invalid
+	}
+	return c, nil
+}
+
+// makeCursorParam makes the cursor parameter for collection operations.
+func makeCursorParam() *Parameter {
+	return &Parameter{
+		Name:        CURSOR,
+		In:          "query",
+		Description: "An opaque token from the next or prev links of a previous page.  Cursors can't be combined with offset.",
+		Type:        "string",
+	}
+}
+
+// setPageLinks adds next and prev links to the metadata of a result set, and
+// sends them (along with a link to the first page) in a Link header.  Links
+// use cursors if the backend returned them, otherwise they use offsets.
+func setPageLinks(h http.Header, req *http.Request, meta *ContainerMeta, limit int) {
+	if meta.Limit > 0 {
+		limit = meta.Limit
+	}
+
+	if meta.NextCursor != "" {
+		meta.Next = pageURL(req, CURSOR, meta.NextCursor)
+	} else if limit > 0 && meta.Offset+limit < meta.Total {
+		meta.Next = pageURL(req, OFFSET, strconv.Itoa(meta.Offset+limit))
+	}
+
+	if meta.PrevCursor != "" {
+		meta.Prev = pageURL(req, CURSOR, meta.PrevCursor)
+	} else if limit > 0 && meta.Offset > 0 {
+		prev := meta.Offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		meta.Prev = pageURL(req, OFFSET, strconv.Itoa(prev))
+	}
+
+	links := []string{"<" + pageURL(req, "", "") + ">; rel=\"first\""}
+	if meta.Next != "" {
+		links = append(links, "<"+meta.Next+">; rel=\"next\"")
+	}
+	if meta.Prev != "" {
+		links = append(links, "<"+meta.Prev+">; rel=\"prev\"")
+	}
+	h.Set("Link", strings.Join(links, ", "))
+}
+
+// pageURL returns the URL of the current request, with any paging params
+// replaced by the passed param.  An empty name returns the first page.
+func pageURL(req *http.Request, name string, value string) string {
+	query := req.URL.Query()
+	query.Del(CURSOR)
+	query.Del(OFFSET)
+	if name != "" {
+		query.Set(name, value)
+	}
+
+	out := req.URL.Path
+	if encoded := query.Encode(); encoded != "" {
+		out = out + "?" + encoded
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+package dragonfruit
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []*Cursor{
+		{Key: "red", DocID: "a1"},
+		{Key: []interface{}{"red", 5.0}, DocID: "a1", Before: true},
+		{Key: nil, DocID: ""},
+		{Key: map[string]interface{}{"k": true}, DocID: "doc/with/slashes"},
+	}
+
+	for _, c := range tests {
+		token := EncodeCursor(c)
+		got, err := DecodeCursor(token)
+		if err != nil {
+			t.Fatalf("DecodeCursor(%q): %v", token, err)
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Errorf("got %+v, want %+v", got, c)
+		}
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  *Cursor
+	}{
+		{"valid tokens", base64.RawURLEncoding.EncodeToString([]byte(`{"k":"x","id":"1","b":true}`)),
+			&Cursor{Key: "x", DocID: "1", Before: true}},
+		{"empty objects", base64.RawURLEncoding.EncodeToString([]byte(`{}`)), &Cursor{}},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"id":"1"}`)), nil},
+		{"not base64", "!!!", nil},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte(`nope`)), nil},
+		{"not an object", base64.RawURLEncoding.EncodeToString([]byte(`[1]`)), nil},
+		{"empty tokens", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeCursor(tt.token)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetPageLinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		meta     ContainerMeta
+		limit    int
+		wantNext string
+		wantPrev string
+		wantLink string
+	}{
+		{"first page of offsets", "/pets?limit=10", ContainerMeta{Total: 25}, 10,
+			"/pets?limit=10&offset=10", "",
+			`</pets?limit=10>; rel="first", </pets?limit=10&offset=10>; rel="next"`},
+		{"middle page of offsets", "/pets?offset=10", ContainerMeta{Offset: 10, Total: 25}, 10,
+			"/pets?offset=20", "/pets?offset=0",
+			`</pets>; rel="first", </pets?offset=20>; rel="next", </pets?offset=0>; rel="prev"`},
+		{"last page of offsets", "/pets?offset=20", ContainerMeta{Offset: 20, Total: 25}, 10,
+			"", "/pets?offset=10",
+			`</pets>; rel="first", </pets?offset=10>; rel="prev"`},
+		{"prev offsets stop at zero", "/pets?offset=5", ContainerMeta{Offset: 5, Total: 25}, 10,
+			"/pets?offset=15", "/pets?offset=0",
+			`</pets>; rel="first", </pets?offset=15>; rel="next", </pets?offset=0>; rel="prev"`},
+		{"the backend's limit wins", "/pets", ContainerMeta{Limit: 5, Total: 25}, 10,
+			"/pets?offset=5", "",
+			`</pets>; rel="first", </pets?offset=5>; rel="next"`},
+		{"cursors replace offsets", "/pets?color=red&offset=10",
+			ContainerMeta{Offset: 10, Total: 25, NextCursor: "n", PrevCursor: "p"}, 10,
+			"/pets?color=red&cursor=n", "/pets?color=red&cursor=p",
+			`</pets?color=red>; rel="first", </pets?color=red&cursor=n>; rel="next", </pets?color=red&cursor=p>; rel="prev"`},
+		{"cursor pages drop the old cursor", "/pets?cursor=old", ContainerMeta{NextCursor: "n"}, 10,
+			"/pets?cursor=n", "",
+			`</pets>; rel="first", </pets?cursor=n>; rel="next"`},
+		{"no limit", "/pets", ContainerMeta{Total: 25}, 0, "", "", `</pets>; rel="first"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			h := http.Header{}
+			meta := tt.meta
+			setPageLinks(h, req, &meta, tt.limit)
+			if meta.Next != tt.wantNext {
+				t.Errorf("got next %q, want %q", meta.Next, tt.wantNext)
+			}
+			if meta.Prev != tt.wantPrev {
+				t.Errorf("got prev %q, want %q", meta.Prev, tt.wantPrev)
+			}
+			if got := h.Get("Link"); got != tt.wantLink {
+				t.Errorf("got Link %q, want %q", got, tt.wantLink)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package dragonfruit
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PATCH body formats, selected by the Content-Type of the request.  Plain
+// JSON bodies are treated as merge patches.
+const (
+	MERGEPATCH = "application/merge-patch+json"
+	JSONPATCH  = "application/json-patch+json"
+)
+
+// A PatchOperation is a single operation from a JSON Patch (RFC 6902).
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// A PatchError is returned when a patch can't be applied.  The frontend
+// returns it with a 409.
+type PatchError struct {
+	Message string `json:"message"`
+}
+
+func (e *PatchError) Error() string {
+	return e.Message
+}
+
+// newPatchError makes a PatchError.
+func newPatchError(message string) error {
+	return &PatchError{Message: message}
+}
+
+// ApplyPatch applies a patch in the passed format (MERGEPATCH or JSONPATCH)
+// to a document unmarshaled from JSON, and returns the patched document.
+// Maps and slices in the document may be changed in place, so the document
+// should be thrown away if an error is returned.
+func ApplyPatch(format string, doc interface{}, patch interface{}) (interface{}, error) {
+	switch format {
+	case "", MERGEPATCH:
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return doc, newPatchError("A merge patch must be an object.")
+		}
+		return MergePatch(doc, patch), nil
+	case JSONPATCH:
+		// the patch has already been unmarshaled, so round trip it
+		// to get the operations
+		raw, err := json.Marshal(patch)
+		if err != nil {
+			return doc, err
+		}
+		var ops []PatchOperation
+		if json.Unmarshal(raw, &ops) != nil {
+			return doc, newPatchError("A JSON patch must be an array of operations.")
+		}
+		return ApplyJSONPatch(doc, ops)
+	}
+	return doc, newPatchError("The patch format " + format + " is not supported.")
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to a document.  Objects
+// are merged recursively and null values remove keys.
+func MergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for key, val := range p {
+		if val == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = MergePatch(t[key], val)
+	}
+	return t
+}
+
+// ApplyJSONPatch applies a list of JSON Patch (RFC 6902) operations to a
+// document.  Operations are applied in order and the first failure stops the
+// patch.
+func ApplyJSONPatch(doc interface{}, ops []PatchOperation) (interface{}, error) {
+	for _, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return doc, err
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = patchAdd(doc, path, op.Value)
+		case "remove":
+			doc, _, err = patchRemove(doc, path)
+		case "replace":
+			doc, err = patchReplace(doc, path, op.Value)
+		case "move", "copy":
+			var from []string
+			from, err = parsePointer(op.From)
+			if err != nil {
+				return doc, err
+			}
+
+			var val interface{}
+			if op.Op == "move" {
+				if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+					return doc, newPatchError("A value can't be moved into itself.")
+				}
+				doc, val, err = patchRemove(doc, from)
+			} else {
+				val, err = patchGet(doc, from)
+				val = copyValue(val)
+			}
+			if err == nil {
+				doc, err = patchAdd(doc, path, val)
+			}
+		case "test":
+			var val interface{}
+			val, err = patchGet(doc, path)
+			if err == nil && !reflect.DeepEqual(val, op.Value) {
+				err = newPatchError("The test of " + op.Path + " failed.")
+			}
+		default:
+			err = newPatchError("The patch operation " + op.Op + " is not valid.")
+		}
+
+		if err != nil {
+			return doc, err
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, newPatchError("The path " + pointer + " is not a valid JSON pointer.")
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// patchGet returns the value at a path.
+func patchGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			val, ok := d[token]
+			if !ok {
+				return nil, pathNotFound(path)
+			}
+			doc = val
+		case []interface{}:
+			i, err := arrayIndex(token, len(d)-1, path)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, pathNotFound(path)
+		}
+	}
+	return doc, nil
+}
+
+// patchAdd adds a value at a path.  Values added to arrays are inserted
+// before the index, and - appends to the array.
+func patchAdd(doc interface{}, path []string, val interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[key] = val
+			return p, nil
+		case []interface{}:
+			i := len(p)
+			if key != "-" {
+				var err error
+				i, err = arrayIndex(key, len(p), path)
+				if err != nil {
+					return p, err
+				}
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = val
+			return p, nil
+		}
+		return parent, pathNotFound(path)
+	})
+}
+
+// patchRemove removes the value at a path and returns it.
+func patchRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return doc, nil, newPatchError("The whole document can't be removed.")
+	}
+
+	var removed interface{}
+	out, err := updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			val, ok := p[key]
+			if !ok {
+				return p, pathNotFound(path)
+			}
+			removed = val
+			delete(p, key)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(p)-1, path)
+			if err != nil {
+				return p, err
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return parent, pathNotFound(path)
+	})
+	return out, removed, err
+}
+
+// patchReplace replaces the value at a path, which must exist.
+func patchReplace(doc interface{}, path []string, val interface{}) (interface{}, error) {
+	if _, err := patchGet(doc, path); err != nil {
+		return doc, err
+	}
+	if len(path) == 0 {
+		return val, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[key] = val
+			return p, nil
+		case []interface{}:
+			i, _ := arrayIndex(key, len(p)-1, path)
+			p[i] = val
+			return p, nil
+		}
+		return parent, pathNotFound(path)
+	})
+}
+
+// updateParent walks to the parent of the last token of a path and calls fn
+// with it.  Parents are replaced with whatever fn returns, since appending
+// to (or removing from) an array makes a new slice.
+func updateParent(doc interface{}, path []string,
+	fn func(interface{}, string) (interface{}, error)) (interface{}, error) {
+
+	var walk func(node interface{}, tokens []string) (interface{}, error)
+	walk = func(node interface{}, tokens []string) (interface{}, error) {
+		if len(tokens) == 1 {
+			return fn(node, tokens[0])
+		}
+
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[tokens[0]]
+			if !ok {
+				return node, pathNotFound(path)
+			}
+			newChild, err := walk(child, tokens[1:])
+			if err != nil {
+				return node, err
+			}
+			n[tokens[0]] = newChild
+			return n, nil
+		case []interface{}:
+			i, err := arrayIndex(tokens[0], len(n)-1, path)
+			if err != nil {
+				return node, err
+			}
+			newChild, err := walk(n[i], tokens[1:])
+			if err != nil {
+				return node, err
+			}
+			n[i] = newChild
+			return n, nil
+		}
+		return node, pathNotFound(path)
+	}
+
+	return walk(doc, path)
+}
+
+// arrayIndex parses an array index from a path token.  The index must be
+// between 0 and max.
+func arrayIndex(token string, max int, path []string) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, pathNotFound(path)
+	}
+	return i, nil
+}
+
+// pathNotFound returns an error for a path which doesn't exist.
+func pathNotFound(path []string) error {
+	return newPatchError("The path /" + strings.Join(path, "/") + " does not exist.")
+}
+
+// copyValue makes a deep copy of a value unmarshaled from JSON.
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for key, item := range v {
+			out[key] = copyValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = copyValue(item)
+		}
+		return out
+	}
+	return val
+}
+
+// checkRootPointer rejects JSON Patch operations on the whole document.  The
+// root pointer would get past every per-property check (read only fields,
+// audit fields, the owner and relation policies), so only "test" may use it.
+func checkRootPointer(format string, body []byte) error {
+	if format != JSONPATCH {
+		return nil
+	}
+
+	var ops []PatchOperation
+	if json.Unmarshal(body, &ops) != nil {
+		return nil
+	}
+
+	for _, op := range ops {
+		if op.Op == "test" {
+			continue
+		}
+		pointers := []string{op.Path}
+		if op.Op == "move" || op.Op == "copy" {
+			pointers = append(pointers, op.From)
+		}
+		for _, pointer := range pointers {
+			if path, err := parsePointer(pointer); err == nil && len(path) == 0 {
+				return newPatchError("Patches can't " + op.Op + " the whole document.")
+			}
+		}
+	}
+	return nil
+}
+
+// patchIntegrityBody returns the top-level values written by a patch, so
+// relation policies can be checked (see checkWriteIntegrity).
+func patchIntegrityBody(format string, body []byte) []byte {
+	if format != JSONPATCH {
+		return body
+	}
+
+	var ops []PatchOperation
+	if json.Unmarshal(body, &ops) != nil {
+		return body
+	}
+
+	written := make(map[string]interface{})
+	for _, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil || len(path) != 1 {
+			continue
+		}
+		if op.Op == "add" || op.Op == "replace" {
+			written[path[0]] = op.Value
+		}
+	}
+
+	out, _ := json.Marshal(written)
+	return out
+}
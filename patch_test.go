@@ -0,0 +1,135 @@
+package dragonfruit
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// unmarshalTest unmarshals a JSON literal used in a test.
+func unmarshalTest(t *testing.T, s string) interface{} {
+	t.Helper()
+	var out interface{}
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		t.Fatalf("bad JSON %s: %v", s, err)
+	}
+	return out
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+	}{
+		{"adds keys", `{"a":1}`, `{"b":2}`, `{"a":1,"b":2}`},
+		{"replaces values", `{"a":1}`, `{"a":"x"}`, `{"a":"x"}`},
+		{"removes null keys", `{"a":1,"b":2}`, `{"b":null}`, `{"a":1}`},
+		{"removing missing keys", `{"a":1}`, `{"b":null}`, `{"a":1}`},
+		{"merges nested objects", `{"a":{"b":1,"c":2}}`, `{"a":{"c":null,"d":3}}`, `{"a":{"b":1,"d":3}}`},
+		{"replaces arrays", `{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{"replaces non-objects", `{"a":1}`, `{"a":{"b":null,"c":1}}`, `{"a":{"c":1}}`},
+		{"non-object patches replace", `{"a":1}`, `[1]`, `[1]`},
+		{"non-object targets", `[1]`, `{"a":1}`, `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergePatch(unmarshalTest(t, tt.target), unmarshalTest(t, tt.patch))
+			if want := unmarshalTest(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		// the patch fails with a PatchError
+		fails bool
+	}{
+		{"add a key", `{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`, false},
+		{"add replaces a key", `{"a":1}`, `[{"op":"add","path":"/a","value":2}]`, `{"a":2}`, false},
+		{"add into an array", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`, false},
+		{"add to the end of an array", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`, false},
+		{"add past the end of an array", `{"a":[1]}`, `[{"op":"add","path":"/a/3","value":2}]`, "", true},
+		{"add under a missing parent", `{}`, `[{"op":"add","path":"/a/b","value":1}]`, "", true},
+		{"remove a key", `{"a":1,"b":2}`, `[{"op":"remove","path":"/b"}]`, `{"a":1}`, false},
+		{"remove from an array", `{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/1"}]`, `{"a":[1,3]}`, false},
+		{"remove a missing key", `{"a":1}`, `[{"op":"remove","path":"/b"}]`, "", true},
+		{"replace a key", `{"a":{"b":1}}`, `[{"op":"replace","path":"/a/b","value":"x"}]`, `{"a":{"b":"x"}}`, false},
+		{"replace a missing key", `{"a":1}`, `[{"op":"replace","path":"/b","value":1}]`, "", true},
+		{"move a key", `{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`, `{"a":{},"c":{"d":1}}`, false},
+		{"move into itself", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`, "", true},
+		{"copy a key", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"}]`, `{"a":{"b":1},"c":{"b":1}}`, false},
+		{"test passes", `{"a":[1,{"b":true}]}`, `[{"op":"test","path":"/a/1/b","value":true}]`, `{"a":[1,{"b":true}]}`, false},
+		{"test fails", `{"a":1}`, `[{"op":"test","path":"/a","value":2}]`, "", true},
+		{"escaped pointers", `{"a/b":{"c~d":1}}`, `[{"op":"replace","path":"/a~1b/c~0d","value":2}]`, `{"a/b":{"c~d":2}}`, false},
+		{"bad pointers", `{"a":1}`, `[{"op":"remove","path":"a"}]`, "", true},
+		{"unknown operations", `{"a":1}`, `[{"op":"frob","path":"/a"}]`, "", true},
+		{"operations apply in order", `{}`, `[{"op":"add","path":"/a","value":[]},{"op":"add","path":"/a/-","value":1},{"op":"test","path":"/a/0","value":1}]`, `{"a":[1]}`, false},
+		{"a failure stops the patch", `{"a":1}`, `[{"op":"test","path":"/a","value":2},{"op":"remove","path":"/a"}]`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []PatchOperation
+			if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+				t.Fatalf("bad patch %s: %v", tt.patch, err)
+			}
+			got, err := ApplyJSONPatch(unmarshalTest(t, tt.doc), ops)
+			if tt.fails {
+				if _, ok := err.(*PatchError); !ok {
+					t.Fatalf("got error %v, want a PatchError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := unmarshalTest(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyPatchFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		patch  string
+		want   string
+		fails  bool
+	}{
+		{"plain JSON merges", "", `{"b":2}`, `{"a":1,"b":2}`, false},
+		{"merge patch", MERGEPATCH, `{"a":null}`, `{}`, false},
+		{"merge patches must be objects", MERGEPATCH, `[1]`, "", true},
+		{"JSON patch", JSONPATCH, `[{"op":"remove","path":"/a"}]`, `{}`, false},
+		{"JSON patches must be arrays", JSONPATCH, `{"op":"remove"}`, "", true},
+		{"unknown formats", "text/plain", `{}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyPatch(tt.format, unmarshalTest(t, `{"a":1}`), unmarshalTest(t, tt.patch))
+			if tt.fails {
+				if _, ok := err.(*PatchError); !ok {
+					t.Fatalf("got error %v, want a PatchError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := unmarshalTest(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
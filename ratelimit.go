@@ -0,0 +1,228 @@
+package dragonfruit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// Rate limit headers
+const (
+	RATELIMITLIMIT     = "X-RateLimit-Limit"
+	RATELIMITREMAINING = "X-RateLimit-Remaining"
+	RATELIMITRESET     = "X-RateLimit-Reset"
+)
+
+// RATELIMITERROR is returned when a client has used up its requests.
+const RATELIMITERROR = "Too many requests.  Try again later."
+
+// the period of rate limits which don't set one, in seconds
+const defaultRateLimitPeriod = 60
+
+// A RateLimit limits the requests each client can make to an operation, as
+// a token bucket: clients can make Burst requests at once, and get Requests
+// more every Period seconds.  Clients are told apart by their API key, or
+// else by their IP address.
+type RateLimit struct {
+	Requests int `json:"requests"`
+	// in seconds (defaults to 60)
+	Period int `json:"period,omitempty"`
+	// defaults to Requests
+	Burst int `json:"burst,omitempty"`
+}
+
+// capacity returns the number of requests a client can make at once.
+func (r *RateLimit) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.Requests)
+}
+
+// rate returns the number of requests a client gets back each second.
+func (r *RateLimit) rate() float64 {
+	period := r.Period
+	if period <= 0 {
+		period = defaultRateLimitPeriod
+	}
+	return float64(r.Requests) / float64(period)
+}
+
+// applyRateLimits adds the rate limits of a configuration, and the 429
+// responses they cause, to the operations of a definition.  Operation rate
+// limits (keyed by method and path, e.g. "POST /people") replace the global
+// one, and a limit of 0 requests turns it off.
+func applyRateLimits(sw *Swagger, cnf Conf) {
+	for _, pathitem := range sw.Paths {
+		for _, op := range []*Operation{pathitem.Get, pathitem.Put, pathitem.Post,
+			pathitem.Delete, pathitem.Head, pathitem.Patch} {
+
+			if op != nil {
+				op.RateLimit = cnf.RateLimit
+			}
+		}
+	}
+
+	for key, limit := range cnf.OperationRateLimits {
+		parts := strings.Fields(key)
+		if len(parts) != 2 {
+			continue
+		}
+		pathitem, ok := sw.Paths[parts[1]]
+		if !ok {
+			continue
+		}
+		if op := pathitem.operation(strings.ToUpper(parts[0])); op != nil && op != pathitem.Options {
+			op.RateLimit = limit
+		}
+	}
+
+	for _, pathitem := range sw.Paths {
+		for _, op := range []*Operation{pathitem.Get, pathitem.Put, pathitem.Post,
+			pathitem.Delete, pathitem.Head, pathitem.Patch} {
+
+			if op == nil {
+				continue
+			}
+			if op.RateLimit == nil || op.RateLimit.Requests <= 0 {
+				op.RateLimit = nil
+				delete(op.Responses, "429")
+				continue
+			}
+			if op.Responses == nil {
+				op.Responses = make(map[string]*Response)
+			}
+			op.Responses["429"] = &Response{
+				Description: RATELIMITERROR,
+				Schema:      &Schema{Type: "string"},
+				Headers: map[string]*Items{
+					"Retry-After":      &Items{Type: "integer"},
+					RATELIMITLIMIT:     &Items{Type: "integer"},
+					RATELIMITREMAINING: &Items{Type: "integer"},
+					RATELIMITRESET:     &Items{Type: "integer"},
+				},
+			}
+		}
+	}
+}
+
+// tokenBucket holds the requests a single client has left.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps the token buckets of an operation's clients.  Buckets
+// which have filled up again are dropped, at most once a period.
+type rateLimiter struct {
+	sync.Mutex
+	limit   *RateLimit
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// newRateLimiter makes a rateLimiter.
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// take takes a request from a client's bucket.  It returns the requests the
+// client has left and the time until its bucket is full again, or, if the
+// client has none left, false and the time until it has one.
+func (l *rateLimiter) take(client string, now time.Time) (int, time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	capacity, rate := l.limit.capacity(), l.limit.rate()
+	fill := func(b *tokenBucket) float64 {
+		return math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+
+	if now.Sub(l.swept).Seconds()*rate >= capacity {
+		for key, b := range l.buckets {
+			if fill(b) >= capacity {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens = fill(b)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return 0, seconds((1 - b.tokens) / rate), false
+	}
+	b.tokens--
+	return int(b.tokens), seconds((capacity - b.tokens) / rate), true
+}
+
+// seconds converts a number of seconds to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// limitRequests returns a handler which rejects requests from clients who
+// have used up the rate limit of an operation.  It runs before authenticate,
+// so rejected clients can't keep trying credentials.
+func limitRequests(rd *Swagger, op *Operation) martini.Handler {
+	if op.RateLimit == nil || op.RateLimit.Requests <= 0 {
+		return func() {}
+	}
+	limiter := newRateLimiter(op.RateLimit)
+
+	return func(auth *authenticator, req *http.Request, res http.ResponseWriter) {
+		remaining, wait, ok := limiter.take(rateLimitClient(rd, auth, req), time.Now())
+
+		h := res.Header()
+		h.Set(RATELIMITLIMIT, strconv.Itoa(int(op.RateLimit.capacity())))
+		h.Set(RATELIMITREMAINING, strconv.Itoa(remaining))
+		h.Set(RATELIMITRESET, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		if ok {
+			return
+		}
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(res, 429, RATELIMITERROR)
+	}
+}
+
+// rateLimitClient returns the key of the client making a request: its API
+// key, if it sends a valid one, or else its IP address.
+func rateLimitClient(rd *Swagger, auth *authenticator, req *http.Request) string {
+	names := make([]string, 0)
+	for name, scheme := range rd.SecurityDefinitions {
+		if scheme.Type == APIKEYSCHEME {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		scheme := rd.SecurityDefinitions[name]
+		if auth.check(scheme, req) != nil {
+			return "key:" + apiKeyValue(scheme, req)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
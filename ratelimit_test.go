@@ -0,0 +1,72 @@
+package dragonfruit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitDefaults(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        RateLimit
+		wantCapacity float64
+		wantRate     float64
+	}{
+		{"period defaults to a minute", RateLimit{Requests: 30}, 30, 0.5},
+		{"burst defaults to requests", RateLimit{Requests: 10, Period: 5}, 10, 2},
+		{"burst", RateLimit{Requests: 10, Period: 10, Burst: 3}, 3, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limit.capacity(); got != tt.wantCapacity {
+				t.Errorf("got capacity %v, want %v", got, tt.wantCapacity)
+			}
+			if got := tt.limit.rate(); got != tt.wantRate {
+				t.Errorf("got rate %v, want %v", got, tt.wantRate)
+			}
+		})
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	// three requests at once, and one more every second
+	l := newRateLimiter(&RateLimit{Requests: 60, Period: 60, Burst: 3})
+	start := time.Now()
+
+	steps := []struct {
+		name          string
+		client        string
+		at            time.Duration
+		wantOK        bool
+		wantRemaining int
+		wantWait      time.Duration
+	}{
+		{"first request", "a", 0, true, 2, time.Second},
+		{"second request", "a", 0, true, 1, 2 * time.Second},
+		{"last request of the burst", "a", 0, true, 0, 3 * time.Second},
+		{"bucket is empty", "a", 0, false, 0, time.Second},
+		{"bucket is half full", "a", 500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+		{"bucket has a request again", "a", time.Second, true, 0, 3 * time.Second},
+		{"clients have their own buckets", "b", time.Second, true, 2, time.Second},
+		{"buckets fill up to the burst", "a", time.Minute, true, 2, time.Second},
+	}
+
+	for _, s := range steps {
+		remaining, wait, ok := l.take(s.client, start.Add(s.at))
+		if ok != s.wantOK {
+			t.Errorf("%s: got ok %v, want %v", s.name, ok, s.wantOK)
+		}
+		if remaining != s.wantRemaining {
+			t.Errorf("%s: got %d remaining, want %d", s.name, remaining, s.wantRemaining)
+		}
+		if diff := wait - s.wantWait; diff > time.Millisecond || diff < -time.Millisecond {
+			t.Errorf("%s: got wait %v, want %v", s.name, wait, s.wantWait)
+		}
+	}
+
+	// full buckets are swept, so only the last client's is left
+	if len(l.buckets) != 1 || l.buckets["a"] == nil {
+		t.Errorf("got buckets %v, want only a's", l.buckets)
+	}
+}
@@ -0,0 +1,400 @@
+package dragonfruit
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/gedex/inflector"
+)
+
+const (
+	EXPAND = "expand"
+)
+
+// rootResource describes a top-level resource in a definition
+// (e.g. /customers and /customers/{customerId}).
+type rootResource struct {
+	path   string
+	model  string
+	idName string
+}
+
+// RegisterRelation declares a relationship between two registered resources.
+// The property of the resourceType model holds the ID of the target resource
+// (e.g. RegisterRelation(d, cnf, "order", "buyerId", "customer")).
+// Declared relations take priority over relations inferred from property
+// names.
+func RegisterRelation(d DbBackend, cnf Conf, resourceType string,
+	property string, target string) error {
+
+	sw, err := d.LoadDefinition(cnf)
+	if err != nil {
+		return err
+	}
+
+	roots := findRootResources(sw)
+	source, ok := roots[strings.Title(inflector.Singularize(resourceType))]
+	if !ok {
+		return errors.New("The resource " + resourceType + " is not registered.")
+	}
+	related, ok := roots[strings.Title(inflector.Singularize(target))]
+	if !ok {
+		return errors.New("The resource " + target + " is not registered.")
+	}
+
+	model := sw.Definitions[source.model]
+	if _, ok := model.Properties[property]; !ok {
+		return errors.New("The property " + property + " does not exist on " + source.model + ".")
+	}
+
+	rel := &Relation{
+		Name:     inflector.Singularize(target),
+		Property: property,
+		Model:    related.model,
+		Path:     related.path,
+		Param:    related.idName,
+	}
+
+	// replace any existing relation with the same name or property
+	relations := make([]*Relation, 0)
+	for _, existing := range model.Relations {
+		if existing.Name != rel.Name && existing.Property != rel.Property {
+			relations = append(relations, existing)
+		}
+	}
+	model.Relations = append(relations, rel)
+
+	linkResources(sw, cnf)
+	applyOwnership(sw, cnf)
+
+	return d.SaveDefinition(sw)
+}
+
+// linkResources infers relations between the top-level resources of a
+// definition, and adds navigation paths (e.g. /orders/{orderId}/customer) and
+// expand parameters for every relation.
+func linkResources(sw *Swagger, cnf Conf) {
+	roots := findRootResources(sw)
+
+	for modelName, root := range roots {
+		model, ok := sw.Definitions[modelName]
+		if !ok {
+			continue
+		}
+
+		pruneRelations(model, roots)
+		inferRelations(modelName, model, roots)
+		if len(model.Relations) == 0 {
+			continue
+		}
+
+		individualPath := root.path + "/{" + root.idName + "}"
+		individual, ok := sw.Paths[individualPath]
+		if !ok {
+			continue
+		}
+
+		// navigation paths use the same path params as the single item
+		upstreamParams := make([]*Parameter, 0)
+		for _, param := range individual.Get.Parameters {
+			if param.In == "path" {
+				upstreamParams = append(upstreamParams, param)
+			}
+		}
+
+		names := make([]string, 0)
+		for _, rel := range model.Relations {
+			names = append(names, rel.Name)
+			sw.Paths[individualPath+"/"+rel.Name] = makeRelationAPI(modelName,
+				rel, upstreamParams, cnf)
+		}
+		sort.Strings(names)
+
+		setExpandParam(sw.Paths[root.path].Get, names)
+		setExpandParam(individual.Get, names)
+	}
+}
+
+// findRootResources finds the top-level resources in a definition.  It
+// returns a map of resources keyed by model name.
+func findRootResources(sw *Swagger) map[string]*rootResource {
+	out := make(map[string]*rootResource)
+
+	for path, pathitem := range sw.Paths {
+		segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		if len(segments) != 1 || pathitem.Get == nil {
+			continue
+		}
+
+		model := modelFromResponse(pathitem.Get)
+		if model == "" {
+			continue
+		}
+
+		root := &rootResource{
+			path:  path,
+			model: model,
+		}
+
+		// find the ID param from the single item path
+		for itemPath := range sw.Paths {
+			itemSegments := strings.Split(strings.TrimPrefix(itemPath, "/"), "/")
+			if len(itemSegments) == 2 && itemSegments[0] == segments[0] &&
+				TerminalPath.MatchString(itemPath) {
+				root.idName = strings.Trim(itemSegments[1], "{}")
+			}
+		}
+
+		if root.idName != "" {
+			out[model] = root
+		}
+	}
+	return out
+}
+
+// inferRelations adds relations for properties named after another top-level
+// resource (e.g. customerId when /customers is registered).
+func inferRelations(modelName string, model *Schema,
+	roots map[string]*rootResource) {
+
+	for propName, prop := range model.Properties {
+		if !isPrimitiveType(prop.Type) || !strings.HasSuffix(propName, "Id") {
+			continue
+		}
+
+		name := strings.TrimSuffix(propName, "Id")
+		related, ok := roots[strings.Title(name)]
+
+		// skip the model's own ID
+		if !ok || related.model == modelName {
+			continue
+		}
+
+		// don't hide real properties or declared relations
+		if _, exists := model.Properties[name]; exists {
+			continue
+		}
+		if findRelation(model.Relations, name) != nil {
+			continue
+		}
+
+		model.Relations = append(model.Relations, &Relation{
+			Name:     name,
+			Property: propName,
+			Model:    related.model,
+			Path:     related.path,
+			Param:    related.idName,
+			Inferred: true,
+		})
+	}
+}
+
+// pruneRelations removes relations whose property or related resource no
+// longer exists.
+func pruneRelations(model *Schema, roots map[string]*rootResource) {
+	relations := make([]*Relation, 0)
+	for _, rel := range model.Relations {
+		_, hasProperty := model.Properties[rel.Property]
+		_, hasResource := roots[rel.Model]
+		if hasProperty && hasResource {
+			relations = append(relations, rel)
+		}
+	}
+	model.Relations = relations
+}
+
+// findRelation returns the relation with the passed name, or nil.
+func findRelation(relations []*Relation, name string) *Relation {
+	for _, rel := range relations {
+		if rel.Name == name {
+			return rel
+		}
+	}
+	return nil
+}
+
+// modelFromResponse returns the name of the model returned by an operation
+// (e.g. Customer for an operation returning a CustomerContainer).
+func modelFromResponse(op *Operation) string {
+	resp, ok := op.Responses["200"]
+	if !ok || resp.Schema == nil {
+		return ""
+	}
+	return strings.TrimSuffix(DeRef(resp.Schema.Ref), strings.Title(ContainerName))
+}
+
+// makeRelationAPI creates a navigation API which loads the resource related
+// to a single item.
+func makeRelationAPI(schemaName string, rel *Relation,
+	upstreamParams []*Parameter, cnf Conf) *PathItem {
+
+	getOp := &Operation{
+		OperationID: "get" + schemaName + strings.Title(rel.Name),
+		Summary:     "Get the " + rel.Name + " of a " + schemaName + " object.",
+		Responses:   copyResponseMap(cnf.CommonSingleResponses),
+		Relation:    rel,
+	}
+
+	getOp.Responses["200"] = &Response{
+		Schema: &Schema{
+			Ref: MakeRef(rel.Model + strings.Title(ContainerName)),
+		},
+		Description: "The " + rel.Name + " of a " + schemaName,
+	}
+
+	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
+
+	return &PathItem{
+		Get:     getOp,
+		Options: makeOptionsOperation("GET", upstreamParams),
+	}
+}
+
+// setExpandParam adds (or replaces) the expand query parameter of a GET
+// operation.
+func setExpandParam(op *Operation, names []string) {
+	params := make([]*Parameter, 0)
+	for _, param := range op.Parameters {
+		if param.Name != EXPAND {
+			params = append(params, param)
+		}
+	}
+
+	enum := make([]interface{}, 0)
+	for _, name := range names {
+		enum = append(enum, name)
+	}
+
+	params = append(params, &Parameter{
+		Name:        EXPAND,
+		In:          "query",
+		Description: "A comma separated list of related resources to embed.",
+		Type:        "array",
+		Items: &Items{
+			Type: "string",
+			Enum: enum,
+		},
+		CollectionFormat: "csv",
+	})
+	op.Parameters = params
+}
+
+// resolveRelation loads the resource related to a single item for a
+// navigation path (e.g. /orders/:orderId/customer).
+func resolveRelation(db DbBackend, q QueryParams, rel *Relation) (Container, error) {
+	parentPath := strings.TrimSuffix(q.Path, "/"+EndOfPathRe.FindString(q.Path))
+
+	parent, err := db.Query(QueryParams{
+		Path:        parentPath,
+		PathParams:  q.PathParams,
+		QueryParams: make(qparam),
+		Owner:       q.Owner,
+		Context:     q.Context,
+	})
+	if err != nil || parent.Meta.Count == 0 {
+		return parent, err
+	}
+
+	doc, ok := parent.Results[0].(map[string]interface{})
+	if !ok {
+		return Container{}, nil
+	}
+
+	return queryRelated(q.Context, db, rel, doc[rel.Property], q.Owner)
+}
+
+// relationSource returns the model whose relation a navigation path (e.g.
+// /orders/{orderId}/customer) follows.
+func relationSource(rd *Swagger, template string, rel *Relation) string {
+	parent, ok := rd.Paths[strings.TrimSuffix(strings.TrimPrefix(template, rd.BasePath), "/"+rel.Name)]
+	if !ok || parent.Get == nil {
+		return ""
+	}
+	return modelFromResponse(parent.Get)
+}
+
+// expandResults embeds related resources in a set of results.  names is the
+// list of relation names sent with the expand parameter, and owned results
+// only embed resources with the same owner.
+func expandResults(ctx context.Context, db DbBackend, results []interface{},
+	relations []*Relation, names []string, owner string) error {
+
+	err := checkExpand(relations, names)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		rel := findRelation(relations, strings.TrimSpace(name))
+
+		// results often point at the same related resource.  IDs may be
+		// any JSON value, so they're keyed by their encoding.
+		cache := make(map[string]interface{})
+
+		for _, result := range results {
+			doc, ok := result.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			val, ok := doc[rel.Property]
+			if !ok || val == nil {
+				continue
+			}
+
+			key := GroupKey(val)
+			related, cached := cache[key]
+			if !cached {
+				c, err := queryRelated(ctx, db, rel, val, owner)
+				if err != nil {
+					return err
+				}
+				if c.Meta.Count > 0 {
+					related = c.Results[0]
+				}
+				cache[key] = related
+			}
+			doc[rel.Name] = related
+		}
+	}
+	return nil
+}
+
+// checkExpand returns an error if an expand parameter names a relation
+// which doesn't exist.
+func checkExpand(relations []*Relation, names []string) error {
+	for _, name := range names {
+		if findRelation(relations, strings.TrimSpace(name)) == nil {
+			return errors.New("The relation " + name + " cannot be expanded.")
+		}
+	}
+	return nil
+}
+
+// queryRelated loads a single related resource by ID.
+func queryRelated(ctx context.Context, db DbBackend, rel *Relation, id interface{},
+	owner string) (Container, error) {
+	if id == nil {
+		return Container{}, nil
+	}
+
+	return db.Query(QueryParams{
+		Path:        rel.Path + "/:" + rel.Param,
+		PathParams:  map[string]interface{}{rel.Param: id},
+		QueryParams: make(qparam),
+		Owner:       owner,
+		Context:     ctx,
+	})
+}
+
+// relationsForOperation returns the relations of the model returned by an
+// operation.
+func relationsForOperation(rd *Swagger, op *Operation) []*Relation {
+	model, ok := rd.Definitions[modelFromResponse(op)]
+	if !ok {
+		return nil
+	}
+	return model.Relations
+}
@@ -0,0 +1,552 @@
+package dragonfruit
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// The role of requests without an authenticated user
+const ANONYMOUSROLE = "anonymous"
+
+// The role which may manage webhooks, unless Conf.AdminRoles is set
+const ADMINROLE = "admin"
+
+// ROLEERROR is returned when a user's roles don't allow an operation.
+const ROLEERROR = "The user's roles don't allow this operation."
+
+// Describes which roles can't see or write a property of a model (see
+// Conf.FieldAccess).  Hidden properties can't be written either.
+type FieldAccess struct {
+	HiddenFrom  []string `json:"hiddenFrom,omitempty"`
+	ReadOnlyFor []string `json:"readOnlyFor,omitempty"`
+}
+
+// An AccessError is returned when a user's roles don't allow a request.  The
+// frontend returns it with a 403.
+type AccessError struct {
+	Message string `json:"message"`
+}
+
+func (e *AccessError) Error() string {
+	return e.Message
+}
+
+// newAccessError makes an AccessError.
+func newAccessError(message string) error {
+	return &AccessError{Message: message}
+}
+
+// accessErrorResponse returns an AccessError for the frontend.
+func accessErrorResponse(err error) (int, string) {
+	out, _ := json.Marshal(err)
+	return 403, string(out)
+}
+
+// requestRoles returns the roles of the user making a request.  Requests
+// without a user have the anonymous role.
+func requestRoles(req *http.Request) []string {
+	auth := GetAuthorization(req)
+	if auth == nil || auth.User == "" {
+		roles := []string{ANONYMOUSROLE}
+		if auth != nil {
+			roles = append(roles, auth.Roles...)
+		}
+		return roles
+	}
+	return auth.Roles
+}
+
+// hasRole reports whether any of a user's roles is in a list of roles.
+func hasRole(roles []string, list []string) bool {
+	for _, role := range roles {
+		if containsString(list, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeRoles returns a handler which rejects requests from users who
+// don't have one of the roles of an operation.  It runs after authenticate.
+func authorizeRoles(rd *Swagger, op *Operation) martini.Handler {
+	return func(req *http.Request, res http.ResponseWriter) {
+		if len(op.Roles) == 0 || hasRole(requestRoles(req), op.Roles) {
+			return
+		}
+		if GetAuthorization(req) == nil {
+			for _, challenge := range challenges(rd, operationSecurity(rd, op), 401) {
+				res.Header().Add("WWW-Authenticate", challenge)
+			}
+			writeError(res, 401, UNAUTHORIZEDERROR)
+			return
+		}
+		writeError(res, 403, ROLEERROR)
+	}
+}
+
+// applyRoles adds the operation roles of a configuration (keyed by method
+// and path, e.g. "DELETE /people/{id}") to the operations of a definition.
+func applyRoles(sw *Swagger, cnf Conf) {
+	for key, roles := range cnf.OperationRoles {
+		parts := strings.Fields(key)
+		if len(parts) != 2 {
+			continue
+		}
+		pathitem, ok := sw.Paths[parts[1]]
+		if !ok {
+			continue
+		}
+		op := pathitem.operation(strings.ToUpper(parts[0]))
+		if op == nil {
+			continue
+		}
+		op.Roles = roles
+		if op.Responses == nil {
+			op.Responses = make(map[string]*Response)
+		}
+		op.Responses["403"] = &Response{
+			Description: ROLEERROR,
+			Schema:      &Schema{Type: "string"},
+		}
+	}
+}
+
+// operation returns the operation of a path item for a method.
+func (p *PathItem) operation(method string) *Operation {
+	switch method {
+	case "GET":
+		return p.Get
+	case "PUT":
+		return p.Put
+	case "POST":
+		return p.Post
+	case "DELETE":
+		return p.Delete
+	case "HEAD":
+		return p.Head
+	case "PATCH":
+		return p.Patch
+	case "OPTIONS":
+		return p.Options
+	}
+	return nil
+}
+
+// applyFieldAccess adds the field access rules of a configuration to the
+// properties of a model.
+func applyFieldAccess(schemaName string, schema *Schema, cnf Conf) {
+	for propName, access := range cnf.FieldAccess[schemaName] {
+		prop, ok := schema.Properties[propName]
+		if !ok || access == nil {
+			continue
+		}
+		prop.HiddenFrom = access.HiddenFrom
+		prop.ReadOnlyFor = access.ReadOnlyFor
+	}
+}
+
+// operationModel returns the model an operation reads or writes.
+func operationModel(op *Operation) string {
+	for _, model := range []string{op.Aggregate, op.Bulk, op.Trash, op.Changes} {
+		if model != "" {
+			return model
+		}
+	}
+	if model := modelFromResponse(op); model != "" {
+		return model
+	}
+	if resp, ok := op.Responses["201"]; ok && resp.Schema != nil {
+		return strings.TrimSuffix(DeRef(resp.Schema.Ref), strings.Title(ContainerName))
+	}
+	return ""
+}
+
+// fieldGuard applies the field access rules of a model for a single
+// request.  A nil guard leaves documents unchanged, so operations on models
+// without rules for the user's roles don't need to check for them.
+type fieldGuard struct {
+	rd    *Swagger
+	model string
+	roles []string
+}
+
+// newFieldGuard returns the field guard of a request, or nil if the user's
+// roles can see and write every property of the operation's model.
+func newFieldGuard(rd *Swagger, op *Operation, req *http.Request) *fieldGuard {
+	g := &fieldGuard{
+		rd:    rd,
+		model: operationModel(op),
+		roles: requestRoles(req),
+	}
+	if !g.restricts(g.model, make(map[string]bool)) {
+		return nil
+	}
+	return g
+}
+
+// restricts reports whether any property of a model (or the models it
+// embeds) is hidden or read only for the guard's roles.
+func (g *fieldGuard) restricts(model string, seen map[string]bool) bool {
+	schema, ok := g.rd.Definitions[model]
+	if !ok || seen[model] {
+		return false
+	}
+	seen[model] = true
+	for _, prop := range schema.Properties {
+		if g.readOnly(prop) {
+			return true
+		}
+		if sub := propertyModel(prop); sub != "" && g.restricts(sub, seen) {
+			return true
+		}
+	}
+	// expanded resources are hidden with their own model's rules
+	for _, rel := range schema.Relations {
+		if g.restricts(rel.Model, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden reports whether a property is hidden from the guard's roles.
+func (g *fieldGuard) hidden(prop *Schema) bool {
+	return prop != nil && hasRole(g.roles, prop.HiddenFrom)
+}
+
+// readOnly reports whether the guard's roles can't write a property.
+func (g *fieldGuard) readOnly(prop *Schema) bool {
+	return prop != nil && (g.hidden(prop) || hasRole(g.roles, prop.ReadOnlyFor))
+}
+
+// propertyModel returns the model of an embedded property, or of the items
+// of an array property.
+func propertyModel(prop *Schema) string {
+	if prop.Type == "array" && prop.Items != nil {
+		return DeRef(prop.Items.Ref)
+	}
+	return DeRef(prop.Ref)
+}
+
+// hide returns a copy of a document without the properties hidden from the
+// guard's roles, at any depth.
+func (g *fieldGuard) hide(doc interface{}) interface{} {
+	if g == nil {
+		return doc
+	}
+	return g.hideModel(g.model, doc)
+}
+
+func (g *fieldGuard) hideModel(model string, doc interface{}) interface{} {
+	schema, ok := g.rd.Definitions[model]
+	if !ok {
+		return doc
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(d))
+		for k, v := range d {
+			prop := schema.Properties[k]
+			if g.hidden(prop) {
+				continue
+			}
+			if prop != nil && propertyModel(prop) != "" {
+				v = g.hideModel(propertyModel(prop), v)
+			} else if rel := findRelation(schema.Relations, k); prop == nil && rel != nil {
+				v = g.hideModel(rel.Model, v)
+			}
+			out[k] = v
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(d))
+		for i, v := range d {
+			out[i] = g.hideModel(model, v)
+		}
+		return out
+	}
+	return doc
+}
+
+// checkRelations returns an AccessError if the user's roles can't read the
+// related resources named by an expand parameter or a navigation path: the
+// related item's GET needs roles the user doesn't have, or the property
+// holding its ID is hidden.
+func checkRelations(rd *Swagger, req *http.Request, model string,
+	relations []*Relation, names []string) error {
+
+	roles := requestRoles(req)
+	for _, name := range names {
+		rel := findRelation(relations, strings.TrimSpace(name))
+		if rel == nil {
+			continue
+		}
+		if item, ok := rd.Paths[rel.Path+"/{"+rel.Param+"}"]; ok && item.Get != nil &&
+			len(item.Get.Roles) > 0 && !hasRole(roles, item.Get.Roles) {
+			return newAccessError(ROLEERROR)
+		}
+		if schema, ok := rd.Definitions[model]; ok {
+			if prop, ok := schema.Properties[rel.Property]; ok && hasRole(roles, prop.HiddenFrom) {
+				return newAccessError("The property " + rel.Property + " can't be read.")
+			}
+		}
+	}
+	return nil
+}
+
+// hideResults hides properties from the results of a container.
+func (g *fieldGuard) hideResults(c *Container) {
+	if g == nil {
+		return
+	}
+	for i, r := range c.Results {
+		c.Results[i] = g.hide(r)
+	}
+}
+
+// hideEvents hides properties from the documents of change events.  Events
+// are shared between subscribers, so they're copied rather than changed.
+func (g *fieldGuard) hideEvents(events <-chan *ChangeEvent, stop <-chan struct{}) <-chan *ChangeEvent {
+	if g == nil {
+		return events
+	}
+	return filterEvents(events, stop, func(ev *ChangeEvent) *ChangeEvent {
+		hidden := *ev
+		hidden.Doc = g.hide(ev.Doc)
+		return &hidden
+	})
+}
+
+// checkPaths returns an AccessError if any of a list of property paths
+// (e.g. filter params, sort fields or address.city) names a hidden property.
+// Filter operators (e.g. name[ne]) and group prefixes (e.g. or1.name) are
+// ignored.
+func (g *fieldGuard) checkPaths(paths []string) error {
+	if g == nil {
+		return nil
+	}
+	for _, path := range paths {
+		path = strings.TrimLeft(path, "-+")
+		if i := strings.Index(path, "["); i >= 0 {
+			path = path[:i]
+		}
+		if g.hiddenPath(g.model, strings.Split(path, "."), true) {
+			return newAccessError("The property " + path + " can't be read.")
+		}
+	}
+	return nil
+}
+
+func (g *fieldGuard) hiddenPath(model string, segments []string, top bool) bool {
+	schema, ok := g.rd.Definitions[model]
+	if !ok || len(segments) == 0 {
+		return false
+	}
+	prop, ok := schema.Properties[segments[0]]
+	if !ok {
+		// the first segment may be a filter group
+		return top && g.hiddenPath(model, segments[1:], false)
+	}
+	if g.hidden(prop) {
+		return true
+	}
+	if sub := propertyModel(prop); sub != "" {
+		return g.hiddenPath(sub, segments[1:], false)
+	}
+	return false
+}
+
+// checkQuery returns an AccessError if a query filters, sorts, projects or
+// aggregates on a hidden property.
+func (g *fieldGuard) checkQuery(qParams map[string]interface{}) error {
+	if g == nil {
+		return nil
+	}
+	paths := make([]string, 0)
+	for k, v := range qParams {
+		paths = append(paths, k)
+		switch k {
+		case FIELDS, SORT, GROUPBY:
+			paths = append(paths, stringList(v)...)
+		default:
+			if containsString(AggregateFunctions, k) {
+				paths = append(paths, stringList(v)...)
+			}
+		}
+	}
+	return g.checkPaths(paths)
+}
+
+// searchFields returns the search fields of a model which the guard's roles
+// can read.
+func (g *fieldGuard) searchFields(fields []string) []string {
+	if g == nil {
+		return fields
+	}
+	out := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if !g.hiddenPath(g.model, strings.Split(field, "."), false) {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+// create checks the body of a new item.  Bodies which aren't JSON are left
+// for the backend to reject.
+func (g *fieldGuard) create(body []byte) ([]byte, error) {
+	return g.write(body, nil)
+}
+
+// replace checks the body of a PUT.  Protected properties keep the values of
+// the item being replaced: they can be sent back unchanged, and are copied
+// from the item when they're left out.
+func (g *fieldGuard) replace(body []byte, existing interface{}) ([]byte, error) {
+	return g.write(body, existing)
+}
+
+// patch checks a merge patch or JSON patch.  Patches can't change protected
+// properties at all.
+func (g *fieldGuard) patch(format string, body []byte) ([]byte, error) {
+	if g == nil {
+		return body, nil
+	}
+	if format != JSONPATCH {
+		return g.write(body, nil)
+	}
+
+	var ops []PatchOperation
+	if json.Unmarshal(body, &ops) != nil {
+		return body, nil
+	}
+	for _, op := range ops {
+		for _, pointer := range []string{op.Path, op.From} {
+			path, err := parsePointer(pointer)
+			if err == nil && g.protectedPointer(g.model, path) {
+				return body, newAccessError("The property " + strings.Join(path, ".") + " can't be written.")
+			}
+		}
+	}
+	return body, nil
+}
+
+// protectedPointer reports whether a JSON pointer (split into segments)
+// touches a protected property.  Array indexes are skipped.
+func (g *fieldGuard) protectedPointer(model string, path []string) bool {
+	schema, ok := g.rd.Definitions[model]
+	if !ok || len(path) == 0 {
+		return false
+	}
+	prop, ok := schema.Properties[path[0]]
+	if !ok {
+		return false
+	}
+	if g.readOnly(prop) {
+		return true
+	}
+	sub := propertyModel(prop)
+	if sub == "" {
+		return false
+	}
+	rest := path[1:]
+	if prop.Type == "array" && len(rest) > 0 {
+		rest = rest[1:]
+	}
+	return g.protectedPointer(sub, rest)
+}
+
+// write checks a body against an existing document (nil for new items and
+// patches).
+func (g *fieldGuard) write(body []byte, existing interface{}) ([]byte, error) {
+	if g == nil {
+		return body, nil
+	}
+	var doc interface{}
+	if json.Unmarshal(body, &doc) != nil {
+		return body, nil
+	}
+	out, err := g.writeModel(g.model, doc, existing)
+	if err != nil {
+		return body, err
+	}
+	return json.Marshal(out)
+}
+
+func (g *fieldGuard) writeModel(model string, doc interface{}, existing interface{}) (interface{}, error) {
+	schema, ok := g.rd.Definitions[model]
+	if !ok {
+		return doc, nil
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		old, _ := existing.(map[string]interface{})
+		for propName, prop := range schema.Properties {
+			val, sent := d[propName]
+			oldVal, had := old[propName]
+
+			if g.readOnly(prop) {
+				if sent && !(had && reflect.DeepEqual(val, oldVal)) {
+					return nil, newAccessError("The property " + propName + " can't be written.")
+				}
+				if !sent && had {
+					d[propName] = oldVal
+				}
+				continue
+			}
+
+			if sub := propertyModel(prop); sub != "" && sent {
+				newVal, err := g.writeModel(sub, val, oldVal)
+				if err != nil {
+					return nil, err
+				}
+				d[propName] = newVal
+			}
+		}
+		return d, nil
+
+	case []interface{}:
+		// array items are matched with existing items by their ID
+		idName := itemIDName(schema)
+		old := make(map[string]interface{})
+		if items, ok := existing.([]interface{}); ok {
+			for _, item := range items {
+				if m, ok := item.(map[string]interface{}); ok {
+					old[GroupKey(m[idName])] = item
+				}
+			}
+		}
+		for i, item := range d {
+			var oldItem interface{}
+			if m, ok := item.(map[string]interface{}); ok {
+				oldItem = old[GroupKey(m[idName])]
+			}
+			newItem, err := g.writeModel(model, item, oldItem)
+			if err != nil {
+				return nil, err
+			}
+			d[i] = newItem
+		}
+		return d, nil
+	}
+	return doc, nil
+}
+
+// itemIDName returns the ID property of a model, the same way makePathID
+// picks it, without changing the model.
+func itemIDName(schema *Schema) string {
+	for propName, prop := range schema.Properties {
+		if prop.Type == "array" || prop.Ref != "" {
+			continue
+		}
+		if propName == "id" || (strings.Contains(propName, "Id") && prop.Type != "") {
+			return propName
+		}
+	}
+	return schema.Title + "Id"
+}
@@ -0,0 +1,198 @@
+package dragonfruit
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	SEARCH = "q"
+)
+
+// the page size used when the frontend has to load a whole collection
+const scanPageSize = 100
+
+// tokenRe splits text into search terms.  The CouchDB backend uses the same
+// expression in its search view.
+var tokenRe = regexp.MustCompile("[^a-z0-9]+")
+
+// A TextSearcher is a backend which can run full-text searches natively.
+// Backends which don't implement it are searched by the frontend, which
+// loads every matching document and scores it in memory.
+type TextSearcher interface {
+	// Search runs a full-text search using the Search and SearchFields of
+	// a QueryParams struct.  Other query params are applied as filters.
+	// Results are ordered by relevance unless a sort is passed.
+	Search(QueryParams) (Container, error)
+}
+
+// A SearchHit is a document which matches a full-text search.
+type SearchHit struct {
+	Doc interface{}
+	// the number of distinct search terms found in the document
+	Terms int
+	// the number of times any search term was found
+	Occurrences int
+}
+
+// Tokenize splits text into lower case search terms.
+func Tokenize(text string) []string {
+	out := make([]string, 0)
+	for _, term := range tokenRe.Split(strings.ToLower(text), -1) {
+		if term != "" {
+			out = append(out, term)
+		}
+	}
+	return out
+}
+
+// ScoreDocument searches the passed fields of a document for a set of
+// terms.  It returns nil if none of the terms are found.
+func ScoreDocument(doc interface{}, fields []string, terms []string) *SearchHit {
+	counts := make(map[string]int)
+	for _, term := range terms {
+		counts[term] = 0
+	}
+
+	for _, field := range fields {
+		for _, val := range lookupPath(doc, strings.Split(field, ".")) {
+			str, ok := val.(string)
+			if !ok {
+				continue
+			}
+			for _, token := range Tokenize(str) {
+				if _, wanted := counts[token]; wanted {
+					counts[token]++
+				}
+			}
+		}
+	}
+
+	hit := &SearchHit{Doc: doc}
+	for _, count := range counts {
+		if count > 0 {
+			hit.Terms++
+			hit.Occurrences = hit.Occurrences + count
+		}
+	}
+	if hit.Terms == 0 {
+		return nil
+	}
+	return hit
+}
+
+// RankHits orders search hits by relevance: documents matching more of the
+// search terms come first, then documents matching the terms more often.
+func RankHits(hits []*SearchHit) {
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Terms != hits[j].Terms {
+			return hits[i].Terms > hits[j].Terms
+		}
+		return hits[i].Occurrences > hits[j].Occurrences
+	})
+}
+
+// OrderHits ranks search hits by relevance, or sorts them if sort fields
+// are passed.
+func OrderHits(hits []*SearchHit, fields []SortField) {
+	if len(fields) == 0 {
+		RankHits(hits)
+		return
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return LessByFields(hits[i].Doc, hits[j].Doc, fields)
+	})
+}
+
+// makeSearchFields returns the properties of a model used for full-text
+// search.  Models listed in the SearchFields configuration use the
+// configured list, others search every string property.
+func makeSearchFields(schemaName string, schema *Schema, cnf Conf) []string {
+	if fields, ok := cnf.SearchFields[schemaName]; ok {
+		return fields
+	}
+
+	out := make([]string, 0)
+	for propName, prop := range schema.Properties {
+		isString := prop.Type == "string"
+		isStringArray := prop.Type == "array" && prop.Items != nil &&
+			prop.Items.Type == "string"
+		if isString || isStringArray {
+			out = append(out, propName)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// searchResults runs a full-text search for backends which don't implement
+// TextSearcher.  It loads every document matching the other query params,
+// scores them and applies the limit and offset itself.
+func searchResults(db DbBackend, q QueryParams) (Container, error) {
+	limit, offset := 10, 0
+	if l, ok := q.QueryParams[LIMIT].(int64); ok {
+		limit = int(l)
+	}
+	if o, ok := q.QueryParams[OFFSET].(int64); ok {
+		offset = int(o)
+	}
+
+	terms := Tokenize(q.Search)
+	hits := make([]*SearchHit, 0)
+
+	c, err := queryAll(db, q, func(doc interface{}) {
+		if hit := ScoreDocument(doc, q.SearchFields, terms); hit != nil {
+			hits = append(hits, hit)
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	OrderHits(hits, q.Sort)
+
+	c.Meta.Total = len(hits)
+	c.Meta.Offset = offset
+	c.Meta.Limit = limit
+	c.Results = make([]interface{}, 0)
+	for i := offset; i < len(hits) && i < offset+limit; i++ {
+		c.Results = append(c.Results, ProjectFields(hits[i].Doc, q.Fields))
+	}
+	c.Meta.Count = len(c.Results)
+	return c, nil
+}
+
+// queryAll pages through every document matching the path and query params
+// (apart from the limit and offset) of a query, passing each one to fn.  It
+// returns the container of the last page.
+func queryAll(db DbBackend, q QueryParams, fn func(interface{})) (Container, error) {
+	for page := 0; ; page = page + scanPageSize {
+		// backends mutate the query params, so copy them each time
+		pageParams := make(qparam)
+		for k, v := range q.QueryParams {
+			pageParams[k] = v
+		}
+		pageParams[LIMIT] = int64(scanPageSize)
+		pageParams[OFFSET] = int64(page)
+
+		c, err := db.Query(QueryParams{
+			Path:        q.Path,
+			PathParams:  q.PathParams,
+			QueryParams: pageParams,
+			Owner:       q.Owner,
+			Context:     q.Context,
+		})
+		if err != nil {
+			return c, err
+		}
+
+		for _, result := range c.Results {
+			fn(result)
+		}
+
+		if len(c.Results) == 0 || page+scanPageSize >= c.Meta.Total {
+			return c, nil
+		}
+	}
+}
@@ -7,14 +7,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/go-martini/martini"
-	"github.com/martini-contrib/cors"
 )
 
 var (
@@ -39,7 +40,8 @@ const (
 )
 
 const (
-	NOTFOUNDERROR = "Entity not found."
+	NOTFOUNDERROR      = "Entity not found."
+	PRECONDITIONFAILED = "The resource has been modified."
 )
 
 // init sets up some basic regular expressions used by the frontend and
@@ -65,11 +67,6 @@ func init() {
 	ViewPathRe = regexp.MustCompile("(/([[:word:]]*)(/{[[:word:]]*})?)")
 	EndOfPathRe = regexp.MustCompile("[^/]+$")
 	m = martini.Classic()
-	m.Use(cors.Allow(&cors.Options{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{"PUT", "PATCH", "POST", "GET", "OPTIONS", "DELETE"},
-		AllowHeaders: []string{"Origin", "Expires", "Cache-Control", "X-Requested-With", "Content-Type"},
-	}))
 }
 
 // GetMartiniInstance returns a Martini instance (so that it can be used by
@@ -86,6 +83,25 @@ func ServeDocSet(m *martini.ClassicMartini, db DbBackend, cnf Conf) {
 	if err != nil {
 		panic(err)
 	}
+	auth, err := newAuthenticator(cnf)
+	if err != nil {
+		panic(err)
+	}
+	m.Map(auth)
+	if cnf.AccessLog != "" {
+		sink, err := openLogSink(cnf.AccessLog)
+		if err != nil {
+			panic(err)
+		}
+		AddLogSink(sink)
+	}
+	if cnf.Tracing != nil {
+		if err := setUpTracing(cnf.Tracing); err != nil {
+			panic(err)
+		}
+	}
+	m.Use(logRequests())
+	m.Use(corsHandler(rd, cnf))
 
 	m.Get("/api-docs", func(res http.ResponseWriter) (int, string) {
 		h := res.Header()
@@ -98,14 +114,31 @@ func ServeDocSet(m *martini.ClassicMartini, db DbBackend, cnf Conf) {
 
 		return 200, string(docs)
 	})
+	ServeWebhookAdmin(m, db, rd, cnf)
+	ServeMetrics(m, authenticate(rd, adminSecurity(rd, cnf)))
 	// create a path for each API described in the doc set
-	for path, pathitem := range rd.Paths {
+	for _, path := range routeOrder(rd.Paths) {
 
-		NewAPIFromSpec(path, pathitem, rd, m)
+		NewAPIFromSpec(path, rd.Paths[path], rd, m)
 	}
 
 }
 
+// routeOrder sorts a set of paths so that reserved paths (e.g.
+// /orders/_aggregate) are routed before the path params they would otherwise
+// match (e.g. /orders/{orderId}).
+func routeOrder(paths map[string]*PathItem) []string {
+	out := make([]string, 0)
+	for path := range paths {
+		out = append(out, path)
+	}
+	sort.Strings(out)
+	sort.SliceStable(out, func(i, j int) bool {
+		return strings.Contains(out[i], "/_") && !strings.Contains(out[j], "/_")
+	})
+	return out
+}
+
 // NewAPIFromSpec creates a new API from stored swagger-doc specifications.
 func NewAPIFromSpec(path string, pathitem *PathItem, rd *Swagger, m *martini.ClassicMartini) {
 
@@ -139,15 +172,33 @@ func addOperation(path string,
 	m *martini.ClassicMartini,
 ) {
 
+	template := path
 	path = TranslatePath(path)
-	produces := append(rd.Produces, op.Produces...)
+	// copy the definition's lists, so operations don't share them
+	produces := append(append([]string{}, rd.Produces...), op.Produces...)
 
-	consumes := append(rd.Consumes, op.Consumes...)
+	consumes := append(append([]string{}, rd.Consumes...), op.Consumes...)
+
+	// change feeds write their own (streaming) responses
+	if op.Changes != "" && method == "GET" {
+		m.Get(path, describeRoute(template, op), traceOperation(template, op), limitRequests(rd, op), authenticate(rd, operationSecurity(rd, op)), authorizeRoles(rd, op), requireOwner(rd, op), func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) {
+			outParams, err := coerceParam(params, op.Parameters)
+			if err != nil {
+				writeError(res, 409, err.Error())
+				return
+			}
+			serveChanges(db, rd, strings.TrimPrefix(path, rd.BasePath), outParams, res, req,
+				newFieldGuard(rd, op, req), requestOwner(op, req))
+		})
+		return
+	}
 
 	switch method {
 	case "GET":
-		m.Get(path, func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
-			isCollection := false
+		m.Get(path, describeRoute(template, op), traceOperation(template, op), limitRequests(rd, op), authenticate(rd, operationSecurity(rd, op)), authorizeRoles(rd, op), requireOwner(rd, op), func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
+			// collections are the only paths that accept new items, so
+			// single items and embedded models return a 404 when empty
+			isCollection := pathitem.Post != nil
 
 			h := res.Header()
 			addHeaders(h, "Content-Type", produces)
@@ -173,26 +224,139 @@ func addOperation(path string,
 				return 409, string(outerr)
 			}
 
-			path = strings.TrimPrefix(path, rd.BasePath)
+			// hidden properties can't be filtered, sorted or aggregated on
+			guard := newFieldGuard(rd, op, req)
+			err = guard.checkQuery(qParams)
+			if err != nil {
+				return accessErrorResponse(err)
+			}
+
+			owner := requestOwner(op, req)
+			if op.Aggregate != "" {
+				return serveAggregate(db, strings.TrimPrefix(path, rd.BasePath), outParams, qParams, owner,
+					req.Context())
+			}
 
-			pathcount := strings.Split(path, "/")
-			if (len(pathcount) % 2) == 0 {
-				isCollection = true
+			if op.Trash != "" {
+				return serveTrash(db, strings.TrimPrefix(path, rd.BasePath), outParams, qParams, guard, owner,
+					req.Context())
 			}
 
+			// related resources are embedded after the query
+			expand := stringList(qParams[EXPAND])
+			delete(qParams, EXPAND)
+
+			fields := stringList(qParams[FIELDS])
+			delete(qParams, FIELDS)
+			err = validateFields(rd, op, fields)
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 409, string(outerr)
+			}
+
+			sortFields, err := parseSort(qParams[SORT], op)
+			delete(qParams, SORT)
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 409, string(outerr)
+			}
+
+			search, _ := qParams[SEARCH].(string)
+			delete(qParams, SEARCH)
+
+			// the backend removes the limit, but the frontend needs it
+			// for page links
+			limit, _ := qParams[LIMIT].(int64)
+
+			var cursor *Cursor
+			if token, ok := qParams[CURSOR].(string); ok {
+				delete(qParams, CURSOR)
+				if _, hasOffset := qParams[OFFSET]; hasOffset || search != "" {
+					outerr, _ := json.Marshal("Cursors can't be combined with offset or search.")
+					return 409, string(outerr)
+				}
+				cursor, err = DecodeCursor(token)
+				if err != nil {
+					outerr, _ := json.Marshal(err.Error())
+					return 409, string(outerr)
+				}
+			}
+
+			err = checkExpand(relationsForOperation(rd, op), expand)
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 400, string(outerr)
+			}
+
+			// related resources need the roles of their own GET
+			if op.Relation != nil {
+				err = checkRelations(rd, req, relationSource(rd, template, op.Relation),
+					[]*Relation{op.Relation}, []string{op.Relation.Name})
+			} else {
+				err = checkRelations(rd, req, modelFromResponse(op), relationsForOperation(rd, op), expand)
+			}
+			if err != nil {
+				return accessErrorResponse(err)
+			}
+
+			path = strings.TrimPrefix(path, rd.BasePath)
+
 			q := QueryParams{
 				Path:        path,
 				PathParams:  outParams,
 				QueryParams: qParams,
+				Fields:      fieldsForBackend(fields, relationsForOperation(rd, op), expand),
+				Sort:        sortFields,
+				Search:      search,
+				Cursor:      cursor,
+				Owner:       owner,
+				Context:     req.Context(),
+			}
+
+			var result Container
+			if op.Relation != nil {
+				result, err = resolveRelation(db, q, op.Relation)
+			} else if search != "" {
+				// hidden properties can't be searched either, or
+				// their values could be probed
+				if model, ok := rd.Definitions[modelFromResponse(op)]; ok {
+					q.SearchFields = guard.searchFields(model.SearchFields)
+				}
+				if searcher, ok := db.(TextSearcher); ok {
+					result, err = searcher.Search(q)
+				} else {
+					result, err = searchResults(db, q)
+				}
+			} else {
+				result, err = db.Query(q)
 			}
 
-			result, err := db.Query(q)
+			if cursorErr, ok := err.(*CursorError); ok {
+				out, _ := json.Marshal(cursorErr)
+				return 410, string(out)
+			}
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
 
+			err = expandResults(req.Context(), db, result.Results, relationsForOperation(rd, op), expand, owner)
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
 			}
 
+			// backends may have projected already, but the properties
+			// needed for expansion have to be removed
+			for i, r := range result.Results {
+				result.Results[i] = ProjectFields(r, fields)
+			}
+			guard.hideResults(&result)
+
+			if isCollection {
+				setPageLinks(h, req, &result.Meta, int(limit))
+			}
+
 			out, err := json.Marshal(result)
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
@@ -203,10 +367,22 @@ func addOperation(path string,
 				return 404, notFoundError.Error()
 			}
 
+			// expanded resources can change without changing the
+			// document's version
+			version := result.Meta.Version
+			if len(expand) > 0 {
+				version = ""
+			}
+			etag := makeETag(version, out)
+			h.Set("ETag", etag)
+			if matchETag(req.Header.Get(IFNONEMATCH), etag) {
+				return 304, ""
+			}
+
 			return 200, string(out)
 		})
 	case "POST":
-		m.Post(path, func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
+		m.Post(path, describeRoute(template, op), traceOperation(template, op), limitRequests(rd, op), authenticate(rd, operationSecurity(rd, op)), authorizeRoles(rd, op), requireOwner(rd, op), func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
 			h := res.Header()
 
 			addHeaders(h, "Content-Type", produces)
@@ -227,19 +403,61 @@ func addOperation(path string,
 			}
 
 			path = strings.TrimPrefix(path, rd.BasePath)
+
+			if op.Bulk != "" {
+				return serveBulk(db, rd, op, path, outParams, val, req)
+			}
+
+			guard := newFieldGuard(rd, op, req)
+			owner := requestOwner(op, req)
+			if op.Trash != "" {
+				return serveRestore(db, path, outParams, guard, owner, req.Context())
+			}
+
+			val, err = stripMetadata("", val)
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
+			val, err = guard.create(val)
+			if err != nil {
+				return accessErrorResponse(err)
+			}
+
+			val, err = newAuditStamp(op, req).create(val)
+			if err == nil {
+				val, err = stampOwner(path, owner, val)
+			}
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
+			err = checkWriteIntegrity(req.Context(), db, rd, path, val, owner)
+			if err != nil {
+				return integrityErrorResponse(err)
+			}
+
 			q := QueryParams{
 				Path:       path,
 				PathParams: outParams,
 				Body:       val,
+				Owner:      owner,
+				Context:    req.Context(),
 			}
 
 			doc, err := db.Insert(q)
+			if err != nil && err.Error() == NOTFOUNDERROR {
+				return 404, string(err.Error())
+			}
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
 			}
+			publishInsert(db, rd, path, outParams, doc, owner)
 
-			out, err := json.Marshal(doc)
+			out, err := json.Marshal(guard.hide(doc))
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
@@ -248,7 +466,7 @@ func addOperation(path string,
 			return 201, string(out)
 		})
 	case "PUT":
-		m.Put(path, func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
+		m.Put(path, describeRoute(template, op), traceOperation(template, op), limitRequests(rd, op), authenticate(rd, operationSecurity(rd, op)), authorizeRoles(rd, op), requireOwner(rd, op), func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
 			h := res.Header()
 
 			addHeaders(h, "Content-Type", produces)
@@ -268,10 +486,64 @@ func addOperation(path string,
 			}
 
 			path = strings.TrimPrefix(path, rd.BasePath)
+
+			val, err = stripMetadata("", val)
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
+			owner := requestOwner(op, req)
+			err = checkWriteIntegrity(req.Context(), db, rd, path, val, owner)
+			if err != nil {
+				return integrityErrorResponse(err)
+			}
+
+			version, err := checkIfMatch(req.Context(), db, path, outParams, owner,
+				req.Header.Get(IFMATCH))
+			if err != nil && err.Error() == PRECONDITIONFAILED {
+				return 412, string(err.Error())
+			}
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
+			// protected and creation properties are kept from the item
+			// being replaced
+			guard := newFieldGuard(rd, op, req)
+			stamp := newAuditStamp(op, req)
+			var existing interface{}
+			if guard != nil || stamp != nil {
+				existing = loadExisting(db, path, outParams)
+			}
+
+			val, err = guard.replace(val, existing)
+			if err != nil {
+				return accessErrorResponse(err)
+			}
+
+			if stamp != nil {
+				val, err = stamp.replace(val, existing)
+				if err != nil {
+					outerr, _ := json.Marshal(err.Error())
+					return 500, string(outerr)
+				}
+			}
+
+			val, err = stampOwner(path, owner, val)
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
 			q := QueryParams{
 				Path:       path,
 				PathParams: outParams,
 				Body:       val,
+				Version:    version,
+				Owner:      owner,
+				Context:    req.Context(),
 			}
 
 			doc, err := db.Update(q, PUT)
@@ -279,12 +551,16 @@ func addOperation(path string,
 				if err.Error() == NOTFOUNDERROR {
 					return 404, string(err.Error())
 				}
+				if err.Error() == PRECONDITIONFAILED {
+					return 412, string(err.Error())
+				}
 
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
 			}
+			publishChange(db, CHANGEUPDATE, FillPath(path, outParams), doc, owner)
 
-			out, err := json.Marshal(doc)
+			out, err := json.Marshal(guard.hide(doc))
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
@@ -292,7 +568,7 @@ func addOperation(path string,
 			return 200, string(out)
 		})
 	case "PATCH":
-		m.Patch(path, func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
+		m.Patch(path, describeRoute(template, op), traceOperation(template, op), limitRequests(rd, op), authenticate(rd, operationSecurity(rd, op)), authorizeRoles(rd, op), requireOwner(rd, op), func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
 			h := res.Header()
 
 			addHeaders(h, "Content-Type", produces)
@@ -311,24 +587,94 @@ func addOperation(path string,
 			}
 
 			path = strings.TrimPrefix(path, rd.BasePath)
+
+			h.Set("Accept-Patch", MERGEPATCH+", "+JSONPATCH)
+			format, err := patchFormat(req.Header.Get("Content-Type"))
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 415, string(outerr)
+			}
+
+			err = checkRootPointer(format, val)
+			if err == nil {
+				val, err = stripMetadata(format, val)
+			}
+			if patchErr, ok := err.(*PatchError); ok {
+				out, _ := json.Marshal(patchErr)
+				return 409, string(out)
+			}
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
+			owner := requestOwner(op, req)
+			err = checkWriteIntegrity(req.Context(), db, rd, path, patchIntegrityBody(format, val), owner)
+			if err != nil {
+				return integrityErrorResponse(err)
+			}
+
+			version, err := checkIfMatch(req.Context(), db, path, outParams, owner,
+				req.Header.Get(IFMATCH))
+			if err != nil && err.Error() == PRECONDITIONFAILED {
+				return 412, string(err.Error())
+			}
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
+			guard := newFieldGuard(rd, op, req)
+			val, err = guard.patch(format, val)
+			if err != nil {
+				return accessErrorResponse(err)
+			}
+
+			val, err = newAuditStamp(op, req).patch(format, val)
+			if err == nil {
+				val, err = checkOwnerPatch(path, owner, format, val)
+			}
+			if patchErr, ok := err.(*PatchError); ok {
+				out, _ := json.Marshal(patchErr)
+				return 409, string(out)
+			}
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
 			q := QueryParams{
-				Path:       path,
-				PathParams: outParams,
-				Body:       val,
+				Path:        path,
+				PathParams:  outParams,
+				Body:        val,
+				Version:     version,
+				PatchFormat: format,
+				Owner:       owner,
+				Context:     req.Context(),
 			}
 
 			doc, err := db.Update(q, PATCH)
 
-			if err.Error() == NOTFOUNDERROR {
+			if patchErr, ok := err.(*PatchError); ok {
+				out, _ := json.Marshal(patchErr)
+				return 409, string(out)
+			}
+
+			if err != nil && err.Error() == NOTFOUNDERROR {
 				return 404, string(err.Error())
 			}
 
+			if err != nil && err.Error() == PRECONDITIONFAILED {
+				return 412, string(err.Error())
+			}
+
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
 			}
+			publishChange(db, CHANGEUPDATE, FillPath(path, outParams), doc, owner)
 
-			out, err := json.Marshal(doc)
+			out, err := json.Marshal(guard.hide(doc))
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
@@ -336,7 +682,7 @@ func addOperation(path string,
 			return 200, string(out)
 		})
 	case "DELETE":
-		m.Delete(path, func(params martini.Params, db DbBackend, res http.ResponseWriter) (int, string) {
+		m.Delete(path, describeRoute(template, op), traceOperation(template, op), limitRequests(rd, op), authenticate(rd, operationSecurity(rd, op)), authorizeRoles(rd, op), requireOwner(rd, op), func(params martini.Params, req *http.Request, db DbBackend, res http.ResponseWriter) (int, string) {
 			h := res.Header()
 
 			addHeaders(h, "Content-Type", produces)
@@ -348,9 +694,41 @@ func addOperation(path string,
 			}
 
 			path = strings.TrimPrefix(path, rd.BasePath)
+
+			// relation policies are checked before the delete, so
+			// check the owner and version first
+			owner := requestOwner(op, req)
+			var version string
+			err = checkOwner(db, path, outParams, owner)
+			if err == nil {
+				version, err = checkIfMatch(req.Context(), db, path, outParams, owner,
+					req.Header.Get(IFMATCH))
+			}
+			if err != nil && err.Error() == NOTFOUNDERROR {
+				return 404, string(err.Error())
+			}
+			if err != nil && err.Error() == PRECONDITIONFAILED {
+				return 412, string(err.Error())
+			}
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+
+			// refuse to break references to the resource, and clean
+			// them up once it's gone
+			plan, err := planDeleteIntegrity(req.Context(), db, rd, path, outParams, owner)
+			if err != nil {
+				return integrityErrorResponse(err)
+			}
+
 			q := QueryParams{
 				Path:       path,
 				PathParams: outParams,
+				Version:    version,
+				SoftDelete: op.SoftDelete,
+				Owner:      owner,
+				Context:    req.Context(),
 			}
 			err = db.Remove(q)
 
@@ -358,6 +736,17 @@ func addOperation(path string,
 				return 404, string(err.Error())
 			}
 
+			if err != nil && err.Error() == PRECONDITIONFAILED {
+				return 412, string(err.Error())
+			}
+
+			if err != nil {
+				outerr, _ := json.Marshal(err.Error())
+				return 500, string(outerr)
+			}
+			publishChange(db, CHANGEDELETE, FillPath(path, outParams), nil, owner)
+
+			err = plan.apply(req.Context(), db, rd)
 			if err != nil {
 				outerr, _ := json.Marshal(err.Error())
 				return 500, string(outerr)
@@ -366,7 +755,7 @@ func addOperation(path string,
 		})
 
 	case "OPTIONS":
-		m.Options(path, func(db DbBackend, res http.ResponseWriter) (int, string) {
+		m.Options(path, describeRoute(template, op), traceOperation(template, op), func(db DbBackend, res http.ResponseWriter) (int, string) {
 			h := res.Header()
 
 			addHeaders(h, "Content-Type", produces)
@@ -407,7 +796,14 @@ func coerceParam(sentParams martini.Params,
 					}
 					outParams[key] = val
 				case "number":
-					val, parseErr := strconv.ParseFloat(sentParam, 32)
+					val, parseErr := strconv.ParseFloat(sentParam, 64)
+					if parseErr != nil {
+						err = parseErr
+						return
+					}
+					outParams[key] = val
+				case "boolean":
+					val, parseErr := strconv.ParseBool(sentParam)
 					if parseErr != nil {
 						err = parseErr
 						return
@@ -441,9 +837,12 @@ func coerceQueryParam(sentParams url.Values,
 
 	for key := range sentParams {
 		present := false
+
+		// filters in OR groups use the same parameter definitions
+		name := stripFilterGroup(key)
 		for _, apiParam := range apiPathParams {
 
-			if key == apiParam.Name {
+			if name == apiParam.Name {
 				present = true
 				sentParam := sentParams.Get(key)
 
@@ -472,7 +871,7 @@ func coerceQueryParam(sentParams url.Values,
 
 					outParams[key] = val
 				case "number":
-					val, parseErr := strconv.ParseFloat(sentParam, 32)
+					val, parseErr := strconv.ParseFloat(sentParam, 64)
 					if parseErr != nil {
 						err = parseErr
 						return
@@ -486,6 +885,14 @@ func coerceQueryParam(sentParams url.Values,
 
 					outParams[key] = val
 
+				case "array":
+					vals, arrErr := coerceArrayParam(apiParam, key, sentParam)
+					if arrErr != nil {
+						err = arrErr
+						return
+					}
+					outParams[key] = vals
+
 				default:
 					strEnumErr := checkStrEnum(apiParam, key, sentParam)
 					if strEnumErr != nil {
@@ -509,6 +916,95 @@ func coerceQueryParam(sentParams url.Values,
 
 }
 
+// coerceArrayParam splits an array query parameter using its collection
+// format, and coerces each item to the type of the array's items.
+func coerceArrayParam(apiParam *Parameter, paramName string,
+	sentParam string) ([]interface{}, error) {
+
+	sep := ","
+	switch apiParam.CollectionFormat {
+	case "ssv":
+		sep = " "
+	case "tsv":
+		sep = "\t"
+	case "pipes":
+		sep = "|"
+	}
+
+	out := make([]interface{}, 0)
+	if apiParam.Items == nil {
+		for _, item := range strings.Split(sentParam, sep) {
+			out = append(out, item)
+		}
+		return out, nil
+	}
+
+	// the item definition is checked like a parameter of its own
+	itemParam := &Parameter{
+		Type: apiParam.Items.Type,
+		Enum: apiParam.Items.Enum,
+	}
+
+	for _, item := range strings.Split(sentParam, sep) {
+		item = strings.TrimSpace(item)
+		switch itemParam.Type {
+		case "integer":
+			val, err := strconv.ParseInt(item, 10, 0)
+			if err != nil {
+				return out, err
+			}
+			err = checkIntEnum(itemParam, paramName, val)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, val)
+		case "number":
+			val, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				return out, err
+			}
+			err = checkFloatEnum(itemParam, paramName, val)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, val)
+		case "boolean":
+			val, err := strconv.ParseBool(item)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, val)
+		default:
+			err := checkStrEnum(itemParam, paramName, item)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, item)
+		}
+	}
+	return out, nil
+}
+
+// stringList returns the items of a coerced array parameter as strings.
+func stringList(val interface{}) []string {
+	out := make([]string, 0)
+	switch v := val.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if str, ok := item.(string); ok && str != "" {
+				out = append(out, str)
+			}
+		}
+	case string:
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
+
 func checkStrEnum(apiParam *Parameter, paramName string, sentParam string) error {
 	if len(apiParam.Enum) == 0 {
 		return nil
@@ -576,7 +1072,7 @@ func checkBounds(apiParam *Parameter, paramName string, sentParam string) error
 		return nil
 	}
 
-	val, parseErr := strconv.ParseFloat(sentParam, 32)
+	val, parseErr := strconv.ParseFloat(sentParam, 64)
 
 	if parseErr != nil {
 		return parseErr
@@ -610,6 +1106,38 @@ func checkBounds(apiParam *Parameter, paramName string, sentParam string) error
 
 }
 
+// patchFormat returns the format of a PATCH body from its Content-Type.
+// Plain JSON (or no Content-Type) is treated as a merge patch.
+func patchFormat(contentType string) (string, error) {
+	if contentType == "" {
+		return MERGEPATCH, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+
+	switch mediaType {
+	case MERGEPATCH, JSONPATCH:
+		return mediaType, nil
+	case "application/json":
+		return MERGEPATCH, nil
+	}
+	return "", errors.New("The content type " + mediaType + " can't be used to patch.")
+}
+
+// integrityErrorResponse returns a 409 and the offending references for
+// integrity errors, and a 500 for anything else.
+func integrityErrorResponse(err error) (int, string) {
+	if integrityErr, ok := err.(*IntegrityError); ok {
+		out, _ := json.Marshal(integrityErr)
+		return 409, string(out)
+	}
+	outerr, _ := json.Marshal(err.Error())
+	return 500, string(outerr)
+}
+
 func addHeaders(h http.Header, headerType string, headArray []string) {
 	for _, head := range headArray {
 		h.Add(headerType, head)
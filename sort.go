@@ -0,0 +1,148 @@
+package dragonfruit
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	SORT = "sort"
+)
+
+// SortResults sorts a set of results by one or more fields.  Backends which
+// can't sort natively use this so that results are ordered the same way
+// everywhere.
+func SortResults(results []interface{}, fields []SortField) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return LessByFields(results[i], results[j], fields)
+	})
+}
+
+// LessByFields reports whether document a sorts before document b.
+func LessByFields(a interface{}, b interface{}, fields []SortField) bool {
+	docA, _ := a.(map[string]interface{})
+	docB, _ := b.(map[string]interface{})
+
+	for _, field := range fields {
+		cmp := CompareValues(docA[field.Name], docB[field.Name])
+		if field.Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
+
+// CompareValues compares two values from a document, returning -1, 0 or 1.
+// Values are ordered the way CouchDB collates view keys: nulls, then
+// booleans (false first), then numbers, then strings.  Strings are compared
+// case-insensitively first, with lower case letters sorting before upper
+// case ones.
+func CompareValues(a interface{}, b interface{}) int {
+	rankA, rankB := collationRank(a), collationRank(b)
+	if rankA != rankB {
+		return compareInts(rankA, rankB)
+	}
+
+	switch va := a.(type) {
+	case bool:
+		vb := b.(bool)
+		if va == vb {
+			return 0
+		}
+		if !va {
+			return -1
+		}
+		return 1
+	case float64, int64, int:
+		fa, fb := toFloat(a), toFloat(b)
+		if fa < fb {
+			return -1
+		}
+		if fa > fb {
+			return 1
+		}
+		return 0
+	case string:
+		vb := b.(string)
+		cmp := strings.Compare(strings.ToLower(va), strings.ToLower(vb))
+		if cmp != 0 {
+			return cmp
+		}
+		// lower case first
+		return -strings.Compare(va, vb)
+	}
+	return 0
+}
+
+// collationRank returns the position of a value's type in the collation
+// order.
+func collationRank(val interface{}) int {
+	switch val.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64, int64, int:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+func compareInts(a int, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func toFloat(val interface{}) float64 {
+	switch v := val.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+// parseSort parses a sort query parameter (e.g. -createdAt,name) and checks
+// each key against the values allowed by the operation's sort parameter.
+func parseSort(val interface{}, op *Operation) ([]SortField, error) {
+	out := make([]SortField, 0)
+
+	var allowed []interface{}
+	for _, param := range op.Parameters {
+		if param.Name == SORT && param.Items != nil {
+			allowed = param.Items.Enum
+		}
+	}
+
+	for _, key := range stringList(val) {
+		valid := false
+		for _, a := range allowed {
+			if a == key {
+				valid = true
+			}
+		}
+		if !valid {
+			return out, errors.New("The results cannot be sorted by " + key + ".")
+		}
+
+		out = append(out, SortField{
+			Name:       strings.TrimPrefix(key, "-"),
+			Descending: strings.HasPrefix(key, "-"),
+		})
+	}
+	return out, nil
+}
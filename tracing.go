@@ -0,0 +1,167 @@
+package dragonfruit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingConf configures where the spans of requests are exported to.
+type TracingConf struct {
+	// the OTLP/HTTP traces endpoint (e.g. http://localhost:4318/v1/traces)
+	Endpoint string `json:"endpoint"`
+	// headers sent with each export to the endpoint (e.g. an API key)
+	Headers map[string]string `json:"headers"`
+	// write spans as JSON to stdout, stderr or a file
+	File string `json:"file"`
+	// the service.name of exported spans (defaults to dragonfruit)
+	ServiceName string `json:"serviceName"`
+}
+
+// the name spans of the frontend and backends are made under
+const tracerName = "github.com/dragonfruit-api/dragonfruit"
+
+// tracer makes the spans of the frontend and backends.  Until tracing is set
+// up (see TracingConf), the global tracer provider makes spans which aren't
+// recorded.
+var tracer = otel.Tracer(tracerName)
+
+// StartSpan starts a span, as a child of the span of a context (or else as
+// the root of a new trace), and returns a context holding it.  Callers end
+// the span with defer (e.g. defer span.End()).
+func StartSpan(ctx context.Context, name string,
+	opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// StartBackendCall starts a backend call, named after the DbBackend method,
+// and returns a context holding its span, for the calls the backend makes
+// while serving it, and a func which ends the call and records its timing
+// (see TimeBackend).  Backends call it first thing, e.g.
+//
+//	ctx, finish := dragonfruit.StartBackendCall(params.Context, "Query", params.Path)
+//	defer finish()
+func StartBackendCall(ctx context.Context, call string, path string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := StartSpan(ctx, call,
+		trace.WithAttributes(attribute.String("dragonfruit.path", path)))
+	return ctx, func() {
+		span.End()
+		TimeBackend(ctx, call, path, start)
+	}
+}
+
+// InjectTrace sets the trace context headers (i.e. traceparent) of the span
+// a context belongs to on a request made to another service, so its spans
+// join the trace.
+func InjectTrace(ctx context.Context, header http.Header) {
+	if ctx == nil {
+		return
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// setUpTracing sets up the global tracer provider with the exporters of a
+// tracing configuration, and continues the W3C trace context of requests.
+func setUpTracing(cnf *TracingConf) error {
+	serviceName := cnf.ServiceName
+	if serviceName == "" {
+		serviceName = "dragonfruit"
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(sdkresource.NewSchemaless(
+			attribute.String("service.name", serviceName))),
+	}
+
+	if cnf.File != "" {
+		w, err := openLogFile(cnf.File)
+		if err != nil {
+			return err
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+	if cnf.Endpoint != "" {
+		exp, err := otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(cnf.Endpoint),
+			otlptracehttp.WithHeaders(cnf.Headers))
+		if err != nil {
+			return err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(opts...))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// traceOperation returns a handler which traces the requests of an
+// operation, continuing the trace of the caller's traceparent header.  The
+// spans of backend calls made while serving the request are its children.
+func traceOperation(path string, op *Operation) martini.Handler {
+	return func(c martini.Context, req *http.Request, res http.ResponseWriter) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(),
+			propagation.HeaderCarrier(req.Header))
+		attrs := []attribute.KeyValue{
+			attribute.String("http.request.method", req.Method),
+			attribute.String("http.route", path),
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("dragonfruit.request_id", GetRequestID(ctx)),
+		}
+		if op != nil {
+			attrs = append(attrs, attribute.String("dragonfruit.operation_id", op.OperationID))
+		}
+		ctx, span := StartSpan(ctx, req.Method+" "+path,
+			trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+		if !span.IsRecording() {
+			span.End()
+			return
+		}
+		if entry, ok := ctx.Value(logEntryKey{}).(*LogEntry); ok {
+			entry.TraceID = span.SpanContext().TraceID().String()
+		}
+		c.Map(req.WithContext(ctx))
+
+		defer func() {
+			panicked := recover()
+			status := 200
+			if rw, ok := res.(martini.ResponseWriter); ok && rw.Status() != 0 {
+				status = rw.Status()
+			}
+			if panicked != nil {
+				status = 500
+				err := fmt.Errorf("panic: %v", panicked)
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			} else if status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			span.End()
+			if panicked != nil {
+				panic(panicked)
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,278 @@
+package dragonfruit
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gedex/inflector"
+)
+
+// The trash path segment (e.g. GET /people/_trash lists deleted people and
+// POST /people/_trash/4 restores one).
+const TRASH = "_trash"
+
+// METADATA is the reserved property holding what the frontend records about
+// a document or sub-document, and DELETEDAT is the property inside it which
+// marks soft deleted items.  Clients can't write METADATA.  DELETEDAT starts
+// with an underscore so it can't clash with model properties; CouchDB only
+// reserves those at the top level of documents.
+const (
+	METADATA  = "dragonfruit"
+	DELETEDAT = "_deletedAt"
+)
+
+// A Trasher is a backend which can soft delete documents.  Removals with
+// SoftDelete set mark documents (or sub-documents) as deleted instead of
+// removing them, and marked documents are left out of queries until they're
+// restored.  Backends which don't implement it remove documents for good.
+type Trasher interface {
+	// Trash lists the soft deleted items of the collection at the Path of
+	// a QueryParams struct.
+	Trash(QueryParams) (Container, error)
+
+	// Restore un-deletes the soft deleted item at the Path of a
+	// QueryParams struct and returns it.
+	Restore(QueryParams) (interface{}, error)
+}
+
+// IsTrashed reports whether a document has been soft deleted.
+func IsTrashed(doc interface{}) bool {
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	meta, ok := d[METADATA].(map[string]interface{})
+	return ok && meta[DELETEDAT] != nil
+}
+
+// MarkTrashed marks a document as soft deleted, with the current time.
+func MarkTrashed(doc map[string]interface{}) {
+	meta, ok := doc[METADATA].(map[string]interface{})
+	if !ok {
+		meta = make(map[string]interface{})
+		doc[METADATA] = meta
+	}
+	meta[DELETEDAT] = time.Now().UTC().Format(time.RFC3339)
+}
+
+// UnmarkTrashed removes the soft delete marker of a document.
+func UnmarkTrashed(doc map[string]interface{}) {
+	meta, ok := doc[METADATA].(map[string]interface{})
+	if !ok {
+		return
+	}
+	delete(meta, DELETEDAT)
+	if len(meta) == 0 {
+		delete(doc, METADATA)
+	}
+}
+
+// removeMetadata removes the METADATA property from a client's document, at
+// any depth.
+func removeMetadata(doc interface{}) interface{} {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		delete(d, METADATA)
+		for key, val := range d {
+			d[key] = removeMetadata(val)
+		}
+	case []interface{}:
+		for i, val := range d {
+			d[i] = removeMetadata(val)
+		}
+	}
+	return doc
+}
+
+// stripMetadata removes the METADATA property from a request body, so
+// clients can't mark items as soft deleted.  JSON patches have it removed
+// from their values, and return a PatchError if they point into it.  Bodies
+// which can't be decoded are left for the backend to reject.
+func stripMetadata(format string, body []byte) ([]byte, error) {
+	if format != JSONPATCH {
+		var doc interface{}
+		if json.Unmarshal(body, &doc) != nil {
+			return body, nil
+		}
+		return json.Marshal(removeMetadata(doc))
+	}
+
+	var ops []PatchOperation
+	if json.Unmarshal(body, &ops) != nil {
+		return body, nil
+	}
+	for i, op := range ops {
+		for _, pointer := range []string{op.Path, op.From} {
+			segments, err := parsePointer(pointer)
+			if err != nil {
+				continue
+			}
+			for _, segment := range segments {
+				if segment == METADATA {
+					return body, newPatchError("The property " + METADATA + " is read only.")
+				}
+			}
+		}
+		ops[i].Value = removeMetadata(op.Value)
+	}
+	return json.Marshal(ops)
+}
+
+// RemoveTrashed removes soft deleted sub-documents from a document, at any
+// depth.  The document itself is kept even if it has been soft deleted.
+func RemoveTrashed(doc interface{}) interface{} {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		for key, val := range d {
+			if IsTrashed(val) {
+				delete(d, key)
+				continue
+			}
+			d[key] = RemoveTrashed(val)
+		}
+	case []interface{}:
+		out := make([]interface{}, 0, len(d))
+		for _, val := range d {
+			if !IsTrashed(val) {
+				out = append(out, RemoveTrashed(val))
+			}
+		}
+		return out
+	}
+	return doc
+}
+
+// makeTrashAPIs creates the trash APIs of a collection.  Two paths are
+// created:
+// /{collection}/_trash (GET to list deleted items)
+// /{collection}/_trash/{id} (POST to restore an item)
+func makeTrashAPIs(collectionPath string, schemaName string, idName string,
+	idparam *Parameter, upstreamParams []*Parameter, cnf Conf) map[string]*PathItem {
+
+	out := make(map[string]*PathItem)
+	pluralName := inflector.Pluralize(inflector.Singularize(schemaName))
+
+	getOp := &Operation{
+		OperationID: "get" + schemaName + "Trash",
+		Summary:     "Get deleted " + pluralName + ".",
+		Description: "Deleted items include the time they were deleted in " + METADATA + "." + DELETEDAT + ".",
+		Responses:   copyResponseMap(cnf.CommonCollectionResponses),
+		Trash:       schemaName,
+	}
+	getOp.Responses["200"] = &Response{
+		Schema:      &Schema{Ref: MakeRef(schemaName + strings.Title(ContainerName))},
+		Description: "A collection of deleted " + pluralName,
+	}
+	getOp.Parameters = append(getOp.Parameters, getCommonGetParams(cnf)...)
+	getOp.Parameters = append(getOp.Parameters, upstreamParams...)
+
+	out[collectionPath+"/"+TRASH] = &PathItem{
+		Get:     getOp,
+		Options: makeOptionsOperation("GET", upstreamParams),
+	}
+
+	restoreParams := append(append([]*Parameter{}, upstreamParams...), idparam)
+	restoreOp := &Operation{
+		OperationID: "restore" + schemaName,
+		Summary:     "Restore a deleted " + schemaName + " object.",
+		Responses:   copyResponseMap(cnf.CommonSingleResponses),
+		Trash:       schemaName,
+	}
+	restoreOp.Responses["200"] = &Response{
+		Schema:      &Schema{Ref: MakeRef(schemaName)},
+		Description: "The restored " + schemaName,
+	}
+	restoreOp.Parameters = append(restoreOp.Parameters, restoreParams...)
+
+	out[collectionPath+"/"+TRASH+"/{"+idName+"}"] = &PathItem{
+		Post:    restoreOp,
+		Options: makeOptionsOperation("POST", restoreParams),
+	}
+
+	return out
+}
+
+// isSoftDelete reports whether DELETE operations on a (Martini formatted)
+// path soft delete.
+func isSoftDelete(rd *Swagger, path string) bool {
+	for p, pathitem := range rd.Paths {
+		if TranslatePath(p) == path && pathitem.Delete != nil {
+			return pathitem.Delete.SoftDelete
+		}
+	}
+	return false
+}
+
+// serveTrash lists the soft deleted items of a collection for the frontend.
+// path is the (Martini formatted) path of the trash API.
+func serveTrash(db DbBackend, path string, pathParams map[string]interface{},
+	qParams map[string]interface{}, guard *fieldGuard, owner string,
+	ctx context.Context) (int, string) {
+
+	trasher, ok := db.(Trasher)
+	if !ok {
+		outerr, _ := json.Marshal("The backend doesn't support soft deletes.")
+		return 501, string(outerr)
+	}
+
+	result, err := trasher.Trash(QueryParams{
+		Path:        strings.TrimSuffix(path, "/"+TRASH),
+		PathParams:  pathParams,
+		QueryParams: qParams,
+		Trash:       true,
+		Owner:       owner,
+		Context:     ctx,
+	})
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+	guard.hideResults(&result)
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+	return 200, string(out)
+}
+
+// serveRestore restores a soft deleted item for the frontend.  path is the
+// (Martini formatted) path of the restore API.
+func serveRestore(db DbBackend, path string,
+	pathParams map[string]interface{}, guard *fieldGuard, owner string,
+	ctx context.Context) (int, string) {
+
+	trasher, ok := db.(Trasher)
+	if !ok {
+		outerr, _ := json.Marshal("The backend doesn't support soft deletes.")
+		return 501, string(outerr)
+	}
+
+	itemPath := strings.Replace(path, "/"+TRASH, "", 1)
+	doc, err := trasher.Restore(QueryParams{
+		Path:       itemPath,
+		PathParams: pathParams,
+		Trash:      true,
+		Owner:      owner,
+		Context:    ctx,
+	})
+	if err != nil && err.Error() == NOTFOUNDERROR {
+		return 404, string(err.Error())
+	}
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+	// restored items reappear in the collection
+	publishChange(db, CHANGEINSERT, FillPath(itemPath, pathParams), doc, owner)
+
+	out, err := json.Marshal(guard.hide(doc))
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+	return 200, string(out)
+}
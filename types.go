@@ -20,6 +20,56 @@ type Conf struct {
 	DbServer                  string               `json:"dbserver"`
 	DbPort                    string               `json:"dbport"`
 	StaticDirs                []string             `json:"staticDirs"`
+	// expose arrays of primitive values (e.g. tags) as sub-resources
+	PrimitiveSubResources bool `json:"primitiveSubResources"`
+	// properties used for full-text search, keyed by model name
+	// (models which aren't listed search all of their string properties)
+	SearchFields map[string][]string `json:"searchFields"`
+	// mark deleted items instead of removing them, so they can be listed
+	// and restored through /{collection}/_trash
+	SoftDelete bool `json:"softDelete"`
+	// add createdAt, updatedAt, createdBy and updatedBy properties to every
+	// model, set by the frontend when items are written
+	Audit bool `json:"audit"`
+	// the security requirements of every generated operation, naming
+	// schemes in the securityDefinitions of the swagger template
+	// (e.g. [{"apiKey": []}, {"oauth": ["write"]}])
+	Security []map[string][]string `json:"security"`
+	// the API keys accepted by apiKey schemes, mapped to the user they
+	// identify
+	APIKeys map[string]string `json:"apiKeys"`
+	// the users and passwords accepted by basic schemes
+	BasicUsers map[string]string `json:"basicUsers"`
+	// the key used to validate the bearer tokens (JWTs) of oauth2 schemes:
+	// a secret for HS256 tokens, or a PEM encoded public key for RS256
+	// tokens
+	JWTKey string `json:"jwtKey"`
+	// the roles of users, on top of the roles claim of bearer tokens
+	UserRoles map[string][]string `json:"userRoles"`
+	// the roles which may call operations, keyed by method and path
+	// (e.g. "DELETE /people/{id}")
+	OperationRoles map[string][]string `json:"operationRoles"`
+	// the roles which may manage webhooks (defaults to ADMINROLE)
+	AdminRoles []string `json:"adminRoles"`
+	// the roles which can't see or write properties, keyed by model and
+	// property name
+	FieldAccess map[string]map[string]*FieldAccess `json:"fieldAccess"`
+	// limit users to the items they created: top-level models get an owner
+	// property set to the authenticated user, and every operation only
+	// sees the user's items
+	Ownership bool `json:"ownership"`
+	// the CORS policy of the API (defaults to allowing any origin)
+	CORS *CORSConf `json:"cors"`
+	// the rate limit of every generated operation, per client
+	RateLimit *RateLimit `json:"rateLimit"`
+	// the rate limits of single operations, keyed by method and path
+	// (e.g. "POST /people")
+	OperationRateLimits map[string]*RateLimit `json:"operationRateLimits"`
+	// write a JSON log entry for every request to stdout, stderr or a
+	// file (more sinks can be added with AddLogSink)
+	AccessLog string `json:"accessLog"`
+	// export the spans of requests and backend calls
+	Tracing *TracingConf `json:"tracing"`
 }
 
 // Describes a Swagger-doc resource description
@@ -43,7 +93,7 @@ type Swagger struct {
 	Parameters          map[string]*Parameter      `json:"parameters,omitempty"`
 	Responses           map[string]*Response       `json:"responses,omitempty"`
 	SecurityDefinitions map[string]*SecurityScheme `json:"securityDefinitions,omitempty"`
-	Security            map[string][]string        `json:"security,omitempty"`
+	Security            []map[string][]string      `json:"security,omitempty"`
 	Tags                []*Tag                     `json:"tags,omitempty"`
 	ExternalDocs        *ExternalDoc               `json:"externalDocs,omitempty"`
 }
@@ -113,6 +163,13 @@ type Schema struct {
 
 	Discriminator string `json:"discriminator,omitempty"`
 	ReadOnly      bool   `json:"readOnly,omitempty"`
+	// links to other top-level resources (vendor extension)
+	Relations []*Relation `json:"x-relations,omitempty"`
+	// properties used for full-text search (vendor extension)
+	SearchFields []string `json:"x-searchFields,omitempty"`
+	// the roles which can't see or write the property (vendor extensions)
+	HiddenFrom  []string `json:"x-hiddenFrom,omitempty"`
+	ReadOnlyFor []string `json:"x-readOnlyFor,omitempty"`
 	// parameters fields -
 	// properties and params share a bunch of fields
 	XML          *XMLRef      `json:"xml,omitempty"`
@@ -135,23 +192,77 @@ type XMLRef struct {
 	db.Save(SwaggerResourceDB, docname, r)
 }*/
 
-// Describes an authorization option for a resource (not implemented yet)
-type Authorization struct{}
+// Describes the credentials which authorized a request (see
+// GetAuthorization)
+type Authorization struct {
+	// the security scheme which accepted the credentials
+	Scheme string `json:"scheme"`
+	// the user identified by the credentials
+	User string `json:"user"`
+	// the roles of the user (see Conf.UserRoles)
+	Roles []string `json:"roles,omitempty"`
+	// the scopes granted to bearer tokens
+	Scopes []string `json:"scopes,omitempty"`
+	// the claims of bearer tokens
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
 
 // Describes an operation (e.g. a GET, PUT or POST operation)
 type Operation struct {
-	Tags         []string             `json:"tags,omitempty"`
-	Summary      string               `json:"summary,omitempty"`
-	Description  string               `json:"description,omitempty"`
-	ExternalDocs *ExternalDoc         `json:"externalDocs,omitempty"`
-	OperationID  string               `json:"operationId,omitempty"`
-	Produces     []string             `json:"produces,omitempty"`
-	Consumes     []string             `json:"consumes,omitempty"`
-	Parameters   []*Parameter         `json:"parameters,omitempty"`
-	Responses    map[string]*Response `json:"responses"`
-	Schemes      []string             `json:"schemes,omitempty"`
-	Deprecated   bool                 `json:"deprecated,omitempty"`
-	Security     map[string][]string  `json:"authorizations,omitempty"`
+	Tags         []string              `json:"tags,omitempty"`
+	Summary      string                `json:"summary,omitempty"`
+	Description  string                `json:"description,omitempty"`
+	ExternalDocs *ExternalDoc          `json:"externalDocs,omitempty"`
+	OperationID  string                `json:"operationId,omitempty"`
+	Produces     []string              `json:"produces,omitempty"`
+	Consumes     []string              `json:"consumes,omitempty"`
+	Parameters   []*Parameter          `json:"parameters,omitempty"`
+	Responses    map[string]*Response  `json:"responses"`
+	Schemes      []string              `json:"schemes,omitempty"`
+	Deprecated   bool                  `json:"deprecated,omitempty"`
+	Security     []map[string][]string `json:"security,omitempty"`
+	// set on navigation operations (e.g. /orders/{id}/customer)
+	Relation *Relation `json:"x-relation,omitempty"`
+	// the model counted by aggregation operations (e.g. /orders/_aggregate)
+	Aggregate string `json:"x-aggregate,omitempty"`
+	// the model written by bulk operations (e.g. /orders/_bulk)
+	Bulk string `json:"x-bulk,omitempty"`
+	// set on DELETE operations which only mark items as deleted
+	SoftDelete bool `json:"x-softDelete,omitempty"`
+	// the model listed or restored by trash operations
+	// (e.g. /orders/_trash)
+	Trash string `json:"x-trash,omitempty"`
+	// set on write operations which set audit properties
+	Audit bool `json:"x-audit,omitempty"`
+	// the model streamed by change feeds (e.g. /orders/_changes)
+	Changes string `json:"x-changes,omitempty"`
+	// the roles which may call the operation (any role if empty)
+	Roles []string `json:"x-roles,omitempty"`
+	// set on operations which only see the authenticated user's items
+	Owned bool `json:"x-owned,omitempty"`
+	// the requests each client can make to the operation
+	RateLimit *RateLimit `json:"x-rateLimit,omitempty"`
+}
+
+// Describes a link from a property of one resource to another top-level
+// resource (e.g. order.customerId refers to /customers/{customerId}).
+type Relation struct {
+	// the name used for navigation paths and expansion (e.g. customer)
+	Name string `json:"name"`
+	// the property holding the related resource's ID (e.g. customerId)
+	Property string `json:"property"`
+	// the related model (e.g. Customer)
+	Model string `json:"model"`
+	// the path of the related collection (e.g. /customers)
+	Path string `json:"path"`
+	// the ID parameter of the related resource (e.g. customerId)
+	Param string `json:"param"`
+	// inferred relations were found by property naming, not declared
+	Inferred bool `json:"inferred,omitempty"`
+	// what happens to this resource when the related resource is deleted
+	// (restrict, cascade or set-null).  Relations with a policy are also
+	// checked when this resource is written.
+	OnDelete string `json:"onDelete,omitempty"`
 }
 
 // Describes a parameter
@@ -0,0 +1,532 @@
+package dragonfruit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+)
+
+// The webhook admin path and the headers sent with each delivery.  The
+// signature is the hex encoded HMAC-SHA256 of the body, keyed with the
+// webhook's secret (see VerifyWebhookSignature).
+const (
+	WEBHOOKS          = "/_webhooks"
+	WEBHOOKSIGNATURE  = "X-Dragonfruit-Signature"
+	WEBHOOKEVENT      = "X-Dragonfruit-Event"
+	WEBHOOKDELIVERYID = "X-Dragonfruit-Delivery"
+)
+
+// delivery settings: failed deliveries are retried with an exponential
+// backoff, and the most recent deliveries of each webhook are logged
+const (
+	webhookAttempts = 5
+	webhookTimeout  = 10 * time.Second
+	webhookLogSize  = 100
+)
+
+// webhookBackoff is the wait before the first retry of a failed delivery.
+// It doubles with each attempt.
+var webhookBackoff = time.Second
+
+// A Webhook subscribes a URL to the changes made to resources.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// the key used to sign deliveries (only returned when the webhook is
+	// created)
+	Secret string `json:"secret,omitempty"`
+	// the paths whose changes are sent, including their sub-resources
+	// (e.g. /people).  Empty sends every change.
+	Paths []string `json:"paths,omitempty"`
+	// the change types sent (insert, update or delete).  Empty sends
+	// every type.
+	Events []string `json:"events,omitempty"`
+	// the roles and owner of the user who added the webhook.  Deliveries
+	// are limited by them the same way change feeds are.
+	Roles []string `json:"roles,omitempty"`
+	Owner string   `json:"owner,omitempty"`
+}
+
+// matches reports whether a webhook subscribes to a change.
+func (w *Webhook) matches(ev *ChangeEvent) bool {
+	if len(w.Events) > 0 && !containsString(w.Events, ev.Type) {
+		return false
+	}
+	if len(w.Paths) == 0 {
+		return true
+	}
+	for _, path := range w.Paths {
+		path = strings.TrimSuffix(path, "/")
+		if ev.Path == path || strings.HasPrefix(ev.Path, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// A WebhookPayload is the body sent to a webhook.
+type WebhookPayload struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Path  string      `json:"path"`
+	Body  interface{} `json:"body,omitempty"`
+	Time  string      `json:"time"`
+}
+
+// A WebhookDelivery records the outcome of sending a payload to a webhook.
+type WebhookDelivery struct {
+	ID        string `json:"id"`
+	WebhookID string `json:"webhookId"`
+	Event     string `json:"event"`
+	Path      string `json:"path"`
+	Attempts  int    `json:"attempts"`
+	// the status code of the last attempt, if the webhook responded
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Delivered bool   `json:"delivered"`
+	Time      string `json:"time"`
+}
+
+// A WebhookStore is a backend which can store webhook subscriptions.
+// Backends which don't implement it keep them in memory.
+type WebhookStore interface {
+	LoadWebhooks() ([]*Webhook, error)
+	SaveWebhooks([]*Webhook) error
+}
+
+// webhookDispatcher holds the webhooks of the running API and their
+// delivery logs.
+type webhookDispatcher struct {
+	sync.Mutex
+	rd     *Swagger
+	hooks  []*Webhook
+	logs   map[string][]*WebhookDelivery
+	client *http.Client
+}
+
+// webhooks dispatches changes made through the frontend.
+var webhooks = &webhookDispatcher{
+	hooks:  make([]*Webhook, 0),
+	logs:   make(map[string][]*WebhookDelivery),
+	client: &http.Client{Timeout: webhookTimeout},
+}
+
+// load replaces the webhooks of the dispatcher with the ones stored by a
+// backend.
+func (wd *webhookDispatcher) load(db DbBackend) error {
+	store, ok := db.(WebhookStore)
+	if !ok {
+		return nil
+	}
+	hooks, err := store.LoadWebhooks()
+	if err != nil {
+		return err
+	}
+
+	wd.Lock()
+	defer wd.Unlock()
+	wd.hooks = hooks
+	return nil
+}
+
+// update changes the webhooks of the dispatcher and stores them.  The
+// change is rolled back if they can't be stored.
+func (wd *webhookDispatcher) update(db DbBackend, fn func([]*Webhook) []*Webhook) error {
+	wd.Lock()
+	defer wd.Unlock()
+
+	hooks := fn(append([]*Webhook{}, wd.hooks...))
+	if store, ok := db.(WebhookStore); ok {
+		err := store.SaveWebhooks(hooks)
+		if err != nil {
+			return err
+		}
+	}
+	wd.hooks = hooks
+	return nil
+}
+
+// list returns the webhooks of the dispatcher.
+func (wd *webhookDispatcher) list() []*Webhook {
+	wd.Lock()
+	defer wd.Unlock()
+	return append([]*Webhook{}, wd.hooks...)
+}
+
+// find returns a webhook of the dispatcher by ID, or nil.
+func (wd *webhookDispatcher) find(id string) *Webhook {
+	for _, hook := range wd.list() {
+		if hook.ID == id {
+			return hook
+		}
+	}
+	return nil
+}
+
+// dispatch sends a change to every webhook subscribed to it.  Webhooks
+// only get the changes to their owner's items, without the properties hidden
+// from their roles.  Deliveries are made in the background.
+func (wd *webhookDispatcher) dispatch(ev *ChangeEvent) {
+	for _, hook := range wd.list() {
+		if !hook.matches(ev) || (hook.Owner != "" && ev.Owner != hook.Owner) {
+			continue
+		}
+
+		id, err := newWebhookID()
+		if err != nil {
+			continue
+		}
+		payload := &WebhookPayload{
+			ID:    id,
+			Event: ev.Type,
+			Path:  ev.Path,
+			Body:  wd.hide(hook, ev),
+			Time:  time.Now().UTC().Format(time.RFC3339),
+		}
+		delivery := &WebhookDelivery{
+			ID:        payload.ID,
+			WebhookID: hook.ID,
+			Event:     ev.Type,
+			Path:      ev.Path,
+			Time:      payload.Time,
+		}
+		wd.record(delivery)
+		go wd.deliver(hook, payload, delivery)
+	}
+}
+
+// hide returns the document of a change without the properties hidden from
+// a webhook's roles.  Documents of paths without a known model aren't sent.
+func (wd *webhookDispatcher) hide(hook *Webhook, ev *ChangeEvent) interface{} {
+	if ev.Doc == nil || wd.rd == nil {
+		return ev.Doc
+	}
+	model := pathModel(wd.rd, ev.Path)
+	if model == "" {
+		return nil
+	}
+	g := &fieldGuard{rd: wd.rd, model: model, roles: hook.Roles}
+	return g.hide(ev.Doc)
+}
+
+// pathModel returns the model of the item at a URL path (e.g. Pet for
+// /people/4/pets/2), or an empty string.  Reserved paths are matched
+// before the path params they would otherwise match.
+func pathModel(rd *Swagger, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, template := range routeOrder(rd.Paths) {
+		pathitem := rd.Paths[template]
+		if pathitem.Get == nil || !matchTemplate(template, segments) {
+			continue
+		}
+		return operationModel(pathitem.Get)
+	}
+	return ""
+}
+
+// matchTemplate reports whether the segments of a URL path match a path
+// template (e.g. /people/{personId}).
+func matchTemplate(template string, segments []string) bool {
+	parts := strings.Split(strings.Trim(template, "/"), "/")
+	if len(parts) != len(segments) {
+		return false
+	}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") && part != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver sends a payload to a webhook, retrying failed attempts.  A
+// delivery succeeds when the webhook responds with a 2xx status.
+func (wd *webhookDispatcher) deliver(hook *Webhook, payload *WebhookPayload,
+	delivery *WebhookDelivery) {
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		wd.finish(delivery, 0, err)
+		return
+	}
+
+	wait := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		status, err := wd.send(hook, payload, body)
+		wd.Lock()
+		delivery.Attempts = attempt
+		delivery.Time = time.Now().UTC().Format(time.RFC3339)
+		wd.Unlock()
+
+		if err == nil && status >= 200 && status < 300 {
+			wd.finish(delivery, status, nil)
+			return
+		}
+		if err == nil {
+			err = errors.New("The webhook responded with " + http.StatusText(status) + ".")
+		}
+		wd.finish(delivery, status, err)
+
+		if attempt < webhookAttempts {
+			time.Sleep(wait)
+			wait = wait * 2
+		}
+	}
+}
+
+// send makes a single delivery attempt and returns the response status.
+func (wd *webhookDispatcher) send(hook *Webhook, payload *WebhookPayload,
+	body []byte) (int, error) {
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOKEVENT, payload.Event)
+	req.Header.Set(WEBHOOKDELIVERYID, payload.ID)
+	req.Header.Set(WEBHOOKSIGNATURE, SignWebhook(hook.Secret, body))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, nil
+}
+
+// record adds a delivery to the log of its webhook, dropping the oldest
+// deliveries once the log is full.
+func (wd *webhookDispatcher) record(delivery *WebhookDelivery) {
+	wd.Lock()
+	defer wd.Unlock()
+	log := append(wd.logs[delivery.WebhookID], delivery)
+	if len(log) > webhookLogSize {
+		log = log[len(log)-webhookLogSize:]
+	}
+	wd.logs[delivery.WebhookID] = log
+}
+
+// finish records the outcome of a delivery attempt.
+func (wd *webhookDispatcher) finish(delivery *WebhookDelivery, status int, err error) {
+	wd.Lock()
+	defer wd.Unlock()
+	delivery.Status = status
+	delivery.Delivered = err == nil
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+}
+
+// deliveries returns the logged deliveries of a webhook, newest first.
+func (wd *webhookDispatcher) deliveries(id string) []WebhookDelivery {
+	wd.Lock()
+	defer wd.Unlock()
+	log := wd.logs[id]
+	out := make([]WebhookDelivery, 0, len(log))
+	for i := len(log) - 1; i >= 0; i-- {
+		out = append(out, *log[i])
+	}
+	return out
+}
+
+// SignWebhook returns the signature of a webhook body.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the signature header of a delivery, for
+// services receiving webhooks.
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
+
+// newWebhookID returns a random ID for webhooks, secrets and deliveries.
+func newWebhookID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// containsString reports whether a list of strings contains a value.
+func containsString(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// redactWebhook returns a copy of a webhook without its secret.
+func redactWebhook(hook *Webhook) *Webhook {
+	out := *hook
+	out.Secret = ""
+	return &out
+}
+
+// validateWebhook checks a new webhook sent to the admin API.
+func validateWebhook(hook *Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("The webhook URL must be an absolute http or https URL.")
+	}
+	for _, event := range hook.Events {
+		switch event {
+		case CHANGEINSERT, CHANGEUPDATE, CHANGEDELETE:
+		default:
+			return errors.New("The event " + event + " is not valid.")
+		}
+	}
+	return nil
+}
+
+// ServeWebhookAdmin sets up the admin API used to manage webhooks:
+// /_webhooks (GET to list webhooks, POST to add one)
+// /_webhooks/{id} (GET, DELETE)
+// /_webhooks/{id}/deliveries (GET the delivery log)
+// Only users with an admin role (see Conf.AdminRoles) can use it, and it
+// isn't served without security requirements (see adminSecurity), since
+// anyone could then subscribe to every change.  Any handlers passed run
+// before each endpoint, after the role checks.
+func ServeWebhookAdmin(m *martini.ClassicMartini, db DbBackend, rd *Swagger, cnf Conf,
+	handlers ...martini.Handler) {
+
+	security := adminSecurity(rd, cnf)
+	if len(security) == 0 {
+		return
+	}
+	admin := &Operation{
+		Security: security,
+		Roles:    cnf.AdminRoles,
+		Owned:    cnf.Ownership,
+	}
+	if len(admin.Roles) == 0 {
+		admin.Roles = []string{ADMINROLE}
+	}
+	handlers = append([]martini.Handler{authenticate(rd, security), authorizeRoles(rd, admin),
+		requireOwner(rd, admin)}, handlers...)
+
+	webhooks.rd = rd
+	err := webhooks.load(db)
+	if err != nil {
+		panic(err)
+	}
+
+	m.Get(WEBHOOKS, withHandlers(handlers, func(res http.ResponseWriter) (int, string) {
+		res.Header().Set("Content-Type", "application/json;charset=utf-8")
+		out := make([]*Webhook, 0)
+		for _, hook := range webhooks.list() {
+			out = append(out, redactWebhook(hook))
+		}
+		return jsonResponse(200, out)
+	})...)
+
+	m.Post(WEBHOOKS, withHandlers(handlers, func(req *http.Request, res http.ResponseWriter) (int, string) {
+		res.Header().Set("Content-Type", "application/json;charset=utf-8")
+		hook := &Webhook{}
+		err := json.NewDecoder(req.Body).Decode(hook)
+		if err == nil {
+			err = validateWebhook(hook)
+		}
+		if err != nil {
+			outerr, _ := json.Marshal(err.Error())
+			return 409, string(outerr)
+		}
+
+		hook.ID, err = newWebhookID()
+		if err == nil && hook.Secret == "" {
+			hook.Secret, err = newWebhookID()
+		}
+		if err != nil {
+			outerr, _ := json.Marshal(err.Error())
+			return 500, string(outerr)
+		}
+		hook.Roles = requestRoles(req)
+		hook.Owner = requestOwner(admin, req)
+		err = webhooks.update(db, func(hooks []*Webhook) []*Webhook {
+			return append(hooks, hook)
+		})
+		if err != nil {
+			outerr, _ := json.Marshal(err.Error())
+			return 500, string(outerr)
+		}
+		return jsonResponse(201, hook)
+	})...)
+
+	m.Get(WEBHOOKS+"/:id", withHandlers(handlers, func(params martini.Params, res http.ResponseWriter) (int, string) {
+		res.Header().Set("Content-Type", "application/json;charset=utf-8")
+		hook := webhooks.find(params["id"])
+		if hook == nil {
+			return 404, NOTFOUNDERROR
+		}
+		return jsonResponse(200, redactWebhook(hook))
+	})...)
+
+	m.Delete(WEBHOOKS+"/:id", withHandlers(handlers, func(params martini.Params) (int, string) {
+		found := false
+		err := webhooks.update(db, func(hooks []*Webhook) []*Webhook {
+			out := make([]*Webhook, 0)
+			for _, hook := range hooks {
+				if hook.ID == params["id"] {
+					found = true
+					continue
+				}
+				out = append(out, hook)
+			}
+			return out
+		})
+		if err != nil {
+			outerr, _ := json.Marshal(err.Error())
+			return 500, string(outerr)
+		}
+		if !found {
+			return 404, NOTFOUNDERROR
+		}
+		return 200, ""
+	})...)
+
+	m.Get(WEBHOOKS+"/:id/deliveries", withHandlers(handlers, func(params martini.Params, res http.ResponseWriter) (int, string) {
+		res.Header().Set("Content-Type", "application/json;charset=utf-8")
+		if webhooks.find(params["id"]) == nil {
+			return 404, NOTFOUNDERROR
+		}
+		return jsonResponse(200, webhooks.deliveries(params["id"]))
+	})...)
+}
+
+// jsonResponse marshals a response body, or returns a 500 if it can't be.
+func jsonResponse(code int, body interface{}) (int, string) {
+	out, err := json.Marshal(body)
+	if err != nil {
+		outerr, _ := json.Marshal(err.Error())
+		return 500, string(outerr)
+	}
+	return code, string(out)
+}
+
+// withHandlers appends a handler to a copy of a list of handlers, so routes
+// don't share the list.
+func withHandlers(handlers []martini.Handler, h martini.Handler) []martini.Handler {
+	out := make([]martini.Handler, 0, len(handlers)+1)
+	return append(append(out, handlers...), h)
+}
@@ -0,0 +1,100 @@
+package dragonfruit
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// the HMAC-SHA256 example from Wikipedia
+	got := SignWebhook("key", []byte("The quick brown fox jumps over the lazy dog"))
+	want := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":"1","event":"insert"}`)
+	signature := SignWebhook("sekrit", body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{"valid signatures", "sekrit", body, signature, true},
+		{"wrong secrets", "other", body, signature, false},
+		{"changed bodies", "sekrit", []byte(`{"id":"2","event":"insert"}`), signature, false},
+		{"missing prefixes", "sekrit", body, signature[len("sha256="):], false},
+		{"upper case hex", "sekrit", body, "sha256=" + strings.ToUpper(signature[len("sha256="):]), false},
+		{"truncated signatures", "sekrit", body, signature[:len(signature)-2], false},
+		{"empty signatures", "sekrit", body, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyWebhookSignature(tt.secret, tt.body, tt.signature); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		hook  Webhook
+		event ChangeEvent
+		want  bool
+	}{
+		{"every change", Webhook{}, ChangeEvent{Type: "insert", Path: "/people/1"}, true},
+		{"subscribed events", Webhook{Events: []string{"insert", "delete"}},
+			ChangeEvent{Type: "delete", Path: "/people/1"}, true},
+		{"other events", Webhook{Events: []string{"insert"}},
+			ChangeEvent{Type: "update", Path: "/people/1"}, false},
+		{"subscribed paths", Webhook{Paths: []string{"/people"}},
+			ChangeEvent{Type: "insert", Path: "/people"}, true},
+		{"sub-resources of paths", Webhook{Paths: []string{"/people/"}},
+			ChangeEvent{Type: "insert", Path: "/people/1/pets/2"}, true},
+		{"paths sharing a prefix", Webhook{Paths: []string{"/people"}},
+			ChangeEvent{Type: "insert", Path: "/peoplefinder/1"}, false},
+		{"other paths", Webhook{Paths: []string{"/pets", "/people"}},
+			ChangeEvent{Type: "insert", Path: "/places/1"}, false},
+		{"paths and events", Webhook{Paths: []string{"/people"}, Events: []string{"update"}},
+			ChangeEvent{Type: "insert", Path: "/people/1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hook.matches(&tt.event); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		want     bool
+	}{
+		{"/people", "/people", true},
+		{"/people/{personId}", "/people/4", true},
+		{"/people/{personId}/pets/{petId}", "/people/4/pets/2", true},
+		{"/people/{personId}", "/people", false},
+		{"/people/{personId}", "/people/4/pets", false},
+		{"/people/{personId}/pets", "/people/4/toys", false},
+		{"/people/_search", "/people/4", false},
+	}
+
+	for _, tt := range tests {
+		segments := strings.Split(strings.Trim(tt.path, "/"), "/")
+		if got := matchTemplate(tt.template, segments); got != tt.want {
+			t.Errorf("matchTemplate(%q, %q) = %v, want %v", tt.template, tt.path, got, tt.want)
+		}
+	}
+}
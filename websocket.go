@@ -0,0 +1,184 @@
+package dragonfruit
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The GUID used to accept WebSocket handshakes (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// isWebSocket reports whether a request asks to be upgraded to a WebSocket.
+func isWebSocket(req *http.Request) bool {
+	return strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket upgrades a request to a WebSocket and sends events as text
+// messages until the client closes it.  Messages from the client are
+// ignored, apart from pings and close frames.
+func serveWebSocket(res http.ResponseWriter, req *http.Request,
+	events <-chan *ChangeEvent) {
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	hijacker, ok := res.(http.Hijacker)
+	if key == "" || !ok {
+		writeError(res, 400, "The WebSocket handshake is not valid.")
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+
+	// frames from the client are read in the background, so the
+	// connection closes as soon as the client goes away
+	closed := make(chan struct{})
+	pings := make(chan []byte, 1)
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := readFrame(rw.Reader)
+			if err != nil || opcode == wsClose {
+				return
+			}
+			if opcode == wsPing {
+				select {
+				case pings <- payload:
+				default:
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(changeKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				writeFrame(rw.Writer, wsClose, nil)
+				return
+			}
+			data, jsonErr := json.Marshal(ev)
+			if jsonErr != nil {
+				continue
+			}
+			err = writeFrame(rw.Writer, wsText, data)
+		case payload := <-pings:
+			err = writeFrame(rw.Writer, wsPong, payload)
+		case <-ticker.C:
+			err = writeFrame(rw.Writer, wsPing, nil)
+		case <-closed:
+			writeFrame(rw.Writer, wsClose, nil)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeFrame writes a single unmasked frame, as sent by servers.
+func writeFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readFrame reads a single frame sent by a client and unmasks its payload.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// clients only send control frames and small messages, so anything
+	// large is discarded rather than buffered
+	if length > 1<<16 {
+		_, err := io.CopyN(ioutil.Discard, r, int64(length))
+		return opcode, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		if masked {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}